@@ -0,0 +1,222 @@
+// Package audit records who did what to which account. Events are only ever
+// appended; nothing here can change or remove one once it is written, and
+// each carries the hash of the one before so changes made behind its back
+// can be found with Verify.
+package audit
+
+import (
+	"fmt"
+	"github.com/mthorning/go-sso/config"
+	"log"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// AuditSinks is a comma separated list of "store", "file" and
+	// "syslog". Every event goes to all of them; the first that can be
+	// searched backs the admin page.
+	AuditSinks []string `default:"store" split_words:"true"`
+	AuditFile  string   `default:"audit.log" split_words:"true"`
+	// AuditSyslogTag is sent with every syslog message; the local syslog
+	// daemon is used unless AuditSyslogAddr is set.
+	AuditSyslogTag     string `default:"go-sso" split_words:"true"`
+	AuditSyslogNetwork string `default:"udp" split_words:"true"`
+	AuditSyslogAddr    string `split_words:"true"`
+	// A signed checkpoint is added after AuditCheckpointEvents events, or
+	// after AuditCheckpointInterval if there have been any since the last.
+	AuditCheckpointEvents   int           `default:"100" split_words:"true"`
+	AuditCheckpointInterval time.Duration `default:"1h" split_words:"true"`
+	// AuditQueue is how many events can wait to be written to the sinks.
+	// Events logged while it is full are dropped, and show as missing when
+	// the chain is verified.
+	AuditQueue int `default:"1000" split_words:"true"`
+}
+
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+type Event struct {
+	ID   string
+	Time time.Time
+	// Actor is the ID of the user who acted, empty when nobody is signed
+	// in, as with a failed login.
+	Actor string
+	// Target is the ID of the user acted on, or the address tried for a
+	// login to an account that doesn't exist.
+	Target    string
+	Action    string
+	IP        string
+	UserAgent string
+	Outcome   string
+	Detail    string `json:",omitempty"`
+	// Seq numbers events from 1 with no gaps. PrevHash is the Hash of the
+	// event before, and Hash covers every other field.
+	Seq      int64
+	PrevHash string
+	Hash     string
+	// Signature is only set on checkpoints.
+	Signature string `json:",omitempty"`
+}
+
+type Sink interface {
+	Write(e Event) error
+}
+
+// Searcher is a sink that can read its events back.
+type Searcher interface {
+	Search(f Filter) ([]Event, error)
+}
+
+// Filter selects events for Search. Empty fields match everything; Action
+// matches by prefix so "login" finds both successes and failures.
+type Filter struct {
+	Actor   string
+	Target  string
+	Action  string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func (f Filter) Match(e Event) bool {
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+	if f.Target != "" && e.Target != f.Target {
+		return false
+	}
+	if f.Action != "" && !strings.HasPrefix(e.Action, f.Action) {
+		return false
+	}
+	if f.Outcome != "" && e.Outcome != f.Outcome {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+type NotSearchableError struct{}
+
+func (e NotSearchableError) Error() string {
+	return "None of the configured audit sinks can be searched"
+}
+
+var (
+	Conf     Config
+	sinks    []Sink
+	searcher Searcher
+	queue    chan Event
+)
+
+func init() {
+	config.SetConfig(&Conf)
+}
+
+// Start opens the sinks and carries the chain on from where it was left.
+// Events logged before it are dropped.
+func Start() error {
+	if err := loadHead(); err != nil {
+		return fmt.Errorf("error initializing audit log: %v", err)
+	}
+	for _, name := range Conf.AuditSinks {
+		sink, err := newSink(strings.TrimSpace(name))
+		if err != nil {
+			return fmt.Errorf("error initializing audit log: %v", err)
+		}
+		sinks = append(sinks, sink)
+		if s, ok := sink.(Searcher); ok && searcher == nil {
+			searcher = s
+		}
+	}
+
+	mu.Lock()
+	queue = make(chan Event, Conf.AuditQueue)
+	mu.Unlock()
+	go writeSinks(queue)
+	go checkpointEvery(Conf.AuditCheckpointInterval)
+	return nil
+}
+
+func newSink(name string) (Sink, error) {
+	switch name {
+	case "store":
+		return newStoreSink(), nil
+	case "file":
+		return newFileSink(Conf.AuditFile)
+	case "syslog":
+		return newSyslogSink(Conf.AuditSyslogNetwork, Conf.AuditSyslogAddr, Conf.AuditSyslogTag)
+	}
+	return nil, fmt.Errorf("unknown audit sink %q", name)
+}
+
+// Log adds e to the chain and queues it for every sink. A sink that fails
+// doesn't stop the others, and the error is only reported so that auditing
+// never blocks a request.
+func Log(e Event) {
+	if e.Outcome == "" {
+		e.Outcome = Success
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if queue == nil {
+		return
+	}
+	write(e)
+	if Conf.AuditCheckpointEvents > 0 && sinceCheckpoint >= Conf.AuditCheckpointEvents {
+		checkpoint()
+	}
+}
+
+// write must be called with mu held.
+func write(e Event) {
+	// kept to the microsecond so the hash survives a round trip through
+	// any store
+	e.Time = time.Now().Truncate(time.Microsecond)
+	e.ID = newID(e.Time)
+	e.Seq = head.Seq + 1
+	e.PrevHash = head.Hash
+	e.Hash = e.digest()
+
+	select {
+	case queue <- e:
+	default:
+		log.Printf("audit queue is full, dropping event %d %s\n", e.Seq, e.Action)
+	}
+	head = chainHead{Seq: e.Seq, Hash: e.Hash}
+	if err := chain.Set("head", head); err != nil {
+		log.Printf("error saving audit chain: %v\n", err)
+	}
+	sinceCheckpoint++
+}
+
+// writeSinks writes events in the order they were logged, so that a slow
+// sink holds up only the queue.
+func writeSinks(queue <-chan Event) {
+	for e := range queue {
+		for _, sink := range sinks {
+			if err := sink.Write(e); err != nil {
+				log.Printf("error writing audit event %s: %v\n", e.Action, err)
+			}
+		}
+	}
+}
+
+// Search returns matching events, newest first.
+func Search(f Filter) ([]Event, error) {
+	if searcher == nil {
+		return nil, NotSearchableError{}
+	}
+	if f.Limit <= 0 {
+		f.Limit = 200
+	}
+	return searcher.Search(f)
+}
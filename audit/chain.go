@@ -0,0 +1,199 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/mthorning/go-sso/jwt"
+	"github.com/mthorning/go-sso/store"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const checkpointAction = "audit.checkpoint"
+
+// chainHead is the last event written. It is kept in the store so the chain
+// carries on across restarts, and so Verify can tell when events have been
+// removed from the end. The chain assumes a single instance is writing.
+type chainHead struct {
+	Seq  int64
+	Hash string
+}
+
+// checkpointClaims is what a checkpoint signs: the event it follows.
+type checkpointClaims struct {
+	Seq  int64     `json:"seq"`
+	Hash string    `json:"hash"`
+	Time time.Time `json:"time"`
+}
+
+var (
+	mu              sync.Mutex
+	chain           = store.Open("audit-chain")
+	head            chainHead
+	sinceCheckpoint int
+)
+
+func loadHead() error {
+	err := chain.Get("head", &head)
+	if _, ok := err.(store.NotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+func (e Event) digest() string {
+	e.Hash = ""
+	e.Time = e.Time.UTC()
+	data, err := json.Marshal(e)
+	if err != nil {
+		// an Event only holds strings, numbers and a time
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkpoint signs the head of the chain and appends the signature as an
+// event. Rewriting the chain before it would mean forging the signature.
+// It must be called with mu held.
+func checkpoint() {
+	sig, err := jwt.Sign(checkpointClaims{
+		Seq:  head.Seq,
+		Hash: head.Hash,
+		Time: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("error signing audit checkpoint: %v\n", err)
+		return
+	}
+	write(Event{
+		Action:    checkpointAction,
+		Outcome:   Success,
+		Detail:    fmt.Sprintf("events up to %d", head.Seq),
+		Signature: sig,
+	})
+	sinceCheckpoint = 0
+}
+
+func checkpointEvery(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		mu.Lock()
+		if sinceCheckpoint > 0 {
+			checkpoint()
+		}
+		mu.Unlock()
+	}
+}
+
+type Problem struct {
+	Seq    int64
+	Reason string
+}
+
+type Report struct {
+	Events      int
+	Checkpoints int
+	// Signed is the last event covered by a valid checkpoint. Anything
+	// after it could be removed without the chain showing it.
+	Signed int64
+	Last   int64
+	// Unchained counts events logged before chaining was added.
+	Unchained int
+	Problems  []Problem
+}
+
+// Verify walks the chain held by the JSON lines file at path, or by the
+// searchable sink when path is empty, and reports every break in it.
+func Verify(path string) (Report, error) {
+	var source Searcher = searcher
+	if path != "" {
+		source = &fileSink{path: path}
+	}
+	if source == nil {
+		return Report{}, NotSearchableError{}
+	}
+	events, err := source.Search(Filter{Limit: math.MaxInt32})
+	if err != nil {
+		return Report{}, err
+	}
+
+	mu.Lock()
+	if err := loadHead(); err != nil {
+		mu.Unlock()
+		return Report{}, err
+	}
+	last := head
+	mu.Unlock()
+	return verify(events, last), nil
+}
+
+// Span describes a run of events by their Seq.
+func Span(from, to int64) string {
+	if from == to {
+		return fmt.Sprintf("event %d", from)
+	}
+	return fmt.Sprintf("events %d to %d", from, to)
+}
+
+func verify(events []Event, last chainHead) Report {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Seq < events[j].Seq
+	})
+
+	var (
+		report Report
+		prev   Event
+	)
+	var problem = func(seq int64, format string, a ...interface{}) {
+		report.Problems = append(report.Problems, Problem{Seq: seq, Reason: fmt.Sprintf(format, a...)})
+	}
+	for _, e := range events {
+		if e.Seq == 0 {
+			report.Unchained++
+			continue
+		}
+		report.Events++
+
+		switch {
+		case e.Seq == prev.Seq:
+			problem(e.Seq, "event appears more than once")
+			continue
+		case e.Seq > prev.Seq+1:
+			problem(e.Seq, "missing %s", Span(prev.Seq+1, e.Seq-1))
+		case e.PrevHash != prev.Hash:
+			problem(e.Seq, "does not follow on from event %d", prev.Seq)
+		}
+		if e.Hash != e.digest() {
+			problem(e.Seq, "event has been altered")
+		}
+
+		if e.Action == checkpointAction {
+			report.Checkpoints++
+			var claims checkpointClaims
+			if err := jwt.Verify(e.Signature, &claims); err != nil {
+				problem(e.Seq, "checkpoint signature is not valid: %v", err)
+			} else if claims.Seq != e.Seq-1 || claims.Hash != e.PrevHash {
+				problem(e.Seq, "checkpoint was signed for a different event")
+			} else {
+				report.Signed = claims.Seq
+			}
+		}
+		prev = e
+	}
+	report.Last = prev.Seq
+
+	if last.Seq > prev.Seq {
+		problem(last.Seq, "missing %s from the end", Span(prev.Seq+1, last.Seq))
+	} else if last.Seq == prev.Seq && last.Hash != prev.Hash {
+		problem(last.Seq, "last event does not match the one recorded")
+	}
+	return report
+}
@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"github.com/mthorning/go-sso/jwt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// link sets Seq, PrevHash and Hash on events as write would.
+func link(events []Event) ([]Event, chainHead) {
+	var head chainHead
+	for i := range events {
+		events[i].Seq = head.Seq + 1
+		events[i].PrevHash = head.Hash
+		events[i].Hash = events[i].digest()
+		head = chainHead{Seq: events[i].Seq, Hash: events[i].Hash}
+	}
+	return events, head
+}
+
+// testChain is four events, a checkpoint signed with claims, and one more
+// event.
+func testChain(t *testing.T, claims func(events []Event) checkpointClaims) ([]Event, chainHead) {
+	start := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	var events []Event
+	for i := 0; i < 6; i++ {
+		events = append(events, Event{
+			Time:    start.Add(time.Duration(i) * time.Minute),
+			Actor:   "admin",
+			Target:  "user",
+			Action:  "user.update",
+			Outcome: Success,
+		})
+	}
+	events[4].Action = checkpointAction
+
+	events, _ = link(events)
+	sig, err := jwt.Sign(claims(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events[4].Signature = sig
+	return link(events)
+}
+
+func signsFourth(events []Event) checkpointClaims {
+	return checkpointClaims{Seq: events[3].Seq, Hash: events[3].Hash, Time: events[4].Time}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		// claims is what the checkpoint signs
+		claims func(events []Event) checkpointClaims
+		change func(events []Event, head chainHead) ([]Event, chainHead)
+		want   []Problem
+		// wantSigned is the last event covered by the checkpoint
+		wantSigned int64
+	}{
+		{"intact", signsFourth, nil, nil, 4},
+		{"altered event", signsFourth, func(events []Event, head chainHead) ([]Event, chainHead) {
+			events[1].Target = "someone else"
+			return events, head
+		}, []Problem{{2, "event has been altered"}}, 4},
+		{"missing middle event", signsFourth, func(events []Event, head chainHead) ([]Event, chainHead) {
+			return append(events[:2], events[3:]...), head
+		}, []Problem{{4, "missing event 3"}}, 4},
+		{"truncated tail", signsFourth, func(events []Event, head chainHead) ([]Event, chainHead) {
+			return events[:4], head
+		}, []Problem{{6, "missing events 5 to 6 from the end"}}, 0},
+		{"head replaced with the truncated tail", signsFourth, func(events []Event, head chainHead) ([]Event, chainHead) {
+			return events[:4], chainHead{Seq: 4, Hash: "rewritten"}
+		}, []Problem{{4, "last event does not match the one recorded"}}, 0},
+		{"duplicate seq", signsFourth, func(events []Event, head chainHead) ([]Event, chainHead) {
+			dup := events[2]
+			dup.Detail = "again"
+			dup.Hash = dup.digest()
+			return append(events, dup), head
+		}, []Problem{{3, "event appears more than once"}}, 4},
+		{"bad checkpoint signature", signsFourth, func(events []Event, head chainHead) ([]Event, chainHead) {
+			events[4].Signature += "x"
+			return link(events)
+		}, []Problem{{5, "checkpoint signature is not valid"}}, 0},
+		{"checkpoint signed for another event", func(events []Event) checkpointClaims {
+			return checkpointClaims{Seq: events[2].Seq, Hash: events[2].Hash, Time: events[4].Time}
+		}, nil, []Problem{{5, "checkpoint was signed for a different event"}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, head := testChain(t, tt.claims)
+			if tt.change != nil {
+				events, head = tt.change(events, head)
+			}
+			report := verify(events, head)
+
+			if len(report.Problems) != len(tt.want) {
+				t.Fatalf("got problems %+v, want %+v", report.Problems, tt.want)
+			}
+			for i, p := range report.Problems {
+				if p.Seq != tt.want[i].Seq || !strings.HasPrefix(p.Reason, tt.want[i].Reason) {
+					t.Errorf("got problem %+v, want %+v", p, tt.want[i])
+				}
+			}
+			if report.Signed != tt.wantSigned {
+				t.Errorf("Signed = %d, want %d", report.Signed, tt.wantSigned)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/mthorning/go-sso/store"
+	"sort"
+	"time"
+)
+
+// newID sorts in the order events were logged.
+func newID(t time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%019d-%s", t.UnixNano(), hex.EncodeToString(b))
+}
+
+type storeSink struct {
+	events store.Collection
+}
+
+func newStoreSink() *storeSink {
+	return &storeSink{events: store.Open("audit")}
+}
+
+func (s *storeSink) Write(e Event) error {
+	return s.events.Set(e.ID, e)
+}
+
+// Search has the store narrow by time, actor, target and outcome. Actions
+// match by prefix, which the store can't do alongside a range of IDs, so
+// those are filtered here a page at a time.
+func (s *storeSink) Search(f Filter) ([]Event, error) {
+	q := store.Query{Equal: map[string]string{}, Descending: true, Limit: f.Limit}
+	for field, value := range map[string]string{"Actor": f.Actor, "Target": f.Target, "Outcome": f.Outcome} {
+		if value != "" {
+			q.Equal[field] = value
+		}
+	}
+	if !f.Since.IsZero() {
+		q.From = idAt(f.Since)
+	}
+	if !f.Until.IsZero() {
+		q.To = idAt(f.Until)
+	}
+
+	var events []Event
+	for {
+		docs, err := s.events.Find(q)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			var e Event
+			if err := doc.DataTo(&e); err != nil {
+				return nil, err
+			}
+			e.ID = doc.ID()
+			if f.Match(e) {
+				events = append(events, e)
+			}
+			if len(events) == f.Limit {
+				return events, nil
+			}
+		}
+		if q.Limit <= 0 || len(docs) < q.Limit {
+			return events, nil
+		}
+		q.To = docs[len(docs)-1].ID()
+	}
+}
+
+// idAt sorts before the ID of any event logged at t or later.
+func idAt(t time.Time) string {
+	return fmt.Sprintf("%019d", t.UnixNano())
+}
+
+func newestFirst(events []Event, limit int) []Event {
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID > events[j].ID
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events
+}
@@ -0,0 +1,69 @@
+package audit
+
+import (
+	"github.com/mthorning/go-sso/store"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func init() {
+	store.UseMemory()
+}
+
+func TestStoreSearch(t *testing.T) {
+	s := newStoreSink()
+	start := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	actions := []string{"login.success", "user.update", "login.failure", "user.update", "user.update", "login.success"}
+	for i, action := range actions {
+		e := Event{
+			Time:    start.Add(time.Duration(i) * time.Minute),
+			Actor:   "admin",
+			Action:  action,
+			Outcome: Success,
+			Detail:  string(rune('a' + i)),
+		}
+		if action == "login.failure" {
+			e.Actor, e.Outcome = "", Failure
+		}
+		e.ID = newID(e.Time)
+		if err := s.Write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   string
+	}{
+		{"newest first", Filter{Limit: 10}, "fedcba"},
+		{"limit", Filter{Limit: 2}, "fe"},
+		{"actor", Filter{Actor: "admin", Limit: 10}, "fedba"},
+		{"outcome", Filter{Outcome: Failure, Limit: 10}, "c"},
+		{"action prefix", Filter{Action: "login", Limit: 10}, "fca"},
+		// only one login in each page of two
+		{"action prefix past a page", Filter{Action: "login", Limit: 2}, "fc"},
+		{"since", Filter{Since: start.Add(3 * time.Minute), Limit: 10}, "fed"},
+		{"until", Filter{Until: start.Add(2 * time.Minute), Limit: 10}, "ba"},
+		{"since and until", Filter{Since: start.Add(time.Minute), Until: start.Add(4 * time.Minute), Action: "user", Limit: 10}, "db"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := s.Search(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			for _, e := range events {
+				got += e.Detail
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(events, newestFirst(append([]Event{}, events...), tt.filter.Limit)) {
+				t.Error("events are not newest first")
+			}
+		})
+	}
+}
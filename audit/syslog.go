@@ -0,0 +1,34 @@
+package audit
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// syslogSink sends each event as JSON to the auth facility. It can't be
+// searched from the admin page.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogSink(network, addr, tag string) (*syslogSink, error) {
+	if addr == "" {
+		network = ""
+	}
+	writer, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) Write(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if e.Outcome == Failure {
+		return s.writer.Warning(string(line))
+	}
+	return s.writer.Info(string(line))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mthorning/go-sso/audit"
+	"os"
+)
+
+const usage = `Usage:
+  go-sso                      start the server
+  go-sso audit verify [-file path]
+                              check the audit log hash chain and checkpoints
+`
+
+// runCommand runs a command given on the command line and returns the exit
+// status.
+func runCommand(args []string) int {
+	if len(args) >= 2 && args[0] == "audit" && args[1] == "verify" {
+		return auditVerify(args[2:])
+	}
+	fmt.Fprint(os.Stderr, usage)
+	return 2
+}
+
+func auditVerify(args []string) int {
+	flags := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	file := flags.String("file", "", "verify this JSON lines file instead of the searchable sink")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := audit.Verify(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading audit log: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Checked %d events and %d checkpoints.\n", report.Events, report.Checkpoints)
+	if report.Unchained > 0 {
+		fmt.Printf("%d events were logged before chaining and can't be checked.\n", report.Unchained)
+	}
+	for _, p := range report.Problems {
+		fmt.Printf("event %d: %s\n", p.Seq, p.Reason)
+	}
+	if report.Signed < report.Last {
+		fmt.Printf("Not covered by a checkpoint yet: %s.\n", audit.Span(report.Signed+1, report.Last))
+	}
+	if len(report.Problems) > 0 {
+		fmt.Printf("The audit log has been tampered with: %d problems found.\n", len(report.Problems))
+		return 1
+	}
+	fmt.Println("The audit log is intact.")
+	return 0
+}
@@ -5,11 +5,16 @@ go 1.15
 require (
 	cloud.google.com/go/firestore v1.5.0
 	firebase.google.com/go/v4 v4.5.0
+	github.com/duo-labs/webauthn v0.0.0-20210727191636-9f1b88ef44cc
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.1
 	github.com/joho/godotenv v1.3.0
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
 	google.golang.org/api v0.45.0
+	google.golang.org/grpc v1.37.0
 )
@@ -0,0 +1,195 @@
+// Package invite manages the links admins send to let someone create their
+// own account. Invitations are stored so they can be listed, resent and
+// revoked; the token in the link is random and only its hash is stored, so
+// the store alone can't be used to accept one.
+package invite
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/mthorning/go-sso/config"
+	"github.com/mthorning/go-sso/store"
+	"github.com/nu7hatch/gouuid"
+	"sort"
+	"time"
+)
+
+type Config struct {
+	InvitationLifetime time.Duration `default:"168h" split_words:"true"`
+}
+
+type Invitation struct {
+	ID        string `firestore:"-"`
+	Email     string
+	Name      string
+	Roles     []string
+	InvitedBy string
+	Created   time.Time
+	Expires   time.Time
+	// TokenHash changes each time the invitation is resent, which is what
+	// makes links sent before then stop working.
+	TokenHash string
+}
+
+type InvalidTokenError struct{}
+
+func (e InvalidTokenError) Error() string {
+	return "This invitation is not valid. It may have been revoked or replaced by a newer one"
+}
+
+type ExpiredTokenError struct{}
+
+func (e ExpiredTokenError) Error() string {
+	return "This invitation has expired. Please ask for a new one"
+}
+
+var (
+	Conf        Config
+	invitations store.Collection
+)
+
+func init() {
+	config.SetConfig(&Conf)
+	invitations = store.Open("invitations")
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// New stores an invitation for inv.Email, replacing any sent to that
+// address before, and returns it with the token for the link.
+func New(inv Invitation) (Invitation, string, error) {
+	if err := revokeEmail(inv.Email); err != nil {
+		return Invitation{}, "", err
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return Invitation{}, "", err
+	}
+	inv.ID = u.String()
+	inv.Created = time.Now()
+	return save(inv)
+}
+
+// save gives inv a new token and expiry and stores it.
+func save(inv Invitation) (Invitation, string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return Invitation{}, "", err
+	}
+	inv.TokenHash = hashToken(token)
+	inv.Expires = time.Now().Add(Conf.InvitationLifetime)
+	if err := invitations.Set(inv.ID, inv); err != nil {
+		return Invitation{}, "", err
+	}
+	return inv, token, nil
+}
+
+func Get(id string) (Invitation, error) {
+	var inv Invitation
+	if err := invitations.Get(id, &inv); err != nil {
+		return Invitation{}, err
+	}
+	inv.ID = id
+	return inv, nil
+}
+
+// List returns the outstanding invitations, oldest first.
+func List() ([]Invitation, error) {
+	docs, err := invitations.List()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Invitation, 0, len(docs))
+	for _, doc := range docs {
+		var inv Invitation
+		if err := doc.DataTo(&inv); err != nil {
+			return nil, err
+		}
+		inv.ID = doc.ID()
+		list = append(list, inv)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+// Renew gives the invitation a new token and expiry, invalidating links
+// sent before.
+func Renew(id string) (Invitation, string, error) {
+	inv, err := Get(id)
+	if err != nil {
+		return Invitation{}, "", err
+	}
+	return save(inv)
+}
+
+func Revoke(id string) error {
+	return invitations.Delete(id)
+}
+
+func revokeEmail(email string) error {
+	docs, err := invitations.Where("Email", email)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		err := invitations.Delete(doc.ID())
+		if _, ok := err.(store.NotFoundError); err != nil && !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check returns the invitation a token was issued for without using it up.
+func Check(token string) (Invitation, error) {
+	docs, err := invitations.Where("TokenHash", hashToken(token))
+	if err != nil {
+		return Invitation{}, err
+	}
+	if len(docs) != 1 {
+		return Invitation{}, InvalidTokenError{}
+	}
+	var inv Invitation
+	if err := docs[0].DataTo(&inv); err != nil {
+		return Invitation{}, err
+	}
+	inv.ID = docs[0].ID()
+	if time.Now().After(inv.Expires) {
+		return Invitation{}, ExpiredTokenError{}
+	}
+	return inv, nil
+}
+
+// Redeem uses the invitation up and returns it.
+func Redeem(token string) (Invitation, error) {
+	inv, err := Check(token)
+	if err != nil {
+		return Invitation{}, err
+	}
+
+	err = invitations.Delete(inv.ID)
+	if _, ok := err.(store.NotFoundError); ok {
+		// accepted by someone else between the Check and the Delete
+		return Invitation{}, InvalidTokenError{}
+	}
+	if err != nil {
+		return Invitation{}, err
+	}
+	return inv, nil
+}
@@ -0,0 +1,102 @@
+package invite
+
+import (
+	"github.com/mthorning/go-sso/store"
+	"testing"
+	"time"
+)
+
+func init() {
+	store.UseMemory()
+}
+
+func TestTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		// use does whatever happens to the invitation after it's sent
+		use     func(t *testing.T, inv Invitation, token string)
+		wantErr error
+	}{
+		{"unused", func(t *testing.T, inv Invitation, token string) {}, nil},
+		{"accepted", func(t *testing.T, inv Invitation, token string) {
+			if _, err := Redeem(token); err != nil {
+				t.Fatal(err)
+			}
+		}, InvalidTokenError{}},
+		{"expired", func(t *testing.T, inv Invitation, token string) {
+			inv.Expires = time.Now().Add(-time.Minute)
+			if err := invitations.Set(inv.ID, inv); err != nil {
+				t.Fatal(err)
+			}
+		}, ExpiredTokenError{}},
+		{"resent", func(t *testing.T, inv Invitation, token string) {
+			if _, _, err := Renew(inv.ID); err != nil {
+				t.Fatal(err)
+			}
+		}, InvalidTokenError{}},
+		{"replaced", func(t *testing.T, inv Invitation, token string) {
+			if _, _, err := New(Invitation{Email: inv.Email}); err != nil {
+				t.Fatal(err)
+			}
+		}, InvalidTokenError{}},
+		{"revoked", func(t *testing.T, inv Invitation, token string) {
+			if err := Revoke(inv.ID); err != nil {
+				t.Fatal(err)
+			}
+		}, InvalidTokenError{}},
+		{"made up", func(t *testing.T, inv Invitation, token string) {}, InvalidTokenError{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv, token, err := New(Invitation{Email: tt.name + "@invite.test", Roles: []string{"helpdesk"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.use(t, inv, token)
+			if tt.name == "made up" {
+				token = inv.TokenHash
+			}
+
+			got, err := Check(token)
+			if tt.wantErr != nil {
+				if err != tt.wantErr {
+					t.Fatalf("Check = %+v, %v; want %v", got, err, tt.wantErr)
+				}
+				if _, err := Redeem(token); err == nil {
+					t.Fatal("Redeem of an invalid invitation succeeded")
+				}
+				return
+			}
+			if err != nil || got.ID != inv.ID || got.Email != inv.Email || len(got.Roles) != 1 {
+				t.Fatalf("Check = %+v, %v; want %+v", got, err, inv)
+			}
+
+			if _, err := Redeem(token); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Redeem(token); err == nil {
+				t.Fatal("invitation accepted twice")
+			}
+		})
+	}
+}
+
+func TestRenewChangesToken(t *testing.T) {
+	inv, token, err := New(Invitation{Email: "renewed@invite.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed, next, err := Renew(inv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == token || renewed.TokenHash == inv.TokenHash {
+		t.Fatal("resending kept the same token")
+	}
+	if renewed.TokenHash != hashToken(next) {
+		t.Error("token not stored as its hash")
+	}
+	if got, err := Check(next); err != nil || got.ID != inv.ID {
+		t.Errorf("Check of the resent token = %+v, %v", got, err)
+	}
+}
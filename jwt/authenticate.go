@@ -1,13 +1,36 @@
 package jwt
 
 import (
-	"errors"
-	"github.com/mthorning/go-sso/types"
+	"encoding/json"
+	"time"
 )
 
-func Authenticate(token string) (types.User, error) {
-	if !verifySignature(token) {
-		return types.User{}, errors.New("Invalid signature")
+// Authenticate parses the token, verifies its signature and validates its
+// registered claims. Its audience must include one of audiences, or the
+// configured audience if none are given.
+func Authenticate(token string, audiences ...string) (Claims, error) {
+	t, err := parse(token)
+	if err != nil {
+		return Claims{}, err
 	}
-	return decodeUser(token)
+	if err := verifySignature(t); err != nil {
+		return Claims{}, err
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(t.payload, &claims); err != nil {
+		return Claims{}, MalformedError{Reason: "payload is not a valid claims set"}
+	}
+	if err := claims.validate(time.Now(), audiences); err != nil {
+		return Claims{}, err
+	}
+
+	revoked, err := isRevoked(claims)
+	if err != nil {
+		return Claims{}, err
+	}
+	if revoked {
+		return Claims{}, RevokedError{}
+	}
+	return claims, nil
 }
@@ -0,0 +1,172 @@
+package jwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mthorning/go-sso/roles"
+	"math"
+	"time"
+)
+
+type Claims struct {
+	Issuer    string      `json:"iss,omitempty"`
+	Subject   string      `json:"sub,omitempty"`
+	Audience  Audience    `json:"aud,omitempty"`
+	ExpiresAt NumericDate `json:"exp,omitempty"`
+	NotBefore NumericDate `json:"nbf,omitempty"`
+	IssuedAt  NumericDate `json:"iat,omitempty"`
+	ID        string      `json:"jti,omitempty"`
+
+	ClientID string   `json:"client_id,omitempty"`
+	Scope    string   `json:"scope,omitempty"`
+	Nonce    string   `json:"nonce,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Email    string   `json:"email,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+	// Admin is kept for relying parties written before roles; it is set
+	// for users with the admin role.
+	Admin bool `json:"admin,omitempty"`
+}
+
+// SetRoles sets Roles, and Admin to match.
+func (c *Claims) SetRoles(userRoles []string) {
+	c.Roles = userRoles
+	c.Admin = false
+	for _, role := range userRoles {
+		if role == roles.Admin {
+			c.Admin = true
+		}
+	}
+}
+
+// NumericDate is seconds since the epoch. RFC 7519 allows fractions, so
+// they are accepted but dropped when decoding.
+type NumericDate int64
+
+func NewNumericDate(t time.Time) NumericDate {
+	return NumericDate(t.Unix())
+}
+
+func (n NumericDate) Time() time.Time {
+	return time.Unix(int64(n), 0)
+}
+
+func (n *NumericDate) UnmarshalJSON(data []byte) error {
+	var f float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*n = NumericDate(math.Floor(f))
+	return nil
+}
+
+// Audience is a list of recipients, serialised as a plain string when there
+// is only one as most relying parties expect.
+type Audience []string
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a Audience) Contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+type ExpiredError struct{}
+
+func (e ExpiredError) Error() string {
+	return "Token has expired"
+}
+
+type NotYetValidError struct{}
+
+func (e NotYetValidError) Error() string {
+	return "Token is not valid yet"
+}
+
+type IssuerError struct {
+	Issuer string
+}
+
+func (e IssuerError) Error() string {
+	return fmt.Sprintf("Token issuer %q is not trusted", e.Issuer)
+}
+
+type AudienceError struct {
+	Audience Audience
+}
+
+func (e AudienceError) Error() string {
+	return fmt.Sprintf("Token audience %q is not accepted", []string(e.Audience))
+}
+
+type MissingClaimError struct {
+	Claim string
+}
+
+func (e MissingClaimError) Error() string {
+	return fmt.Sprintf("Token is missing the %q claim", e.Claim)
+}
+
+// validate checks the registered claims. Any of audiences is accepted,
+// defaulting to the configured audience.
+func (c Claims) validate(now time.Time, audiences []string) error {
+	skew := Conf.ClockSkew
+
+	if c.ExpiresAt == 0 {
+		return MissingClaimError{Claim: "exp"}
+	}
+	if now.After(c.ExpiresAt.Time().Add(skew)) {
+		return ExpiredError{}
+	}
+	if c.NotBefore != 0 && now.Add(skew).Before(c.NotBefore.Time()) {
+		return NotYetValidError{}
+	}
+	// a token can't have been issued in the future
+	if c.IssuedAt != 0 && now.Add(skew).Before(c.IssuedAt.Time()) {
+		return NotYetValidError{}
+	}
+	if c.Issuer != Conf.Issuer {
+		return IssuerError{Issuer: c.Issuer}
+	}
+
+	if len(audiences) == 0 {
+		audiences = []string{DefaultAudience()}
+	}
+	for _, aud := range audiences {
+		if c.Audience.Contains(aud) {
+			return nil
+		}
+	}
+	return AudienceError{Audience: c.Audience}
+}
+
+// DefaultAudience is the audience of access tokens.
+func DefaultAudience() string {
+	if Conf.Audience == "" {
+		return Conf.Issuer
+	}
+	return Conf.Audience
+}
@@ -0,0 +1,73 @@
+package jwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	skew := int64(Conf.ClockSkew.Seconds())
+	at := func(offset int64) int64 { return now.Unix() + offset }
+	iss := Conf.Issuer
+	aud := DefaultAudience()
+
+	tests := []struct {
+		name      string
+		payload   string
+		audiences []string
+		want      error
+	}{
+		{"valid", fmt.Sprintf(`{"iss":%q,"aud":%q,"exp":%d}`, iss, aud, at(60)), nil, nil},
+		{"no exp", fmt.Sprintf(`{"iss":%q,"aud":%q}`, iss, aud), nil, MissingClaimError{Claim: "exp"}},
+		{"expired within leeway", fmt.Sprintf(`{"iss":%q,"aud":%q,"exp":%d}`, iss, aud, at(-skew)), nil, nil},
+		{"expired", fmt.Sprintf(`{"iss":%q,"aud":%q,"exp":%d}`, iss, aud, at(-skew-1)), nil, ExpiredError{}},
+		{"fractional exp", fmt.Sprintf(`{"iss":%q,"aud":%q,"exp":%d.9}`, iss, aud, at(-skew-1)), nil, ExpiredError{}},
+		{"nbf within leeway", fmt.Sprintf(`{"iss":%q,"aud":%q,"exp":%d,"nbf":%d}`, iss, aud, at(600), at(skew)), nil, nil},
+		{"nbf in the future", fmt.Sprintf(`{"iss":%q,"aud":%q,"exp":%d,"nbf":%d}`, iss, aud, at(600), at(skew+1)), nil, NotYetValidError{}},
+		{"iat within leeway", fmt.Sprintf(`{"iss":%q,"aud":%q,"exp":%d,"iat":%d}`, iss, aud, at(600), at(skew)), nil, nil},
+		{"iat in the future", fmt.Sprintf(`{"iss":%q,"aud":%q,"exp":%d,"iat":%d}`, iss, aud, at(600), at(skew+1)), nil, NotYetValidError{}},
+		{"issuer mismatch", fmt.Sprintf(`{"iss":"https://elsewhere.test","aud":%q,"exp":%d}`, aud, at(60)), nil, IssuerError{Issuer: "https://elsewhere.test"}},
+		{"no issuer", fmt.Sprintf(`{"aud":%q,"exp":%d}`, aud, at(60)), nil, IssuerError{}},
+		{"audience list", fmt.Sprintf(`{"iss":%q,"aud":["other",%q],"exp":%d}`, iss, aud, at(60)), nil, nil},
+		{"audience list without us", fmt.Sprintf(`{"iss":%q,"aud":["other","another"],"exp":%d}`, iss, at(60)), nil, AudienceError{Audience: Audience{"other", "another"}}},
+		{"wrong audience", fmt.Sprintf(`{"iss":%q,"aud":"other","exp":%d}`, iss, at(60)), nil, AudienceError{Audience: Audience{"other"}}},
+		{"no audience", fmt.Sprintf(`{"iss":%q,"exp":%d}`, iss, at(60)), nil, AudienceError{}},
+		{"one of the accepted audiences", fmt.Sprintf(`{"iss":%q,"aud":"client","exp":%d}`, iss, at(60)), []string{"api", "client"}, nil},
+		{"default audience not accepted when others are given", fmt.Sprintf(`{"iss":%q,"aud":%q,"exp":%d}`, iss, aud, at(60)), []string{"client"}, AudienceError{Audience: Audience{aud}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims Claims
+			if err := json.Unmarshal([]byte(tt.payload), &claims); err != nil {
+				t.Fatal(err)
+			}
+			if err := claims.validate(now, tt.audiences); !reflect.DeepEqual(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAudienceJSON(t *testing.T) {
+	tests := []struct {
+		aud  Audience
+		json string
+	}{
+		{Audience{"one"}, `"one"`},
+		{Audience{"one", "two"}, `["one","two"]`},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.aud)
+		if err != nil || string(data) != tt.json {
+			t.Errorf("Marshal(%v) = %s, %v; want %s", tt.aud, data, err, tt.json)
+		}
+		var got Audience
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil || !reflect.DeepEqual(got, tt.aud) {
+			t.Errorf("Unmarshal(%s) = %v, %v; want %v", tt.json, got, err, tt.aud)
+		}
+	}
+}
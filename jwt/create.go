@@ -4,40 +4,67 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/mthorning/go-sso/config"
-	"github.com/mthorning/go-sso/types"
 	"github.com/nu7hatch/gouuid"
+	"log"
 	"time"
 )
 
 type Config struct {
 	Secret string `default:"devsecret"`
+	// SigningKeys is a comma separated list of PEM files. The first signs
+	// new tokens; keep retired keys listed after it until the tokens they
+	// signed have expired, and for as long as audit checkpoints they signed
+	// need verifying.
+	SigningKeys   []string      `split_words:"true"`
+	Issuer        string        `default:"http://localhost:8080"`
+	Audience      string        // defaults to Issuer
+	TokenLifetime time.Duration `default:"1h" split_words:"true"`
+	ClockSkew     time.Duration `default:"30s" split_words:"true"`
+	// RevocationStore is "store" to share revocations through the
+	// configured store, or "memory" for a single instance.
+	RevocationStore         string        `default:"store" split_words:"true"`
+	RevocationSweepInterval time.Duration `default:"1h" split_words:"true"`
 }
 
 var Conf Config
 
 func init() {
 	config.SetConfig(&Conf)
+	if err := loadKeys(Conf.SigningKeys); err != nil {
+		log.Fatalf("error loading signing keys: %v\n", err)
+	}
+	Revocations = newRevocationStore(Conf.RevocationStore)
 }
 
-func New(user types.User) (string, error) {
+// New signs a token for subject. The registered claims are filled in, the
+// audience and expiry only if not already set on claims; anything else
+// about the subject must be set by the caller.
+func New(subject string, claims Claims) (string, error) {
 	header := map[string]string{
-		"alg": "HS256",
+		"alg": Algorithm(),
 		"typ": "JWT",
 	}
+	if signingKey != nil {
+		header["kid"] = signingKey.id
+	}
 
 	u, err := uuid.NewV4()
 	if err != nil {
 		return "", err
 	}
 
-	payload := map[string]interface{}{
-		"jti":   u.String(),
-		"iat":   time.Now(),
-		"name":  user.Name,
-		"email": user.Email,
-		"admin": user.Admin,
+	now := time.Now()
+	claims.ID = u.String()
+	claims.Issuer = Conf.Issuer
+	claims.Subject = subject
+	claims.IssuedAt = NewNumericDate(now)
+	claims.NotBefore = claims.IssuedAt
+	if claims.ExpiresAt == 0 {
+		claims.ExpiresAt = NewNumericDate(now.Add(Conf.TokenLifetime))
+	}
+	if len(claims.Audience) == 0 {
+		claims.Audience = Audience{DefaultAudience()}
 	}
-
 	jsonHeader, err := json.Marshal(header)
 	if err != nil {
 		return "", err
@@ -45,14 +72,17 @@ func New(user types.User) (string, error) {
 
 	h := encode(jsonHeader)
 
-	jsonPayload, err := json.Marshal(payload)
+	jsonPayload, err := json.Marshal(claims)
 	if err != nil {
 		return "", err
 	}
 
 	p := encode(jsonPayload)
 
-	s := createSignature(h, p)
+	s, err := createSignature(h, p)
+	if err != nil {
+		return "", err
+	}
 
 	return fmt.Sprintf("%s.%s.%s", h, p, s), nil
 }
@@ -0,0 +1,31 @@
+package jwt
+
+type JWK map[string]string
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Algorithm is the "alg" used to sign tokens from New.
+func Algorithm() string {
+	if signingKey == nil {
+		return "HS256"
+	}
+	return signingKey.alg
+}
+
+// JWKS returns the public keys relying parties can verify tokens with,
+// including retired keys still within their rotation window. HS256 uses a
+// shared secret which must never be published, so without signing keys the
+// set is empty.
+func JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, k := range verificationKeys {
+		j := k.jwk()
+		j["kid"] = k.id
+		j["alg"] = k.alg
+		j["use"] = "sig"
+		set.Keys = append(set.Keys, j)
+	}
+	return set
+}
@@ -0,0 +1,213 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+)
+
+type key struct {
+	id      string
+	alg     string
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+var (
+	// signingKey is nil when no keys are configured, in which case tokens
+	// are signed with HS256 and Conf.Secret.
+	signingKey       *key
+	verificationKeys []*key
+)
+
+// loadKeys reads PEM encoded keys. The first must be a private key and is
+// used to sign new tokens; the rest may be private or public keys and are
+// only used to verify tokens signed before a rotation.
+func loadKeys(paths []string) error {
+	for i, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		k, err := parseKey(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if i == 0 {
+			if k.private == nil {
+				return fmt.Errorf("%s: the signing key must be a private key", path)
+			}
+			signingKey = k
+		}
+		verificationKeys = append(verificationKeys, k)
+	}
+	return nil
+}
+
+func findKey(kid string) (*key, bool) {
+	for _, k := range verificationKeys {
+		if k.id == kid {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+func parseKey(data []byte) (*key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var (
+		parsed interface{}
+		err    error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &key{}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		k.private = signer
+		k.public = signer.Public()
+	} else {
+		k.public = parsed
+	}
+
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		k.alg = "RS256"
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		k.alg = "ES256"
+	case ed25519.PublicKey:
+		k.alg = "EdDSA"
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+
+	k.id, err = thumbprint(k.jwk())
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *key) jwk() JWK {
+	var j JWK
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		j = JWK{
+			"kty": "RSA",
+			"n":   encode(pub.N.Bytes()),
+			"e":   encode(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		j = JWK{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   encode(pad(pub.X.Bytes(), 32)),
+			"y":   encode(pad(pub.Y.Bytes(), 32)),
+		}
+	case ed25519.PublicKey:
+		j = JWK{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   encode(pub),
+		}
+	}
+	return j
+}
+
+// thumbprint is the RFC 7638 key ID: the hash of the required members
+// only, which json.Marshal already emits in lexicographic order.
+func thumbprint(j JWK) (string, error) {
+	required := map[string]string{}
+	for _, m := range []string{"crv", "e", "kty", "n", "x", "y"} {
+		if v, ok := j[m]; ok {
+			required[m] = v
+		}
+	}
+	data, err := json.Marshal(required)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return encode(sum[:]), nil
+}
+
+func pad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func (k *key) sign(input []byte) ([]byte, error) {
+	switch priv := k.private.(type) {
+	case *rsa.PrivateKey:
+		hash := sha256.Sum256(input)
+		return rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		// JWS wants fixed width r||s rather than the ASN.1 DER of crypto.Signer
+		hash := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, priv, hash[:])
+		if err != nil {
+			return nil, err
+		}
+		return append(pad(r.Bytes(), 32), pad(s.Bytes(), 32)...), nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(priv, input), nil
+	}
+	return nil, errors.New("key cannot sign")
+}
+
+func (k *key) verify(input, sig []byte) bool {
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return false
+		}
+		hash := sha256.Sum256(input)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, hash[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, input, sig)
+	}
+	return false
+}
@@ -0,0 +1,298 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/mthorning/go-sso/store"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func init() {
+	store.UseMemory()
+}
+
+func generateKeys(t *testing.T) (*rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsaKey, ecKey, edKey
+}
+
+func pemBlock(t *testing.T, blockType string, der []byte, err error) []byte {
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func pkcs8(t *testing.T, k crypto.Signer) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	return pemBlock(t, "PRIVATE KEY", der, err)
+}
+
+func pkix(t *testing.T, k crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(k)
+	return pemBlock(t, "PUBLIC KEY", der, err)
+}
+
+// useKeys configures keys for the rest of the test, signing with the first.
+func useKeys(t *testing.T, keys ...*key) {
+	oldSigning, oldVerification := signingKey, verificationKeys
+	t.Cleanup(func() {
+		signingKey, verificationKeys = oldSigning, oldVerification
+	})
+	signingKey, verificationKeys = keys[0], keys
+}
+
+func mustParseKey(t *testing.T, data []byte) *key {
+	k, err := parseKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestParseKey(t *testing.T) {
+	rsaKey, ecKey, edKey := generateKeys(t)
+	smallRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, ecErr := x509.MarshalECPrivateKey(ecKey)
+	rsaFile, err := ioutil.ReadFile("testdata/rsa.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantAlg     string
+		wantPrivate bool
+		wantErr     bool
+	}{
+		{"RSA PKCS#8", pkcs8(t, rsaKey), "RS256", true, false},
+		{"RSA PKCS#1", pemBlock(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), nil), "RS256", true, false},
+		{"RSA file", rsaFile, "RS256", true, false},
+		{"RSA public", pkix(t, &rsaKey.PublicKey), "RS256", false, false},
+		{"RSA PKCS#1 public", pemBlock(t, "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey), nil), "RS256", false, false},
+		{"EC PKCS#8", pkcs8(t, ecKey), "ES256", true, false},
+		{"EC SEC 1", pemBlock(t, "EC PRIVATE KEY", ecDER, ecErr), "ES256", true, false},
+		{"EC public", pkix(t, &ecKey.PublicKey), "ES256", false, false},
+		{"Ed25519", pkcs8(t, edKey), "EdDSA", true, false},
+		{"Ed25519 public", pkix(t, edKey.Public()), "EdDSA", false, false},
+		{"RSA under 2048 bits", pkcs8(t, smallRSA), "", false, true},
+		{"P-384", pkcs8(t, p384), "", false, true},
+		{"unsupported block", pemBlock(t, "CERTIFICATE", []byte{1}, nil), "", false, true},
+		{"not PEM", []byte("not a key"), "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := parseKey(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsed as %s", k.alg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.alg != tt.wantAlg {
+				t.Errorf("alg = %s, want %s", k.alg, tt.wantAlg)
+			}
+			if (k.private != nil) != tt.wantPrivate {
+				t.Errorf("private key loaded = %v, want %v", k.private != nil, tt.wantPrivate)
+			}
+			if k.id == "" {
+				t.Error("no key ID")
+			}
+		})
+	}
+}
+
+func TestKeyIDsMatchPrivateAndPublic(t *testing.T) {
+	rsaKey, ecKey, edKey := generateKeys(t)
+	for _, k := range []crypto.Signer{rsaKey, ecKey, edKey} {
+		private, public := mustParseKey(t, pkcs8(t, k)), mustParseKey(t, pkix(t, k.Public()))
+		if private.id != public.id {
+			t.Errorf("%s: private key ID %s, public %s", private.alg, private.id, public.id)
+		}
+	}
+}
+
+// TestThumbprint checks against the example in RFC 7638 section 3.1.
+func TestThumbprint(t *testing.T) {
+	n, err := decode("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &key{public: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}}
+	j := k.jwk()
+	// members outside the required set don't change it
+	j["alg"], j["kid"] = "RS256", "2011-04-29"
+
+	got, err := thumbprint(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestES256Signature(t *testing.T) {
+	_, ecKey, _ := generateKeys(t)
+	k := mustParseKey(t, pkcs8(t, ecKey))
+	input := []byte("header.payload")
+	hash := sha256.Sum256(input)
+
+	// enough signatures that some r or s is short and needs padding
+	for i := 0; i < 200; i++ {
+		sig, err := k.sign(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sig) != 64 {
+			t.Fatalf("signature is %d bytes, want r||s in 64", len(sig))
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(&ecKey.PublicKey, hash[:], r, s) {
+			t.Fatal("r||s does not verify")
+		}
+		if !k.verify(input, sig) {
+			t.Fatal("key doesn't verify its own signature")
+		}
+	}
+
+	der, err := ecKey.Sign(rand.Reader, hash[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.verify(input, der) {
+		t.Error("ASN.1 DER signature accepted")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, ecKey, edKey := generateKeys(t)
+	keys := []*key{
+		mustParseKey(t, pkcs8(t, rsaKey)),
+		mustParseKey(t, pkcs8(t, ecKey)),
+		mustParseKey(t, pkix(t, edKey.Public())),
+	}
+	useKeys(t, keys...)
+
+	data, err := json.Marshal(JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != len(keys) {
+		t.Fatalf("got %d keys, want %d", len(set.Keys), len(keys))
+	}
+
+	want := []map[string]string{
+		{"kty": "RSA", "alg": "RS256", "e": "AQAB"},
+		{"kty": "EC", "alg": "ES256", "crv": "P-256"},
+		{"kty": "OKP", "alg": "EdDSA", "crv": "Ed25519"},
+	}
+	for i, j := range set.Keys {
+		for member, value := range want[i] {
+			if j[member] != value {
+				t.Errorf("key %d: %s = %q, want %q", i, member, j[member], value)
+			}
+		}
+		if j["kid"] != keys[i].id || j["use"] != "sig" {
+			t.Errorf("key %d: kid %q, use %q", i, j["kid"], j["use"])
+		}
+		if _, ok := j["d"]; ok {
+			t.Errorf("key %d publishes its private part", i)
+		}
+	}
+	// coordinates are fixed width, whatever their value
+	for _, member := range []string{"x", "y"} {
+		if b, err := decode(set.Keys[1][member]); err != nil || len(b) != 32 {
+			t.Errorf("EC %s is %d bytes, %v", member, len(b), err)
+		}
+	}
+}
+
+func TestSignAndVerifyWithKeys(t *testing.T) {
+	rsaKey, ecKey, edKey := generateKeys(t)
+	rsaPriv, ecPriv, edPriv := mustParseKey(t, pkcs8(t, rsaKey)), mustParseKey(t, pkcs8(t, ecKey)), mustParseKey(t, pkcs8(t, edKey))
+
+	for _, k := range []*key{rsaPriv, ecPriv, edPriv} {
+		t.Run(k.alg, func(t *testing.T) {
+			useKeys(t, k)
+			token, err := New("subject", Claims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := Authenticate(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "subject" {
+				t.Errorf("sub = %q", claims.Subject)
+			}
+
+			parts := strings.Split(token, ".")
+			parts[1] = encode([]byte(`{"sub":"someone else"}`))
+			if _, err := Authenticate(strings.Join(parts, ".")); err == nil {
+				t.Error("token with a changed payload accepted")
+			}
+		})
+	}
+
+	// a token is only checked with the algorithm of the key it names
+	useKeys(t, ecPriv, rsaPriv)
+	token, err := New("subject", Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	parts[0] = encode([]byte(`{"alg":"RS256","typ":"JWT","kid":"` + ecPriv.id + `"}`))
+	if _, err := Authenticate(strings.Join(parts, ".")); err == nil {
+		t.Fatal("token claiming RS256 with the ES256 key accepted")
+	} else if _, ok := err.(AlgorithmError); !ok {
+		t.Errorf("got %v, want AlgorithmError", err)
+	}
+
+	useKeys(t, rsaPriv)
+	parts[0] = encode([]byte(`{"alg":"ES256","typ":"JWT","kid":"` + ecPriv.id + `"}`))
+	if _, err := Authenticate(strings.Join(parts, ".")); err == nil {
+		t.Fatal("ES256 token accepted with only an RSA key configured")
+	} else if _, ok := err.(AlgorithmError); !ok {
+		t.Errorf("got %v, want AlgorithmError", err)
+	}
+}
@@ -4,40 +4,53 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"github.com/mthorning/go-sso/types"
-	"strings"
 )
 
 func encode(part []byte) string {
 	return base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(part)
 }
 
-func createSignature(h, p string) string {
-	hp := fmt.Sprintf("%s.%s", h, p)
+func decode(part string) ([]byte, error) {
+	return base64.URLEncoding.WithPadding(base64.NoPadding).Strict().DecodeString(part)
+}
+
+func hmacSignature(hp string) []byte {
 	hash := hmac.New(sha256.New, []byte(Conf.Secret))
 	hash.Write([]byte(hp))
-	return encode(hash.Sum(nil))
+	return hash.Sum(nil)
 }
 
-func verifySignature(token string) bool {
-	hps := strings.Split(token, ".")
-	s := createSignature(hps[0], hps[1])
-	return hps[2] == s
+func createSignature(h, p string) (string, error) {
+	hp := fmt.Sprintf("%s.%s", h, p)
+	if signingKey == nil {
+		return encode(hmacSignature(hp)), nil
+	}
+	sig, err := signingKey.sign([]byte(hp))
+	if err != nil {
+		return "", err
+	}
+	return encode(sig), nil
 }
 
-func decodeUser(token string) (types.User, error) {
-	payload := strings.Split(token, ".")[1]
-
-	data, err := base64.URLEncoding.WithPadding(base64.NoPadding).DecodeString(payload)
-	if err != nil {
-		return types.User{}, err
+func verifySignature(t *token) error {
+	if signingKey == nil {
+		if !hmac.Equal(t.signature, hmacSignature(t.signingInput)) {
+			return SignatureError{}
+		}
+		return nil
 	}
 
-	var user types.User
-	if err := json.Unmarshal(data, &user); err != nil {
-		return types.User{}, err
+	// the key decides the algorithm, never the token
+	k, ok := findKey(t.header.Kid)
+	if !ok {
+		return SignatureError{Reason: "unknown key"}
+	}
+	if k.alg != t.header.Alg {
+		return AlgorithmError{Alg: t.header.Alg}
+	}
+	if !k.verify([]byte(t.signingInput), t.signature) {
+		return SignatureError{}
 	}
-	return user, nil
+	return nil
 }
@@ -0,0 +1,103 @@
+package jwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type MalformedError struct {
+	Reason string
+}
+
+func (e MalformedError) Error() string {
+	return fmt.Sprintf("Malformed token: %s", e.Reason)
+}
+
+type AlgorithmError struct {
+	Alg string
+}
+
+func (e AlgorithmError) Error() string {
+	return fmt.Sprintf("Token algorithm %q is not allowed", e.Alg)
+}
+
+type SignatureError struct {
+	Reason string
+}
+
+func (e SignatureError) Error() string {
+	if e.Reason == "" {
+		return "Invalid signature"
+	}
+	return fmt.Sprintf("Invalid signature: %s", e.Reason)
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type token struct {
+	header       header
+	signingInput string
+	payload      []byte
+	signature    []byte
+}
+
+// allowedAlgorithms are those of the configured keys. Anything else,
+// including "none", is rejected before the signature is looked at.
+func allowedAlgorithms() []string {
+	if signingKey == nil {
+		return []string{"HS256"}
+	}
+	var algs []string
+	for _, k := range verificationKeys {
+		algs = append(algs, k.alg)
+	}
+	return algs
+}
+
+func parse(raw string) (*token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, MalformedError{Reason: "expected three segments"}
+	}
+
+	data, err := decode(parts[0])
+	if err != nil {
+		return nil, MalformedError{Reason: "header is not base64url"}
+	}
+	t := &token{signingInput: parts[0] + "." + parts[1]}
+	if err := json.Unmarshal(data, &t.header); err != nil {
+		return nil, MalformedError{Reason: "header is not a JSON object"}
+	}
+	if t.header.Typ != "" && !strings.EqualFold(t.header.Typ, "JWT") {
+		return nil, MalformedError{Reason: fmt.Sprintf("unexpected typ %q", t.header.Typ)}
+	}
+
+	allowed := false
+	for _, alg := range allowedAlgorithms() {
+		if t.header.Alg == alg {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, AlgorithmError{Alg: t.header.Alg}
+	}
+
+	t.payload, err = decode(parts[1])
+	if err != nil {
+		return nil, MalformedError{Reason: "payload is not base64url"}
+	}
+	t.signature, err = decode(parts[2])
+	if err != nil {
+		return nil, MalformedError{Reason: "signature is not base64url"}
+	}
+	if len(t.signature) == 0 {
+		return nil, MalformedError{Reason: "missing signature"}
+	}
+	return t, nil
+}
@@ -0,0 +1,66 @@
+package jwt
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// FuzzParse checks that no input makes parse or verifySignature panic, and
+// that a token is only ever accepted with the algorithm of the configured
+// keys. The seeds in testdata/fuzz/FuzzParse include "none" and HS256
+// tokens signed with the RSA public key as the HMAC secret.
+func FuzzParse(f *testing.F) {
+	data, err := ioutil.ReadFile("testdata/rsa.pem")
+	if err != nil {
+		f.Fatal(err)
+	}
+	rsaKey, err := parseKey(data)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	keys := []struct {
+		alg          string
+		signing      *key
+		verification []*key
+	}{
+		{"HS256", nil, nil},
+		{"RS256", rsaKey, []*key{rsaKey}},
+	}
+	oldSigning, oldVerification := signingKey, verificationKeys
+	f.Cleanup(func() {
+		signingKey, verificationKeys = oldSigning, oldVerification
+	})
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		for _, k := range keys {
+			signingKey, verificationKeys = k.signing, k.verification
+
+			tok, err := parse(raw)
+			if err != nil {
+				switch err.(type) {
+				case MalformedError, AlgorithmError:
+				default:
+					t.Fatalf("%s: parse returned %T: %v", k.alg, err, err)
+				}
+				continue
+			}
+			if !allowed(tok.header.Alg) {
+				t.Fatalf("%s: parse accepted alg %q", k.alg, tok.header.Alg)
+			}
+
+			if err := verifySignature(tok); err == nil && tok.header.Alg != k.alg {
+				t.Fatalf("%s: signature verified with alg %q", k.alg, tok.header.Alg)
+			}
+		}
+	})
+}
+
+func allowed(alg string) bool {
+	for _, a := range allowedAlgorithms() {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
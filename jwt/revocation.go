@@ -0,0 +1,209 @@
+package jwt
+
+import (
+	"github.com/mthorning/go-sso/store"
+	"log"
+	"sync"
+	"time"
+)
+
+type Revocation struct {
+	Expires time.Time
+	Revoked time.Time
+	By      string
+	// Subject is set when every token issued to the subject up to Revoked
+	// is revoked, rather than a single token.
+	Subject string `json:",omitempty"`
+}
+
+// RevocationStore records revoked token IDs until the tokens would have
+// expired anyway.
+type RevocationStore interface {
+	Revoke(jti string, r Revocation) error
+	// Lookup returns the revocation stored under id, and false if there
+	// isn't one.
+	Lookup(id string) (Revocation, bool, error)
+	// List returns the revocations whose tokens haven't expired.
+	List() (map[string]Revocation, error)
+	// Prune removes the revocations whose tokens have expired by now.
+	Prune(now time.Time) error
+}
+
+type RevokedError struct{}
+
+func (e RevokedError) Error() string {
+	return "Token has been revoked"
+}
+
+var Revocations RevocationStore
+
+func newRevocationStore(kind string) RevocationStore {
+	if kind == "memory" {
+		return &memoryRevocations{revoked: map[string]Revocation{}}
+	}
+	return &storeRevocations{c: store.Open("revocations")}
+}
+
+// Revoke adds the token with these claims to the revocation list.
+func Revoke(claims Claims, by string) error {
+	return Revocations.Revoke(claims.ID, Revocation{
+		Expires: claims.ExpiresAt.Time().Add(Conf.ClockSkew),
+		Revoked: time.Now(),
+		By:      by,
+	})
+}
+
+// RevokeID revokes a token when only its jti is known. Nothing we issue
+// lives longer than TokenLifetime, so that bounds how long to remember it.
+func RevokeID(jti, by string) error {
+	now := time.Now()
+	return Revocations.Revoke(jti, Revocation{
+		Expires: now.Add(Conf.TokenLifetime + Conf.ClockSkew),
+		Revoked: now,
+		By:      by,
+	})
+}
+
+// RevokeSubject revokes every token issued to subject so far. Like
+// RevokeID, it only needs remembering for TokenLifetime.
+func RevokeSubject(subject, by string) error {
+	now := time.Now()
+	return Revocations.Revoke(subjectKey(subject), Revocation{
+		Expires: now.Add(Conf.TokenLifetime + Conf.ClockSkew),
+		Revoked: now,
+		By:      by,
+		Subject: subject,
+	})
+}
+
+// SweepRevocations prunes every RevocationSweepInterval until the process
+// exits.
+func SweepRevocations() {
+	if Conf.RevocationSweepInterval <= 0 {
+		return
+	}
+	for now := range time.Tick(Conf.RevocationSweepInterval) {
+		if err := Revocations.Prune(now); err != nil {
+			log.Printf("error pruning revocations: %v\n", err)
+		}
+	}
+}
+
+func subjectKey(subject string) string {
+	return "sub:" + subject
+}
+
+func isRevoked(claims Claims) (bool, error) {
+	_, revoked, err := Revocations.Lookup(claims.ID)
+	if err != nil || revoked {
+		return revoked, err
+	}
+	r, revoked, err := Revocations.Lookup(subjectKey(claims.Subject))
+	if err != nil || !revoked {
+		return false, err
+	}
+	// iat is only to the second, so a token issued in the same second as
+	// the revocation is taken to be before it
+	return claims.IssuedAt.Time().Unix() <= r.Revoked.Unix(), nil
+}
+
+type memoryRevocations struct {
+	mu      sync.RWMutex
+	revoked map[string]Revocation
+}
+
+func (m *memoryRevocations) Revoke(jti string, r Revocation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revoked[jti] = r
+	return nil
+}
+
+func (m *memoryRevocations) Lookup(id string) (Revocation, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.revoked[id]
+	return r, ok, nil
+}
+
+func (m *memoryRevocations) List() (map[string]Revocation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	list := make(map[string]Revocation, len(m.revoked))
+	for id, rev := range m.revoked {
+		if !now.After(rev.Expires) {
+			list[id] = rev
+		}
+	}
+	return list, nil
+}
+
+func (m *memoryRevocations) Prune(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, rev := range m.revoked {
+		if now.After(rev.Expires) {
+			delete(m.revoked, id)
+		}
+	}
+	return nil
+}
+
+type storeRevocations struct {
+	c store.Collection
+}
+
+func (s *storeRevocations) Revoke(jti string, r Revocation) error {
+	return s.c.Set(jti, r)
+}
+
+func (s *storeRevocations) Lookup(id string) (Revocation, bool, error) {
+	var r Revocation
+	err := s.c.Get(id, &r)
+	if _, ok := err.(store.NotFoundError); ok {
+		return Revocation{}, false, nil
+	}
+	return r, err == nil, err
+}
+
+func (s *storeRevocations) List() (map[string]Revocation, error) {
+	docs, err := s.c.List()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	list := map[string]Revocation{}
+	for _, doc := range docs {
+		var r Revocation
+		if err := doc.DataTo(&r); err != nil {
+			return nil, err
+		}
+		if !now.After(r.Expires) {
+			list[doc.ID()] = r
+		}
+	}
+	return list, nil
+}
+
+func (s *storeRevocations) Prune(now time.Time) error {
+	docs, err := s.c.List()
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		var r Revocation
+		if err := doc.DataTo(&r); err != nil {
+			return err
+		}
+		if !now.After(r.Expires) {
+			continue
+		}
+		if err := s.c.Delete(doc.ID()); err != nil {
+			if _, ok := err.(store.NotFoundError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
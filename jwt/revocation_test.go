@@ -0,0 +1,87 @@
+package jwt
+
+import (
+	"testing"
+	"time"
+)
+
+// useRevocations swaps in a revocation store of kind for the rest of the
+// test.
+func useRevocations(t *testing.T, kind string) {
+	old := Revocations
+	t.Cleanup(func() { Revocations = old })
+	Revocations = newRevocationStore(kind)
+}
+
+func TestRevocationStores(t *testing.T) {
+	for _, kind := range []string{"memory", "store"} {
+		t.Run(kind, func(t *testing.T) {
+			useRevocations(t, kind)
+			now := time.Now()
+			revocations := map[string]time.Time{
+				kind + "-expired": now.Add(-time.Minute),
+				kind + "-current": now.Add(time.Minute),
+			}
+			for id, expires := range revocations {
+				if err := Revocations.Revoke(id, Revocation{Expires: expires, Revoked: now, By: "admin"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			list, err := Revocations.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := list[kind+"-expired"]; ok {
+				t.Error("List includes an expired revocation")
+			}
+			if r, ok := list[kind+"-current"]; !ok || r.By != "admin" {
+				t.Errorf("List = %v, want the current revocation", list)
+			}
+
+			if err := Revocations.Prune(now); err != nil {
+				t.Fatal(err)
+			}
+			for id, want := range map[string]bool{kind + "-expired": false, kind + "-current": true} {
+				if _, ok, err := Revocations.Lookup(id); err != nil || ok != want {
+					t.Errorf("after Prune, Lookup(%s) = %v, %v; want %v", id, ok, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIsRevoked(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		claims Claims
+		want   bool
+	}{
+		{"revoked ID", Claims{ID: "revoked-id", Subject: "someone", IssuedAt: NewNumericDate(now)}, true},
+		{"other ID", Claims{ID: "other-id", Subject: "someone", IssuedAt: NewNumericDate(now)}, false},
+		{"subject, issued before", Claims{ID: "a", Subject: "revoked-subject", IssuedAt: NewNumericDate(now.Add(-time.Minute))}, true},
+		{"subject, issued the same second", Claims{ID: "b", Subject: "revoked-subject", IssuedAt: NewNumericDate(now)}, true},
+		{"subject, issued after", Claims{ID: "c", Subject: "revoked-subject", IssuedAt: NewNumericDate(now.Add(2 * time.Second))}, false},
+	}
+	for _, kind := range []string{"memory", "store"} {
+		useRevocations(t, kind)
+		if err := RevokeID("revoked-id", "admin"); err != nil {
+			t.Fatal(err)
+		}
+		if err := RevokeSubject("revoked-subject", "admin"); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			t.Run(kind+" "+tt.name, func(t *testing.T) {
+				got, err := isRevoked(tt.claims)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package jwt
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Sign signs payload with the same key as tokens, for records other than
+// tokens that need to be shown to have come from this server.
+func Sign(payload interface{}) (string, error) {
+	header := map[string]string{
+		"alg": Algorithm(),
+	}
+	if signingKey != nil {
+		header["kid"] = signingKey.id
+	}
+
+	jsonHeader, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	h, p := encode(jsonHeader), encode(jsonPayload)
+	s, err := createSignature(h, p)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%s.%s", h, p, s), nil
+}
+
+// Verify checks a signature made by Sign and decodes its payload into v.
+// Only keys still listed in SigningKeys are tried.
+func Verify(signed string, v interface{}) error {
+	t, err := parse(signed)
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(t); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(t.payload, v); err != nil {
+		return MalformedError{Reason: "payload is not valid JSON"}
+	}
+	return nil
+}
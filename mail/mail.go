@@ -0,0 +1,119 @@
+// Package mail sends the emails the server needs, such as verification
+// links. The SMTP sender is for production; the file and log senders let
+// everything be exercised offline.
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mthorning/go-sso/config"
+	"io/ioutil"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// Mailer is "smtp", "file" or "log".
+	Mailer       string `default:"log"`
+	MailFrom     string `default:"go-sso@localhost" split_words:"true"`
+	MailDir      string `default:"outbox" split_words:"true"`
+	SMTPHost     string `envconfig:"smtp_host"`
+	SMTPPort     int    `envconfig:"smtp_port" default:"587"`
+	SMTPUsername string `envconfig:"smtp_username"`
+	SMTPPassword string `envconfig:"smtp_password"`
+	// BaseURL is where links in emails point.
+	BaseURL string `default:"http://localhost:8080" split_words:"true"`
+}
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(m Message) error
+}
+
+var (
+	Conf   Config
+	Sender Mailer
+)
+
+func init() {
+	config.SetConfig(&Conf)
+
+	switch Conf.Mailer {
+	case "smtp":
+		if Conf.SMTPHost == "" {
+			log.Fatal("SSO_SMTP_HOST is required to send mail over SMTP")
+		}
+		Sender = smtpMailer{}
+	case "file":
+		if err := os.MkdirAll(Conf.MailDir, 0700); err != nil {
+			log.Fatalf("error creating mail directory: %v\n", err)
+		}
+		Sender = fileMailer{dir: Conf.MailDir}
+	case "log":
+		Sender = logMailer{}
+	default:
+		log.Fatalf("unknown mailer %q\n", Conf.Mailer)
+	}
+}
+
+// Link returns an absolute URL for path.
+func Link(path string) string {
+	return strings.TrimRight(Conf.BaseURL, "/") + path
+}
+
+// bytes renders the message, refusing header values that could smuggle in
+// extra headers.
+func (m Message) bytes() ([]byte, error) {
+	if strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return nil, errors.New("mail headers can't contain line breaks")
+	}
+	header := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n",
+		Conf.MailFrom, m.To, m.Subject, time.Now().Format(time.RFC1123Z))
+	body := strings.Replace(m.Body, "\n", "\r\n", -1)
+	return []byte(header + body), nil
+}
+
+type smtpMailer struct{}
+
+func (smtpMailer) Send(m Message) error {
+	addr := fmt.Sprintf("%s:%d", Conf.SMTPHost, Conf.SMTPPort)
+	var auth smtp.Auth
+	if Conf.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", Conf.SMTPUsername, Conf.SMTPPassword, Conf.SMTPHost)
+	}
+	msg, err := m.bytes()
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(addr, auth, Conf.MailFrom, []string{m.To}, msg)
+}
+
+// fileMailer writes each message to its own .eml file.
+type fileMailer struct {
+	dir string
+}
+
+func (f fileMailer) Send(m Message) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.Replace(m.To, "/", "_", -1))
+	msg, err := m.bytes()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(f.dir, name), msg, 0600)
+}
+
+type logMailer struct{}
+
+func (logMailer) Send(m Message) error {
+	log.Printf("mail to %s: %s\n%s\n", m.To, m.Subject, m.Body)
+	return nil
+}
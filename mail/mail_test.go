@@ -0,0 +1,90 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOfflineSenders(t *testing.T) {
+	verification := Message{
+		To:      "alice@example.com",
+		Subject: "Please verify your email address",
+		Body:    "Hi Alice,\n\nPlease confirm this is your email address by opening the link below.\n\n" + Link("/verify/token") + "\n",
+	}
+	injected := verification
+	injected.Subject = "Hello\r\nBcc: mallory@example.com"
+
+	senders := []struct {
+		name string
+		// send returns whatever the sender left behind for a person to read
+		send func(t *testing.T, m Message) (string, error)
+		// crlf is whether the capture is the raw message with its headers
+		crlf bool
+	}{
+		{"file", func(t *testing.T, m Message) (string, error) {
+			dir := t.TempDir()
+			if err := (fileMailer{dir: dir}).Send(m); err != nil {
+				return "", err
+			}
+			files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+			if err != nil || len(files) != 1 {
+				t.Fatalf("outbox has %v, %v; want one .eml file", files, err)
+			}
+			data, err := ioutil.ReadFile(files[0])
+			return string(data), err
+		}, true},
+		{"log", func(t *testing.T, m Message) (string, error) {
+			var buf bytes.Buffer
+			defer log.SetOutput(log.Writer())
+			log.SetOutput(&buf)
+			err := logMailer{}.Send(m)
+			return buf.String(), err
+		}, false},
+	}
+	tests := []struct {
+		name    string
+		message Message
+		want    []string
+		// headers are only looked for in a raw message
+		headers []string
+	}{
+		{"verification", verification, []string{
+			"alice@example.com",
+			"Please verify your email address",
+			"http://localhost:8080/verify/token",
+		}, []string{
+			"From: go-sso@localhost\r\n",
+			"To: alice@example.com\r\n",
+			"\r\n\r\nHi Alice,\r\n",
+		}},
+	}
+
+	for _, s := range senders {
+		for _, tt := range tests {
+			t.Run(s.name+"/"+tt.name, func(t *testing.T) {
+				got, err := s.send(t, tt.message)
+				if err != nil {
+					t.Fatalf("Send: %v", err)
+				}
+				want := tt.want
+				if s.crlf {
+					want = append(want, tt.headers...)
+				}
+				for _, w := range want {
+					if !strings.Contains(got, w) {
+						t.Errorf("sent %q, want it to contain %q", got, w)
+					}
+				}
+			})
+		}
+	}
+
+	// only the file sender writes headers, so only it has to refuse them
+	if _, err := senders[0].send(t, injected); err == nil {
+		t.Error("file sender wrote a subject with a line break")
+	}
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/mthorning/go-sso/audit"
 	"github.com/mthorning/go-sso/config"
-	"github.com/mthorning/go-sso/firestore"
+	"github.com/mthorning/go-sso/jwt"
+	"github.com/mthorning/go-sso/oauth"
+	"github.com/mthorning/go-sso/roles"
 	"github.com/mthorning/go-sso/server"
+	"github.com/mthorning/go-sso/session"
+	"github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/throttle"
 	"github.com/mthorning/go-sso/types"
 	"log"
 	"net/http"
+	"os"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -24,97 +31,268 @@ func init() {
 	config.SetConfig(&conf)
 }
 
+// permissionRules guard the admin pages and actions. Editing your own
+// details needs no permission, so /edit/{id} itself is checked by its
+// handlers.
+var permissionRules = []server.PermissionRule{
+	{Path: regexp.MustCompile(`^/manage$`), Permission: roles.UsersRead},
+	{Path: regexp.MustCompile(`^/users/new$`), Permission: roles.UsersWrite},
+	{Path: regexp.MustCompile(`^/invitations/`), Permission: roles.UsersWrite},
+	{Path: regexp.MustCompile(`^/edit/[^/]+/.`), Permission: roles.UsersWrite},
+	{Path: regexp.MustCompile(`^/clients?(/|$)`), Permission: roles.ClientsManage},
+	{Path: regexp.MustCompile(`^/revocations$`), Permission: roles.TokensRevoke},
+	{Path: regexp.MustCompile(`^/audit$`), Permission: roles.AuditRead},
+}
+
 var routeConfig = server.RouteConfig{
-	// "/index": func(s *types.SessionUser) (interface{}, error) {
-	// 	d := struct {
-	// 		ID    string
-	// 		Admin bool
-	// 		Name  string
-	// 	}{}
-	// 	err := s.GetUser(&d)
-	// 	d.ID = s.ID
-	// 	return d, err
-	// },
-	"/edit/.*$": func(path string, s *types.SessionUser) (interface{}, error) {
+	"^/index$": func(s *types.SessionUser) (interface{}, error) {
+		d := struct {
+			ID            string
+			User          types.SessionUser
+			Name          string
+			Email         string
+			EmailVerified bool
+		}{}
+		user, err := store.Users.Get(s.ID)
+		d.ID = s.ID
+		d.User = *s
+		d.Name = user.Name
+		d.Email = user.Email
+		d.EmailVerified = user.EmailVerified
+		return d, err
+	},
+	"^/edit/[^/]+$": func(path string, s *types.SessionUser) (interface{}, error) {
 		parts := strings.Split(path, "/")
 		userID := parts[len(parts)-1]
+		if userID != s.ID && !s.Can(roles.UsersRead) {
+			return nil, server.PermissionError{Permission: roles.UsersRead}
+		}
 
 		d := struct {
 			ID           string
 			Name         string
 			Email        string
-			Admin        bool
+			Roles        []server.RoleOption
+			SecondFactor bool
+			LockedUntil  time.Time
+			Disabled     bool
+			DeletedAt    time.Time
+			PurgeAt      time.Time
+			Sessions     []session.Info
 			Error        string
-			SessionAdmin bool
+			// View is set when looking at someone else's account, and
+			// Manage when you can change it too
+			View   bool
+			Manage bool
 		}{}
 
-		docsnap, err := firestore.Users.Doc(userID).Get(context.Background())
+		user, err := store.Users.Get(userID)
 		if err != nil {
 			return nil, err
 		}
-		err = docsnap.DataTo(&d)
+		d.Name = user.Name
+		d.Email = user.Email
+		d.SecondFactor = user.NeedsSecondFactor()
+		d.Disabled = user.Disabled
+		d.DeletedAt = user.DeletedAt
+		if user.Deleted() {
+			d.PurgeAt = server.PurgeAt(user)
+		}
+		d.LockedUntil, err = throttle.Account.LockedUntil(user.Email)
 		if err != nil {
 			return nil, err
 		}
 
-		// don't give admin priveleges to own user:
-		d.SessionAdmin = s.Admin && s.ID != userID
+		// your own account only gets the details form
+		d.View = s.ID != userID
+		d.Manage = d.View && s.Can(roles.UsersWrite) && server.CanManage(*s, user)
+		if d.Manage {
+			d.Roles = server.NewRoleOptions(user.RoleNames(), s.Roles)
+		}
+		if d.View {
+			d.Sessions, err = session.ListSessions(userID, "")
+			if err != nil {
+				return nil, err
+			}
+		}
 
 		d.ID = userID
 
 		return d, err
 	},
-	"/chpwd": func(s *types.SessionUser) (interface{}, error) {
+	"^/chpwd$": func(s *types.SessionUser) (interface{}, error) {
 		d := struct {
 			Name  string
 			Error string
 		}{}
-		err := s.GetUser(&d)
+		user, err := store.Users.Get(s.ID)
+		d.Name = user.Name
 		return d, err
 	},
-	"/manage": func(s *types.SessionUser) (interface{}, error) {
-		d := struct {
-			Email string
-		}{}
-		err := s.GetUser(&d)
+	"^/sessions$": func(s *types.SessionUser) (interface{}, error) {
+		sessions, err := session.ListSessions(s.ID, s.SessionKey)
+		return map[string]interface{}{"Sessions": sessions}, err
+	},
+	"^/2fa$": func(s *types.SessionUser) (interface{}, error) {
+		user, err := store.Users.Get(s.ID)
 		if err != nil {
 			return nil, err
 		}
-
-		query := firestore.Users.Where("Email", "!=", d.Email)
-		docs, err := query.Documents(context.Background()).GetAll()
+		return server.NewTwoFactorPage(user), nil
+	},
+	"^/passkeys$": func(s *types.SessionUser) (interface{}, error) {
+		user, err := store.Users.Get(s.ID)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"Passkeys": user.Passkeys}, nil
+	},
+	"^/manage$": func(s *types.SessionUser) (interface{}, error) {
+		if !s.Can(roles.UsersRead) {
+			return nil, server.PermissionError{Permission: roles.UsersRead}
+		}
+		dbUsers, err := store.Users.List()
 		if err != nil {
 			return nil, err
 		}
 
-		var users []types.User
-		for _, doc := range docs {
-			var user types.User
-			err := doc.DataTo(&user)
-			if err != nil {
-				return nil, err
+		type managedUser struct {
+			types.User
+			Disabled bool
+			Deleted  bool
+		}
+		var users []managedUser
+		for _, dbUser := range dbUsers {
+			if dbUser.ID == s.ID {
+				continue
 			}
-			user.ID = doc.Ref.ID
-			users = append(users, user)
+			users = append(users, managedUser{
+				User:     dbUser.User(),
+				Disabled: dbUser.Disabled,
+				Deleted:  dbUser.Deleted(),
+			})
 		}
 		return users, nil
 	},
+	"^/users/new$": func(s *types.SessionUser) (interface{}, error) {
+		if !s.Can(roles.UsersWrite) {
+			return nil, server.PermissionError{Permission: roles.UsersWrite}
+		}
+		return server.NewAddUserPage(s.Roles)
+	},
+	"^/revocations$": func(s *types.SessionUser) (interface{}, error) {
+		if !s.Can(roles.TokensRevoke) {
+			return nil, server.PermissionError{Permission: roles.TokensRevoke}
+		}
+		revocations, err := jwt.Revocations.List()
+		return map[string]interface{}{"Revocations": revocations}, err
+	},
+	"^/clients$": func(s *types.SessionUser) (interface{}, error) {
+		if !s.Can(roles.ClientsManage) {
+			return nil, server.PermissionError{Permission: roles.ClientsManage}
+		}
+		return oauth.ListClients()
+	},
+	"^/client/[^/]+$": func(path string, s *types.SessionUser) (interface{}, error) {
+		if !s.Can(roles.ClientsManage) {
+			return nil, server.PermissionError{Permission: roles.ClientsManage}
+		}
+		parts := strings.Split(path, "/")
+		clientID := parts[len(parts)-1]
+
+		if clientID == "new" {
+			form := server.NewClientForm(oauth.Client{
+				Scopes:     oauth.DefaultScopes,
+				GrantTypes: oauth.GrantTypes,
+			})
+			form.ID = clientID
+			return form, nil
+		}
+
+		c, err := oauth.LoadClient(clientID)
+		if err != nil {
+			return nil, err
+		}
+		return server.NewClientForm(c), nil
+	},
 }
 
 func main() {
+	if err := store.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if err := audit.Start(); err != nil {
+		log.Fatal(err)
+	}
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	go server.PurgeDeletedUsers()
+	go oauth.SweepRefreshTokens()
+	go jwt.SweepRevocations()
+	go session.SweepSessions()
+	go throttle.SweepFailures()
+
 	r := mux.NewRouter()
+	r.Use(server.CSRF("/authorize", "/token", "/userinfo", "/revoke", "/introspect"))
+	r.Use(server.RequirePermissions(permissionRules))
 	r.HandleFunc("/login", server.HandleLogin).Methods("POST")
 	r.HandleFunc("/register", server.HandleRegister).Methods("POST")
-	r.HandleFunc("/authn", server.HandleAuthn).Methods("POST")
 	r.HandleFunc("/logout", server.HandleLogout).Methods("POST")
 	r.HandleFunc("/edit/{id}", server.HandleEdit).Methods("POST")
+	r.HandleFunc("/users/new", server.HandleAddUser).Methods("POST")
+	r.HandleFunc("/invitations/{id}/resend", server.HandleInvitationResend).Methods("POST")
+	r.HandleFunc("/invitations/{id}/revoke", server.HandleInvitationRevoke).Methods("POST")
+	r.HandleFunc("/invite/{token}", server.HandleInvitePage).Methods("GET")
+	r.HandleFunc("/invite/{token}", server.HandleAcceptInvite).Methods("POST")
 	r.HandleFunc("/chpwd", server.HandleChpwd).Methods("POST")
+	r.HandleFunc("/sessions/revoke", server.HandleSignOutEverywhere).Methods("POST")
+	r.HandleFunc("/sessions/{key}/revoke", server.HandleSessionRevoke).Methods("POST")
+	r.HandleFunc("/forgot", server.HandleForgot).Methods("POST")
+	r.HandleFunc("/reset/{token}", server.HandleResetPage).Methods("GET")
+	r.HandleFunc("/reset/{token}", server.HandleReset).Methods("POST")
+	r.HandleFunc("/verify/resend", server.HandleResendVerification).Methods("POST")
+	r.HandleFunc("/verify/{token}", server.HandleVerifyEmail).Methods("GET")
+	r.HandleFunc("/login/2fa", server.HandleSecondFactorPage).Methods("GET")
+	r.HandleFunc("/login/2fa", server.HandleLoginTOTP).Methods("POST")
+	r.HandleFunc("/login/passkey/begin", server.HandlePasskeyLoginBegin).Methods("POST")
+	r.HandleFunc("/login/passkey/finish", server.HandlePasskeyLoginFinish).Methods("POST")
+	r.HandleFunc("/2fa/enroll", server.HandleTOTPEnroll).Methods("POST")
+	r.HandleFunc("/2fa/confirm", server.HandleTOTPConfirm).Methods("POST")
+	r.HandleFunc("/2fa/disable", server.HandleTOTPDisable).Methods("POST")
+	r.HandleFunc("/2fa/recovery", server.HandleRecoveryCodes).Methods("POST")
+	r.HandleFunc("/edit/{id}/2fa/reset", server.HandleTOTPReset).Methods("POST")
+	r.HandleFunc("/edit/{id}/unlock", server.HandleUnlock).Methods("POST")
+	r.HandleFunc("/edit/{id}/disable", server.HandleUserDisable).Methods("POST")
+	r.HandleFunc("/edit/{id}/delete", server.HandleUserDelete).Methods("POST")
+	r.HandleFunc("/edit/{id}/restore", server.HandleUserRestore).Methods("POST")
+	r.HandleFunc("/edit/{id}/purge", server.HandleUserPurge).Methods("POST")
+	r.HandleFunc("/edit/{id}/sessions/revoke", server.HandleUserSessionsRevoke).Methods("POST")
+	r.HandleFunc("/edit/{id}/sessions/{key}/revoke", server.HandleUserSessionsRevoke).Methods("POST")
+	r.HandleFunc("/passkeys/begin", server.HandlePasskeyRegisterBegin).Methods("POST")
+	r.HandleFunc("/passkeys/finish", server.HandlePasskeyRegisterFinish).Methods("POST")
+	r.HandleFunc("/passkeys/{id}/delete", server.HandlePasskeyDelete).Methods("POST")
+
+	r.HandleFunc("/.well-known/openid-configuration", server.HandleDiscovery).Methods("GET")
+	r.HandleFunc("/authorize", server.HandleAuthorize).Methods("GET", "POST")
+	r.HandleFunc("/token", server.HandleToken).Methods("POST")
+	r.HandleFunc("/userinfo", server.HandleUserinfo).Methods("GET", "POST")
+	r.HandleFunc("/jwks", server.HandleJWKS).Methods("GET")
+	r.HandleFunc("/revoke", server.HandleRevoke).Methods("POST")
+	r.HandleFunc("/introspect", server.HandleIntrospect).Methods("POST")
+	r.HandleFunc("/revocations", server.HandleAdminRevoke).Methods("POST")
+	r.HandleFunc("/audit", server.HandleAuditPage).Methods("GET")
+
+	r.HandleFunc("/client/{id}", server.HandleClient).Methods("POST")
+	r.HandleFunc("/client/{id}/secret", server.HandleClientSecret).Methods("POST")
+	r.HandleFunc("/client/{id}/disable", server.HandleClientDisable).Methods("POST")
 
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
 
 	r.HandleFunc("/login", server.NoAuthRoutes)
 	r.HandleFunc("/register", server.NoAuthRoutes)
 	r.HandleFunc("/register-success", server.NoAuthRoutes)
+	r.HandleFunc("/forgot", server.NoAuthRoutes)
 
 	authRoutes := server.AuthRoutes{
 		Config: routeConfig,
@@ -0,0 +1,201 @@
+package oauth
+
+import (
+	"github.com/mthorning/go-sso/store"
+	"github.com/nu7hatch/gouuid"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// GrantTypes are the grants a client can be registered for.
+var GrantTypes = []string{"authorization_code", "refresh_token"}
+
+// DefaultScopes are offered to newly registered clients.
+var DefaultScopes = []string{"openid", "profile", "email"}
+
+type Client struct {
+	ID           string
+	Name         string
+	LogoURI      string
+	SecretHash   []byte
+	RedirectURIs []string
+	Scopes       []string
+	GrantTypes   []string
+	// Public clients (SPAs, CLIs) can't keep a secret, so they only send
+	// their client_id and must prove possession of the code with PKCE.
+	Public      bool
+	RequirePKCE bool
+	Disabled    bool
+	Created     time.Time
+}
+
+var clients store.Collection
+
+// LoadClient returns the registration whether or not it is disabled, for
+// use by the admin pages.
+func LoadClient(id string) (Client, error) {
+	var c Client
+	if err := clients.Get(id, &c); err != nil {
+		return Client{}, err
+	}
+	c.ID = id
+	return c, nil
+}
+
+// GetClient returns a client that is allowed to use the server.
+func GetClient(id string) (Client, error) {
+	if id == "" {
+		return Client{}, NewError("invalid_client", "Unknown client")
+	}
+	c, err := LoadClient(id)
+	if _, ok := err.(store.NotFoundError); ok {
+		return Client{}, NewError("invalid_client", "Unknown client")
+	}
+	if err != nil {
+		return Client{}, err
+	}
+	if c.Disabled {
+		return Client{}, NewError("invalid_client", "Client is disabled")
+	}
+	return c, nil
+}
+
+func ListClients() ([]Client, error) {
+	docs, err := clients.List()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Client, 0, len(docs))
+	for _, doc := range docs {
+		var c Client
+		if err := doc.DataTo(&c); err != nil {
+			return nil, err
+		}
+		c.ID = doc.ID()
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+// CreateClient registers c under a new ID. Confidential clients get a secret
+// which is returned here and only stored hashed.
+func CreateClient(c Client) (Client, string, error) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		return Client{}, "", err
+	}
+	c.ID = u.String()
+	c.Created = time.Now()
+
+	var secret string
+	if !c.Public {
+		secret, err = setSecret(&c)
+		if err != nil {
+			return Client{}, "", err
+		}
+	}
+	if err := clients.Set(c.ID, c); err != nil {
+		return Client{}, "", err
+	}
+	return c, secret, nil
+}
+
+func SaveClient(c Client) error {
+	return clients.Set(c.ID, c)
+}
+
+// RotateSecret replaces the client's secret, immediately invalidating the old one.
+func RotateSecret(id string) (string, error) {
+	c, err := LoadClient(id)
+	if err != nil {
+		return "", err
+	}
+	secret, err := setSecret(&c)
+	if err != nil {
+		return "", err
+	}
+	if err := clients.Set(id, c); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func setSecret(c *Client) (string, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	c.SecretHash, err = bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func (c Client) PKCERequired() bool {
+	return c.Public || c.RequirePKCE
+}
+
+func (c Client) ValidRedirectURI(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Client) AllowsGrant(grant string) bool {
+	for _, g := range c.GrantTypes {
+		if g == grant {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsScope reports whether every scope in the space separated list is
+// registered for the client.
+func (c Client) AllowsScope(scope string) bool {
+	for _, s := range splitScope(scope) {
+		allowed := false
+		for _, a := range c.Scopes {
+			if a == s {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// AuthenticateClient checks client_secret_basic or client_secret_post
+// credentials on a token endpoint request. Public clients are identified by
+// client_id alone.
+func AuthenticateClient(r *http.Request) (Client, error) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id = r.PostFormValue("client_id")
+		secret = r.PostFormValue("client_secret")
+	}
+
+	c, err := GetClient(id)
+	if err != nil {
+		return Client{}, err
+	}
+	if c.Public {
+		return c, nil
+	}
+	if secret == "" || bcrypt.CompareHashAndPassword(c.SecretHash, []byte(secret)) != nil {
+		return Client{}, NewError("invalid_client", "Client authentication failed")
+	}
+	return c, nil
+}
@@ -0,0 +1,110 @@
+package oauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidRedirectURI(t *testing.T) {
+	c := Client{RedirectURIs: []string{"https://app.test/callback", "http://localhost:3000/cb?x=1"}}
+
+	tests := []struct {
+		uri  string
+		want bool
+	}{
+		{"https://app.test/callback", true},
+		{"http://localhost:3000/cb?x=1", true},
+		{"https://app.test/callback/", false},
+		{"https://app.test/callback?next=/", false},
+		{"https://app.test/callback#x", false},
+		{"https://app.test/callbackx", false},
+		{"https://app.test/call", false},
+		{"https://APP.test/callback", false},
+		{"http://app.test/callback", false},
+		{"https://app.test.evil.test/callback", false},
+		{"http://localhost:3000/cb", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			if got := c.ValidRedirectURI(tt.uri); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func tokenRequest(basicID, basicSecret string, form url.Values) *http.Request {
+	r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basicID != "" {
+		r.SetBasicAuth(basicID, basicSecret)
+	}
+	return r
+}
+
+func TestAuthenticateClient(t *testing.T) {
+	confidential, secret, err := CreateClient(Client{Name: "Confidential"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, otherSecret, err := CreateClient(Client{Name: "Other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _, err := CreateClient(Client{Name: "Public", Public: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled, disabledSecret, err := CreateClient(Client{Name: "Disabled"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled.Disabled = true
+	if err := SaveClient(disabled); err != nil {
+		t.Fatal(err)
+	}
+	rotated, oldSecret, err := CreateClient(Client{Name: "Rotated"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSecret, err := RotateSecret(rotated.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		r       *http.Request
+		wantID  string
+		wantErr string
+	}{
+		{"basic", tokenRequest(confidential.ID, secret, nil), confidential.ID, ""},
+		{"post", tokenRequest("", "", url.Values{"client_id": {confidential.ID}, "client_secret": {secret}}), confidential.ID, ""},
+		{"wrong secret", tokenRequest(confidential.ID, "wrong", nil), "", "invalid_client"},
+		{"no secret", tokenRequest("", "", url.Values{"client_id": {confidential.ID}}), "", "invalid_client"},
+		{"empty basic secret", tokenRequest(confidential.ID, "", nil), "", "invalid_client"},
+		{"another client's secret", tokenRequest(confidential.ID, otherSecret, nil), "", "invalid_client"},
+		{"secret sent as another client", tokenRequest(other.ID, secret, nil), "", "invalid_client"},
+		{"unknown client", tokenRequest("unknown", secret, nil), "", "invalid_client"},
+		{"no client", tokenRequest("", "", nil), "", "invalid_client"},
+		{"disabled", tokenRequest(disabled.ID, disabledSecret, nil), "", "invalid_client"},
+		{"rotated secret", tokenRequest(rotated.ID, newSecret, nil), rotated.ID, ""},
+		{"secret from before rotation", tokenRequest(rotated.ID, oldSecret, nil), "", "invalid_client"},
+		{"public", tokenRequest("", "", url.Values{"client_id": {public.ID}}), public.ID, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := AuthenticateClient(tt.r)
+			if code := errorCode(err); code != tt.wantErr {
+				t.Fatalf("got error %q, want %q", code, tt.wantErr)
+			}
+			if c.ID != tt.wantID {
+				t.Errorf("authenticated as %q, want %q", c.ID, tt.wantID)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package oauth
+
+import (
+	"github.com/mthorning/go-sso/store"
+	"time"
+)
+
+type AuthCode struct {
+	ClientID    string
+	UserID      string
+	RedirectURI string
+	// RedirectURISent is false when the client left redirect_uri out and
+	// its only registered one was used, in which case the token request
+	// doesn't have to repeat it.
+	RedirectURISent bool
+	Scope           string
+	Nonce           string
+	Expires         time.Time
+
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+var codes store.Collection
+
+// NewCode stores the grant and returns the code to hand to the client.
+func NewCode(c AuthCode) (string, error) {
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	c.Expires = time.Now().Add(Conf.CodeLifetime)
+	if err := codes.Set(hashToken(code), c); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// ExchangeCode redeems a code. Codes are single use, so it is deleted
+// whether or not it turns out to still be valid.
+func ExchangeCode(code string) (AuthCode, error) {
+	invalid := NewError("invalid_grant", "Invalid or expired authorization code")
+
+	id := hashToken(code)
+	var c AuthCode
+	err := codes.Get(id, &c)
+	if _, ok := err.(store.NotFoundError); ok {
+		return AuthCode{}, invalid
+	}
+	if err != nil {
+		return AuthCode{}, err
+	}
+
+	err = codes.Delete(id)
+	if _, ok := err.(store.NotFoundError); ok {
+		// someone else redeemed it between the Get and the Delete
+		return AuthCode{}, invalid
+	}
+	if err != nil {
+		return AuthCode{}, err
+	}
+
+	if time.Now().After(c.Expires) {
+		return AuthCode{}, invalid
+	}
+	return c, nil
+}
@@ -0,0 +1,75 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/mthorning/go-sso/config"
+	"github.com/mthorning/go-sso/store"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Issuer         string        `default:"http://localhost:8080"`
+	ClientsFile    string        `default:"clients.json" split_words:"true"`
+	CodeLifetime   time.Duration `default:"1m" split_words:"true"`
+	AllowPlainPKCE bool          `default:"true" envconfig:"ALLOW_PLAIN_PKCE"`
+
+	RefreshTokenLifetime      time.Duration `default:"720h" split_words:"true"`
+	RefreshTokenSweepInterval time.Duration `default:"1h" split_words:"true"`
+}
+
+var Conf Config
+
+func init() {
+	config.SetConfig(&Conf)
+	clients = store.Open("clients")
+	codes = store.Open("authcodes")
+	refreshTokens = store.Open("refreshtokens")
+}
+
+// Error is an RFC 6749 error response.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func NewError(code, description string) Error {
+	return Error{Code: code, Description: description}
+}
+
+func splitScope(scope string) []string {
+	return strings.Fields(scope)
+}
+
+func HasScope(scope, want string) bool {
+	for _, s := range splitScope(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tokens are only ever stored hashed so a leaked database can't be replayed
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
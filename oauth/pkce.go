@@ -0,0 +1,75 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"regexp"
+)
+
+// RFC 7636 section 4.1: 43-128 characters of [A-Z] / [a-z] / [0-9] / "-" / "." / "_" / "~"
+var pkceValue = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// CodeChallengeMethods lists the PKCE methods the server will accept.
+func CodeChallengeMethods() []string {
+	if Conf.AllowPlainPKCE {
+		return []string{"S256", "plain"}
+	}
+	return []string{"S256"}
+}
+
+// CheckChallenge validates the PKCE parameters of an authorization request
+// against the client's registration. It returns the method to store, which
+// defaults to plain as the RFC requires.
+func CheckChallenge(c Client, challenge, method string) (string, error) {
+	if challenge == "" {
+		if method != "" {
+			return "", NewError("invalid_request", "code_challenge_method without code_challenge")
+		}
+		if c.PKCERequired() {
+			return "", NewError("invalid_request", "This client must use PKCE")
+		}
+		return "", nil
+	}
+
+	if method == "" {
+		method = "plain"
+	}
+	switch method {
+	case "S256":
+	case "plain":
+		if !Conf.AllowPlainPKCE {
+			return "", NewError("invalid_request", "The plain code_challenge_method is not allowed")
+		}
+	default:
+		return "", NewError("invalid_request", "Unsupported code_challenge_method")
+	}
+	if !pkceValue.MatchString(challenge) {
+		return "", NewError("invalid_request", "Malformed code_challenge")
+	}
+	return method, nil
+}
+
+// VerifyCodeVerifier checks the token request's code_verifier against the
+// challenge stored with the code.
+func VerifyCodeVerifier(c AuthCode, verifier string) error {
+	if c.CodeChallenge == "" {
+		if verifier != "" {
+			return NewError("invalid_grant", "No code_challenge was sent with the authorization request")
+		}
+		return nil
+	}
+	if !pkceValue.MatchString(verifier) {
+		return NewError("invalid_grant", "Missing or malformed code_verifier")
+	}
+
+	expected := verifier
+	if c.CodeChallengeMethod == "S256" {
+		sum := sha256.Sum256([]byte(verifier))
+		expected = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(c.CodeChallenge)) != 1 {
+		return NewError("invalid_grant", "code_verifier does not match code_challenge")
+	}
+	return nil
+}
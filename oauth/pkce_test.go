@@ -0,0 +1,110 @@
+package oauth
+
+import (
+	"strings"
+	"testing"
+)
+
+// The example in RFC 7636 Appendix B.
+const (
+	rfcVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	rfcChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+// withConf changes the configuration for the rest of the test.
+func withConf(t *testing.T, change func(c *Config)) {
+	old := Conf
+	t.Cleanup(func() { Conf = old })
+	change(&Conf)
+}
+
+// errorCode is the OAuth error code of err, or "" if there isn't one.
+func errorCode(err error) string {
+	if e, ok := err.(Error); ok {
+		return e.Code
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func TestCheckChallenge(t *testing.T) {
+	public := Client{Public: true}
+	confidential := Client{}
+
+	tests := []struct {
+		name       string
+		allowPlain bool
+		client     Client
+		challenge  string
+		method     string
+		wantMethod string
+		wantErr    string
+	}{
+		{"S256", false, public, rfcChallenge, "S256", "S256", ""},
+		{"plain", true, public, rfcVerifier, "plain", "plain", ""},
+		{"plain by default", true, public, rfcVerifier, "", "plain", ""},
+		{"plain not allowed", false, public, rfcVerifier, "plain", "", "invalid_request"},
+		{"plain by default not allowed", false, public, rfcVerifier, "", "", "invalid_request"},
+		{"unknown method", true, public, rfcChallenge, "S512", "", "invalid_request"},
+		{"too short", true, public, rfcChallenge[:42], "S256", "", "invalid_request"},
+		{"too long", true, public, strings.Repeat("a", 129), "S256", "", "invalid_request"},
+		{"not URL safe", true, public, rfcChallenge[:42] + "+", "S256", "", "invalid_request"},
+		{"method without challenge", true, confidential, "", "S256", "", "invalid_request"},
+		{"public client without PKCE", true, public, "", "", "", "invalid_request"},
+		{"client requiring PKCE without it", true, Client{RequirePKCE: true}, "", "", "", "invalid_request"},
+		{"confidential client without PKCE", true, confidential, "", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConf(t, func(c *Config) { c.AllowPlainPKCE = tt.allowPlain })
+			method, err := CheckChallenge(tt.client, tt.challenge, tt.method)
+			if code := errorCode(err); code != tt.wantErr {
+				t.Fatalf("got error %q, want %q", code, tt.wantErr)
+			}
+			if method != tt.wantMethod {
+				t.Errorf("got method %q, want %q", method, tt.wantMethod)
+			}
+		})
+	}
+}
+
+func TestCodeChallengeMethods(t *testing.T) {
+	for allowPlain, want := range map[bool]string{true: "S256 plain", false: "S256"} {
+		withConf(t, func(c *Config) { c.AllowPlainPKCE = allowPlain })
+		if got := strings.Join(CodeChallengeMethods(), " "); got != want {
+			t.Errorf("AllowPlainPKCE %v: got %q, want %q", allowPlain, got, want)
+		}
+	}
+}
+
+func TestVerifyCodeVerifier(t *testing.T) {
+	s256 := AuthCode{CodeChallenge: rfcChallenge, CodeChallengeMethod: "S256"}
+	plain := AuthCode{CodeChallenge: rfcVerifier, CodeChallengeMethod: "plain"}
+
+	tests := []struct {
+		name     string
+		code     AuthCode
+		verifier string
+		wantErr  string
+	}{
+		{"RFC 7636 S256 example", s256, rfcVerifier, ""},
+		{"S256 wrong verifier", s256, strings.Repeat("a", 43), "invalid_grant"},
+		// the challenge itself doesn't pass for the verifier
+		{"S256 sent the challenge", s256, rfcChallenge, "invalid_grant"},
+		{"S256 missing verifier", s256, "", "invalid_grant"},
+		{"S256 malformed verifier", s256, rfcVerifier[:42], "invalid_grant"},
+		{"plain", plain, rfcVerifier, ""},
+		{"plain wrong verifier", plain, strings.Repeat("a", 43), "invalid_grant"},
+		{"verifier without a challenge", AuthCode{}, rfcVerifier, "invalid_grant"},
+		{"no PKCE", AuthCode{}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := errorCode(VerifyCodeVerifier(tt.code, tt.verifier)); code != tt.wantErr {
+				t.Errorf("got error %q, want %q", code, tt.wantErr)
+			}
+		})
+	}
+}
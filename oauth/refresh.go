@@ -0,0 +1,180 @@
+package oauth
+
+import (
+	"github.com/mthorning/go-sso/store"
+	"github.com/nu7hatch/gouuid"
+	"log"
+	"time"
+)
+
+// RefreshToken is stored under the hash of the opaque token handed to the
+// client. Every token issued from the same original grant shares a family so
+// that replaying a used token can take down the whole chain.
+type RefreshToken struct {
+	FamilyID string
+	ClientID string
+	UserID   string
+	Scope    string
+	Used     bool
+	Created  time.Time
+	Expires  time.Time
+}
+
+var refreshTokens store.Collection
+
+func NewRefreshToken(clientID, userID, scope string) (string, error) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return issueRefreshToken(RefreshToken{
+		FamilyID: u.String(),
+		ClientID: clientID,
+		UserID:   userID,
+		Scope:    scope,
+		Expires:  time.Now().Add(Conf.RefreshTokenLifetime),
+	})
+}
+
+// issueRefreshToken keeps rt's Expires, so rotating can't stretch a grant
+// beyond the lifetime of the family's first token.
+func issueRefreshToken(rt RefreshToken) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	rt.Used = false
+	rt.Created = time.Now()
+	if err := refreshTokens.Set(hashToken(token), rt); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func LookupRefreshToken(token string) (RefreshToken, error) {
+	var rt RefreshToken
+	err := refreshTokens.Get(hashToken(token), &rt)
+	return rt, err
+}
+
+// RotateRefreshToken spends a refresh token and returns its grant along with
+// the token that replaces it.
+func RotateRefreshToken(token, clientID string) (RefreshToken, string, error) {
+	invalid := NewError("invalid_grant", "Invalid or expired refresh token")
+
+	id := hashToken(token)
+	var rt RefreshToken
+	err := refreshTokens.Get(id, &rt)
+	if _, ok := err.(store.NotFoundError); ok {
+		return RefreshToken{}, "", invalid
+	}
+	if err != nil {
+		return RefreshToken{}, "", err
+	}
+
+	if rt.ClientID != clientID {
+		return RefreshToken{}, "", invalid
+	}
+	if rt.Used {
+		// either the legitimate client or an attacker has a stolen copy, and
+		// we can't tell which, so neither gets to keep the session
+		if err := RevokeFamily(rt.FamilyID); err != nil {
+			return RefreshToken{}, "", err
+		}
+		return RefreshToken{}, "", NewError("invalid_grant", "Refresh token has already been used")
+	}
+	if time.Now().After(rt.Expires) {
+		return RefreshToken{}, "", invalid
+	}
+
+	// deleting is the claim: of two requests spending the token at once only
+	// one can delete it
+	err = refreshTokens.Delete(id)
+	if _, ok := err.(store.NotFoundError); ok {
+		return RefreshToken{}, "", invalid
+	}
+	if err != nil {
+		return RefreshToken{}, "", err
+	}
+	// put back as used so that a later replay is still recognised, until
+	// the family expires and PruneRefreshTokens removes it
+	rt.Used = true
+	if err := refreshTokens.Set(id, rt); err != nil {
+		return RefreshToken{}, "", err
+	}
+	next, err := issueRefreshToken(rt)
+	if err != nil {
+		return RefreshToken{}, "", err
+	}
+	return rt, next, nil
+}
+
+// PruneRefreshTokens removes tokens, used or not, whose family has expired.
+// Replaying one after that is refused anyway, so there is nothing left to
+// recognise.
+func PruneRefreshTokens() error {
+	docs, err := refreshTokens.List()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, doc := range docs {
+		var rt RefreshToken
+		if err := doc.DataTo(&rt); err != nil {
+			return err
+		}
+		if !now.After(rt.Expires) {
+			continue
+		}
+		if err := refreshTokens.Delete(doc.ID()); err != nil {
+			if _, ok := err.(store.NotFoundError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SweepRefreshTokens prunes every RefreshTokenSweepInterval until the
+// process exits.
+func SweepRefreshTokens() {
+	if Conf.RefreshTokenSweepInterval <= 0 {
+		return
+	}
+	for range time.Tick(Conf.RefreshTokenSweepInterval) {
+		if err := PruneRefreshTokens(); err != nil {
+			log.Printf("error pruning refresh tokens: %v\n", err)
+		}
+	}
+}
+
+func RevokeFamily(familyID string) error {
+	docs, err := refreshTokens.Where("FamilyID", familyID)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if err := refreshTokens.Delete(doc.ID()); err != nil {
+			if _, ok := err.(store.NotFoundError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RevokeUser removes every refresh token issued to userID.
+func RevokeUser(userID string) error {
+	docs, err := refreshTokens.Where("UserID", userID)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if err := refreshTokens.Delete(doc.ID()); err != nil {
+			if _, ok := err.(store.NotFoundError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
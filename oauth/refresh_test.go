@@ -0,0 +1,110 @@
+package oauth
+
+import (
+	"github.com/mthorning/go-sso/store"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	store.UseMemory()
+}
+
+func TestRotateRefreshTokenOnce(t *testing.T) {
+	token, err := NewRefreshToken("client", "user", "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		next []string
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, rotated, err := RotateRefreshToken(token, "client")
+			if err == nil {
+				mu.Lock()
+				next = append(next, rotated)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(next) != 1 {
+		t.Fatalf("%d of %d concurrent rotations succeeded, want 1", len(next), n)
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	token, err := NewRefreshToken("client", "user", "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := LookupRefreshToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := RotateRefreshToken(token, "other"); err == nil {
+		t.Fatal("another client rotated the token")
+	}
+	_, next, err := RotateRefreshToken(token, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt, err := LookupRefreshToken(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rt.Expires.Equal(first.Expires) {
+		t.Errorf("rotated token expires %v, want the family's %v", rt.Expires, first.Expires)
+	}
+
+	if _, _, err := RotateRefreshToken(token, "client"); err == nil {
+		t.Fatal("replaying a spent token succeeded")
+	}
+	if _, err := LookupRefreshToken(next); err == nil {
+		t.Error("replaying a spent token left its family alive")
+	}
+}
+
+func TestPruneRefreshTokens(t *testing.T) {
+	live, err := NewRefreshToken("client", "user", "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent, err := NewRefreshToken("client", "user", "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := RotateRefreshToken(spent, "client"); err != nil {
+		t.Fatal(err)
+	}
+	// the spent token's family has run out
+	rt, err := LookupRefreshToken(spent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.Expires = time.Now().Add(-time.Minute)
+	if err := refreshTokens.Set(hashToken(spent), rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PruneRefreshTokens(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LookupRefreshToken(spent); err == nil {
+		t.Error("used token kept after its family expired")
+	}
+	if _, err := LookupRefreshToken(live); err != nil {
+		t.Errorf("live token pruned: %v", err)
+	}
+}
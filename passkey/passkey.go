@@ -0,0 +1,212 @@
+// Package passkey adapts users to the WebAuthn ceremonies, for registering
+// security keys and platform authenticators and signing in with them.
+package passkey
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/mthorning/go-sso/config"
+	"github.com/mthorning/go-sso/types"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// RPID is the domain passkeys are bound to; it can't change without
+	// every user registering their keys again.
+	RPID     string `envconfig:"webauthn_rp_id" default:"localhost"`
+	RPOrigin string `envconfig:"webauthn_rp_origin" default:"http://localhost:8080"`
+	RPName   string `envconfig:"webauthn_rp_name" default:"go-sso"`
+}
+
+var (
+	Conf         Config
+	relyingParty *webauthn.WebAuthn
+	// decoyKey makes up credential IDs for BeginDecoyLogin. It changes on
+	// restart, as would a user's passkeys being replaced.
+	decoyKey = make([]byte, 32)
+)
+
+func init() {
+	config.SetConfig(&Conf)
+	if _, err := rand.Read(decoyKey); err != nil {
+		log.Fatalf("error generating passkey decoy key: %v\n", err)
+	}
+
+	var err error
+	relyingParty, err = webauthn.New(&webauthn.Config{
+		RPDisplayName: Conf.RPName,
+		RPID:          Conf.RPID,
+		RPOrigin:      Conf.RPOrigin,
+	})
+	if err != nil {
+		log.Fatalf("error configuring WebAuthn: %v\n", err)
+	}
+}
+
+type ClonedError struct{}
+
+func (e ClonedError) Error() string {
+	return "This passkey's sign counter went backwards, so it may have been copied. Please remove it and register it again"
+}
+
+// user adapts a DBUser to webauthn.User.
+type user struct {
+	types.DBUser
+}
+
+func (u user) WebAuthnID() []byte {
+	return []byte(u.ID)
+}
+
+func (u user) WebAuthnName() string {
+	return u.Email
+}
+
+func (u user) WebAuthnDisplayName() string {
+	return u.Name
+}
+
+func (u user) WebAuthnIcon() string {
+	return ""
+}
+
+func (u user) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.Passkeys))
+	for _, p := range u.Passkeys {
+		if p.CloneWarning {
+			continue
+		}
+		creds = append(creds, webauthn.Credential{
+			ID:              p.ID,
+			PublicKey:       p.PublicKey,
+			AttestationType: p.AttestationType,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    p.AAGUID,
+				SignCount: p.SignCount,
+			},
+		})
+	}
+	return creds
+}
+
+// BeginRegistration returns the options for navigator.credentials.create
+// and the ceremony state to keep in the session until it finishes.
+func BeginRegistration(u types.DBUser) (*protocol.CredentialCreation, string, error) {
+	exclude := make([]protocol.CredentialDescriptor, len(u.Passkeys))
+	for i, p := range u.Passkeys {
+		exclude[i] = protocol.CredentialDescriptor{
+			Type:         protocol.PublicKeyCredentialType,
+			CredentialID: p.ID,
+		}
+	}
+
+	options, session, err := relyingParty.BeginRegistration(user{u},
+		webauthn.WithExclusions(exclude),
+		webauthn.WithConveyancePreference(protocol.PreferNoAttestation),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	state, err := json.Marshal(session)
+	return options, string(state), err
+}
+
+func FinishRegistration(u types.DBUser, state string, name string, r *http.Request) (types.Passkey, error) {
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(state), &session); err != nil {
+		return types.Passkey{}, err
+	}
+
+	cred, err := relyingParty.FinishRegistration(user{u}, session, r)
+	if err != nil {
+		return types.Passkey{}, err
+	}
+
+	now := time.Now()
+	return types.Passkey{
+		ID:              cred.ID,
+		Name:            name,
+		PublicKey:       cred.PublicKey,
+		AttestationType: cred.AttestationType,
+		AAGUID:          cred.Authenticator.AAGUID,
+		SignCount:       cred.Authenticator.SignCount,
+		Created:         now,
+		LastUsed:        now,
+	}, nil
+}
+
+// BeginLogin returns the options for navigator.credentials.get. A passkey
+// that replaces the password must also verify the user, with a PIN or
+// biometric, to count as two factors.
+func BeginLogin(u types.DBUser, passwordless bool) (*protocol.CredentialAssertion, string, error) {
+	verification := protocol.VerificationPreferred
+	if passwordless {
+		verification = protocol.VerificationRequired
+	}
+
+	options, session, err := relyingParty.BeginLogin(user{u}, webauthn.WithUserVerification(verification))
+	if err != nil {
+		return nil, "", err
+	}
+	state, err := json.Marshal(session)
+	return options, string(state), err
+}
+
+// BeginDecoyLogin returns options like BeginLogin's for an email address
+// that can't sign in with a passkey, so the response doesn't tell anyone
+// whether the account exists. The credential is made up, but the same each
+// time for the same address, and the ceremony can never be finished.
+func BeginDecoyLogin(email string) (*protocol.CredentialAssertion, string, error) {
+	mac := hmac.New(sha256.New, decoyKey)
+	mac.Write([]byte(strings.ToLower(email)))
+	decoy := types.DBUser{
+		Passkeys: []types.Passkey{{ID: mac.Sum(nil)}},
+	}
+	return BeginLogin(decoy, true)
+}
+
+// UserID returns who a login ceremony was started for.
+func UserID(state string) (string, error) {
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(state), &session); err != nil {
+		return "", err
+	}
+	return string(session.UserID), nil
+}
+
+// FinishLogin verifies the assertion and returns the user's passkeys with
+// the sign counter of the one used brought up to date. A counter that has
+// gone backwards flags the key and fails the login.
+func FinishLogin(u types.DBUser, state string, r *http.Request) ([]types.Passkey, error) {
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(state), &session); err != nil {
+		return nil, err
+	}
+
+	cred, err := relyingParty.FinishLogin(user{u}, session, r)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys := append([]types.Passkey{}, u.Passkeys...)
+	for i, p := range passkeys {
+		if !bytes.Equal(p.ID, cred.ID) {
+			continue
+		}
+		passkeys[i].SignCount = cred.Authenticator.SignCount
+		passkeys[i].LastUsed = time.Now()
+		if cred.Authenticator.CloneWarning {
+			passkeys[i].CloneWarning = true
+			return passkeys, ClonedError{}
+		}
+	}
+	return passkeys, nil
+}
@@ -0,0 +1,188 @@
+// Package pwpolicy decides whether a new password is acceptable.
+package pwpolicy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/mthorning/go-sso/config"
+	"github.com/mthorning/go-sso/types"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type Config struct {
+	PasswordMinLength int `default:"8" split_words:"true"`
+	// PasswordMaxLength can't be more than 72 as bcrypt ignores the rest.
+	PasswordMaxLength int `default:"72" split_words:"true"`
+	// PasswordClasses is how many of lower case, upper case, digits and
+	// symbols a password must use.
+	PasswordClasses int `default:"0" split_words:"true"`
+	// PasswordHistory is how many recent passwords, counting the current
+	// one, can't be reused.
+	PasswordHistory int `default:"5" split_words:"true"`
+	// BreachedPasswordsDir holds SHA-1 range files named by the first five
+	// hex characters of the hash, each listing SUFFIX:COUNT lines, as served
+	// by the Pwned Passwords range API. Checking is skipped when unset.
+	BreachedPasswordsDir      string `split_words:"true"`
+	BreachedPasswordsMinCount int    `default:"1" split_words:"true"`
+}
+
+type PolicyError struct {
+	Message string
+}
+
+func (e PolicyError) Error() string {
+	return e.Message
+}
+
+var Conf Config
+
+func init() {
+	config.SetConfig(&Conf)
+	if Conf.PasswordMaxLength <= 0 || Conf.PasswordMaxLength > 72 {
+		Conf.PasswordMaxLength = 72
+	}
+}
+
+// Check returns a PolicyError describing the first rule password breaks.
+// user is whoever the password is for, with their current password and
+// history if they have them.
+func Check(password string, user types.DBUser) error {
+	if password == "" {
+		return PolicyError{"Please enter a password"}
+	}
+	if len(password) > Conf.PasswordMaxLength {
+		return PolicyError{fmt.Sprintf("Passwords can't be longer than %d bytes", Conf.PasswordMaxLength)}
+	}
+	if utf8.RuneCountInString(password) < Conf.PasswordMinLength {
+		return PolicyError{fmt.Sprintf("Passwords must be at least %d characters long", Conf.PasswordMinLength)}
+	}
+	if classes(password) < Conf.PasswordClasses {
+		return PolicyError{fmt.Sprintf("Passwords must use at least %d of lower case letters, upper case letters, numbers and symbols", Conf.PasswordClasses)}
+	}
+	if containsPersonalInfo(password, user) {
+		return PolicyError{"Passwords can't contain your name or email address"}
+	}
+
+	for _, hash := range recent(user) {
+		if len(hash) > 0 && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+			return PolicyError{"Please choose a password you haven't used recently"}
+		}
+	}
+
+	breached, err := Breached(password)
+	if err != nil {
+		return err
+	}
+	if breached {
+		return PolicyError{"This password has appeared in a data breach, please choose another"}
+	}
+	return nil
+}
+
+func classes(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+func containsPersonalInfo(password string, user types.DBUser) bool {
+	password = strings.ToLower(password)
+	parts := strings.Fields(strings.ToLower(user.Name))
+	if at := strings.LastIndex(user.Email, "@"); at > 0 {
+		parts = append(parts, strings.ToLower(user.Email[:at]))
+	}
+	for _, p := range parts {
+		// short names like "Al" turn up inside too many good passwords
+		if utf8.RuneCountInString(p) >= 3 && strings.Contains(password, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Breached looks the password up in the local corpus. Only the file for the
+// first five characters of its hash is read.
+func Breached(password string) (bool, error) {
+	if Conf.BreachedPasswordsDir == "" {
+		return false, nil
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(Conf.BreachedPasswordsDir, prefix))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(Conf.BreachedPasswordsDir, prefix+".txt"))
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		parts := strings.SplitN(line, ":", 2)
+		if !strings.EqualFold(parts[0], suffix) {
+			continue
+		}
+		count := 1
+		if len(parts) == 2 {
+			if n, err := strconv.Atoi(parts[1]); err == nil {
+				count = n
+			}
+		}
+		return count >= Conf.BreachedPasswordsMinCount, nil
+	}
+	return false, scanner.Err()
+}
+
+// recent is user's current password and as many before it as make up
+// PasswordHistory.
+func recent(user types.DBUser) [][]byte {
+	if Conf.PasswordHistory <= 0 {
+		return nil
+	}
+	previous := append([][]byte{user.Password}, user.PasswordHistory...)
+	if len(previous) > Conf.PasswordHistory {
+		previous = previous[:Conf.PasswordHistory]
+	}
+	return previous
+}
+
+// NewHistory returns the history to store once user's password changes.
+// The new password will count as one of PasswordHistory, so one fewer are
+// kept.
+func NewHistory(user types.DBUser) [][]byte {
+	history := recent(user)
+	if len(user.Password) == 0 || len(history) == 0 {
+		return [][]byte{}
+	}
+	if len(history) == Conf.PasswordHistory {
+		history = history[:len(history)-1]
+	}
+	return history
+}
@@ -0,0 +1,134 @@
+package pwpolicy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/mthorning/go-sso/types"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withConf swaps in c for the rest of the test.
+func withConf(t *testing.T, c Config) {
+	old := Conf
+	t.Cleanup(func() { Conf = old })
+	Conf = c
+}
+
+func hash(t *testing.T, password string) []byte {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("Breached pass 1"))
+	h := strings.ToUpper(hex.EncodeToString(sum[:]))
+	rare := sha1.Sum([]byte("Rarely breached 1"))
+	r := strings.ToUpper(hex.EncodeToString(rare[:]))
+	files := map[string]string{
+		h[:5]:          "0000000000000000000000000000000000A:3\r\n" + h[5:] + ":12\r\n",
+		r[:5] + ".txt": strings.ToLower(r[5:]) + ":1\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	withConf(t, Config{
+		PasswordMinLength:         8,
+		PasswordMaxLength:         72,
+		PasswordClasses:           3,
+		PasswordHistory:           3,
+		BreachedPasswordsDir:      dir,
+		BreachedPasswordsMinCount: 2,
+	})
+	user := types.DBUser{
+		Name:            "Alice Al Smith",
+		Email:           "asmith@example.com",
+		Password:        hash(t, "Current pass 1"),
+		PasswordHistory: [][]byte{hash(t, "Previous pass 1"), hash(t, "Oldest pass 1"), hash(t, "Forgotten pass 1")},
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		want     bool
+	}{
+		{"acceptable", "Correct horse 1", true},
+		{"empty", "", false},
+		{"too short", "Ab1!xyz", false},
+		{"length counted in characters", "Åbc1ÅbcÅ", true},
+		{"too long", "Aa1" + strings.Repeat("x", 70), false},
+		{"longest allowed", "Aa1" + strings.Repeat("x", 69), true},
+		{"two classes", "lowercase123", false},
+		{"three classes", "Lowercase123", true},
+		{"symbols count", "lowercase12!", true},
+		{"first name", "Xx1alicexx", false},
+		{"name in another case", "Xx1SMITHxx", false},
+		{"short name part", "Xx1alxxxxx", true},
+		{"email local part", "Xx1Asmith!", false},
+		{"email domain", "Xx1example!", true},
+		{"current password", "Current pass 1", false},
+		{"previous password", "Previous pass 1", false},
+		{"third password back", "Oldest pass 1", false},
+		{"password beyond the history", "Forgotten pass 1", true},
+		{"breached", "Breached pass 1", false},
+		{"breached too rarely to count", "Rarely breached 1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Check(tt.password, user)
+			if tt.want && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !tt.want {
+				if _, ok := err.(PolicyError); !ok {
+					t.Errorf("got %v, want a PolicyError", err)
+				}
+			}
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	withConf(t, Config{PasswordHistory: 3, PasswordMaxLength: 72})
+	passwords := []string{"first", "second", "third", "fourth", "fifth"}
+	user := types.DBUser{Password: hash(t, passwords[0])}
+
+	for i, next := range passwords[1:] {
+		user.PasswordHistory = NewHistory(user)
+		user.Password = hash(t, next)
+		if len(user.PasswordHistory) > Conf.PasswordHistory-1 {
+			t.Fatalf("history holds %d besides the current password, want at most %d", len(user.PasswordHistory), Conf.PasswordHistory-1)
+		}
+
+		// the current password and the two before it are blocked
+		for j, p := range passwords[:i+2] {
+			blocked := false
+			for _, h := range recent(user) {
+				if bcrypt.CompareHashAndPassword(h, []byte(p)) == nil {
+					blocked = true
+				}
+			}
+			if want := j >= i+2-Conf.PasswordHistory; blocked != want {
+				t.Errorf("after changing to %s: %s blocked %v, want %v", next, p, blocked, want)
+			}
+		}
+	}
+
+	withConf(t, Config{PasswordHistory: 0})
+	if h := NewHistory(user); len(h) != 0 {
+		t.Errorf("kept %d passwords with no history", len(h))
+	}
+	if recent(user) != nil {
+		t.Error("current password blocked with no history")
+	}
+}
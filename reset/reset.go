@@ -0,0 +1,125 @@
+// Package reset issues the single use tokens emailed to users who have
+// forgotten their password.
+package reset
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/mthorning/go-sso/config"
+	"github.com/mthorning/go-sso/store"
+	"time"
+)
+
+type Config struct {
+	ResetTokenLifetime time.Duration `default:"1h" split_words:"true"`
+}
+
+type Token struct {
+	UserID  string
+	Created time.Time
+	Expires time.Time
+}
+
+type InvalidTokenError struct{}
+
+func (e InvalidTokenError) Error() string {
+	return "This password reset link is invalid or has expired"
+}
+
+var (
+	Conf   Config
+	tokens store.Collection
+)
+
+func init() {
+	config.SetConfig(&Conf)
+	tokens = store.Open("passwordresets")
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tokens are stored hashed so a leaked database can't be used to take over
+// accounts
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// New returns a token for userID, replacing any they were sent before.
+func New(userID string) (string, error) {
+	if err := Cancel(userID); err != nil {
+		return "", err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = tokens.Set(hashToken(token), Token{
+		UserID:  userID,
+		Created: now,
+		Expires: now.Add(Conf.ResetTokenLifetime),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Check returns who the token belongs to without using it up.
+func Check(token string) (string, error) {
+	var t Token
+	err := tokens.Get(hashToken(token), &t)
+	if _, ok := err.(store.NotFoundError); ok {
+		return "", InvalidTokenError{}
+	}
+	if err != nil {
+		return "", err
+	}
+	if time.Now().After(t.Expires) {
+		return "", InvalidTokenError{}
+	}
+	return t.UserID, nil
+}
+
+// Redeem uses the token up and returns who it belongs to.
+func Redeem(token string) (string, error) {
+	userID, err := Check(token)
+	if err != nil {
+		return "", err
+	}
+
+	err = tokens.Delete(hashToken(token))
+	if _, ok := err.(store.NotFoundError); ok {
+		// redeemed by someone else between the Check and the Delete
+		return "", InvalidTokenError{}
+	}
+	if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// Cancel removes every outstanding token for userID.
+func Cancel(userID string) error {
+	docs, err := tokens.Where("UserID", userID)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		err := tokens.Delete(doc.ID())
+		if _, ok := err.(store.NotFoundError); err != nil && !ok {
+			return err
+		}
+	}
+	return nil
+}
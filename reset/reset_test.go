@@ -0,0 +1,100 @@
+package reset
+
+import (
+	"github.com/mthorning/go-sso/store"
+	"testing"
+	"time"
+)
+
+func init() {
+	store.UseMemory()
+}
+
+func TestTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		// use does whatever happens to the token after it's sent
+		use     func(t *testing.T, userID, token string)
+		wantErr bool
+	}{
+		{"unused", func(t *testing.T, userID, token string) {}, false},
+		{"redeemed", func(t *testing.T, userID, token string) {
+			if _, err := Redeem(token); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"expired", func(t *testing.T, userID, token string) {
+			err := tokens.Set(hashToken(token), Token{
+				UserID:  userID,
+				Created: time.Now().Add(-2 * Conf.ResetTokenLifetime),
+				Expires: time.Now().Add(-Conf.ResetTokenLifetime),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"replaced", func(t *testing.T, userID, token string) {
+			if _, err := New(userID); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"cancelled", func(t *testing.T, userID, token string) {
+			if err := Cancel(userID); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID := "user-" + tt.name
+			token, err := New(userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.use(t, userID, token)
+
+			got, err := Check(token)
+			if tt.wantErr {
+				if _, ok := err.(InvalidTokenError); !ok {
+					t.Fatalf("Check = %q, %v; want InvalidTokenError", got, err)
+				}
+				if _, err := Redeem(token); err == nil {
+					t.Fatal("Redeem of an invalid token succeeded")
+				}
+				return
+			}
+			if err != nil || got != userID {
+				t.Fatalf("Check = %q, %v; want %q", got, err, userID)
+			}
+
+			got, err = Redeem(token)
+			if err != nil || got != userID {
+				t.Fatalf("Redeem = %q, %v; want %q", got, err, userID)
+			}
+			if _, err := Redeem(token); err == nil {
+				t.Fatal("token redeemed twice")
+			}
+		})
+	}
+}
+
+func TestTokensStoredHashed(t *testing.T) {
+	token, err := New("hashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored Token
+	if err := tokens.Get(token, &stored); err == nil {
+		t.Error("the token itself is a document ID")
+	}
+	docs, err := tokens.Where("UserID", "hashed")
+	if err != nil || len(docs) != 1 {
+		t.Fatalf("Where = %v, %v; want the one token", docs, err)
+	}
+	if id := docs[0].ID(); id != hashToken(token) {
+		t.Errorf("stored as %q, want the token's hash", id)
+	}
+	if _, err := Check(hashToken(token)); err == nil {
+		t.Error("the stored hash works as a token")
+	}
+}
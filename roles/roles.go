@@ -0,0 +1,91 @@
+// Package roles maps the named roles users are given to the permissions the
+// server checks before letting them into the admin pages.
+package roles
+
+const (
+	UsersRead     = "users:read"
+	UsersWrite    = "users:write"
+	ClientsManage = "clients:manage"
+	TokensRevoke  = "tokens:revoke"
+	AuditRead     = "audit:read"
+)
+
+// Admin can do everything, and there must always be an active user with it.
+const Admin = "admin"
+
+type Role struct {
+	Name        string
+	Description string
+	Permissions []string
+}
+
+// All are the roles that can be assigned, in the order they are shown.
+var All = []Role{
+	{
+		Name:        Admin,
+		Description: "Full control of users, applications and the audit log",
+		Permissions: []string{UsersRead, UsersWrite, ClientsManage, TokensRevoke, AuditRead},
+	},
+	{
+		Name:        "user-manager",
+		Description: "Add, edit, disable and delete users",
+		Permissions: []string{UsersRead, UsersWrite},
+	},
+	{
+		Name:        "helpdesk",
+		Description: "Look up users and their sessions",
+		Permissions: []string{UsersRead},
+	},
+	{
+		Name:        "client-manager",
+		Description: "Register applications and revoke their tokens",
+		Permissions: []string{ClientsManage, TokensRevoke},
+	},
+	{
+		Name:        "auditor",
+		Description: "Search the audit log",
+		Permissions: []string{UsersRead, AuditRead},
+	},
+}
+
+func Get(name string) (Role, bool) {
+	for _, role := range All {
+		if role.Name == name {
+			return role, true
+		}
+	}
+	return Role{}, false
+}
+
+// Allows reports whether any of the named roles grants permission. Names
+// that aren't roles any more are ignored.
+func Allows(names []string, permission string) bool {
+	for _, name := range names {
+		role, ok := Get(name)
+		if !ok {
+			continue
+		}
+		for _, p := range role.Permissions {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CanGrant reports whether someone with the roles held may give role to,
+// or take it from, someone else. They must already have every permission
+// it grants, so nobody can hand out more than they have.
+func CanGrant(held []string, role string) bool {
+	r, ok := Get(role)
+	if !ok {
+		return false
+	}
+	for _, p := range r.Permissions {
+		if !Allows(held, p) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"github.com/mthorning/go-sso/audit"
+	"github.com/mthorning/go-sso/roles"
+	"github.com/mthorning/go-sso/store"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type AuditPage struct {
+	Actor   string
+	Target  string
+	Action  string
+	Outcome string
+	Since   string
+	Until   string
+	Events  []auditRow
+	Error   string
+}
+
+// auditRow shows an event with the names of the accounts it involves, which
+// are only recorded by ID.
+type auditRow struct {
+	audit.Event
+	ActorName  string
+	TargetName string
+}
+
+// recordEvent logs e with the details of the client that made r.
+func recordEvent(r *http.Request, e audit.Event) {
+	e.IP = clientIP(r)
+	e.UserAgent = r.UserAgent()
+	audit.Log(e)
+}
+
+// auditUserID lets admins search by email address. Anything that isn't the
+// address of an account is searched for as it is, which covers user IDs and
+// logins to unknown addresses.
+func auditUserID(value string) (string, error) {
+	if !strings.Contains(value, "@") {
+		return value, nil
+	}
+	user, err := store.Users.FindByEmail(value)
+	if _, ok := err.(store.NotFoundError); ok {
+		return value, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return user.ID, nil
+}
+
+func HandleAuditPage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := getPermittedUser(w, r, roles.AuditRead); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	page := AuditPage{
+		Actor:   strings.TrimSpace(query.Get("actor")),
+		Target:  strings.TrimSpace(query.Get("target")),
+		Action:  strings.TrimSpace(query.Get("action")),
+		Outcome: query.Get("outcome"),
+		Since:   query.Get("since"),
+		Until:   query.Get("until"),
+	}
+
+	var sendError = func(errorMessage string) {
+		page.Error = errorMessage
+		ServeStaticPage(w, r, "/audit", page)
+	}
+
+	filter := audit.Filter{
+		Action:  page.Action,
+		Outcome: page.Outcome,
+	}
+	var err error
+	if filter.Actor, err = auditUserID(page.Actor); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if filter.Target, err = auditUserID(page.Target); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if page.Since != "" {
+		if filter.Since, err = time.ParseInLocation("2006-01-02", page.Since, time.Local); err != nil {
+			sendError("Please enter dates as YYYY-MM-DD")
+			return
+		}
+	}
+	if page.Until != "" {
+		if filter.Until, err = time.ParseInLocation("2006-01-02", page.Until, time.Local); err != nil {
+			sendError("Please enter dates as YYYY-MM-DD")
+			return
+		}
+		// include the whole of the last day
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+
+	events, err := audit.Search(filter)
+	if _, ok := err.(audit.NotSearchableError); ok {
+		sendError(err.Error())
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	users, err := store.Users.List()
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	names := map[string]string{}
+	for _, u := range users {
+		names[u.ID] = u.Email
+	}
+	for _, e := range events {
+		page.Events = append(page.Events, auditRow{
+			Event:      e,
+			ActorName:  names[e.Actor],
+			TargetName: names[e.Target],
+		})
+	}
+	ServeStaticPage(w, r, "/audit", page)
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/mthorning/go-sso/oauth"
+	"github.com/mthorning/go-sso/roles"
+	"github.com/mthorning/go-sso/store"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type ClientForm struct {
+	ID            string
+	New           bool
+	Name          string
+	LogoURI       string
+	RedirectURIs  string
+	Scopes        string
+	GrantTypes    map[string]bool
+	AllGrantTypes []string
+	Public        bool
+	RequirePKCE   bool
+	Disabled      bool
+	Secret        string
+	Error         string
+}
+
+func NewClientForm(c oauth.Client) ClientForm {
+	grantTypes := map[string]bool{}
+	for _, g := range c.GrantTypes {
+		grantTypes[g] = true
+	}
+	return ClientForm{
+		ID:            c.ID,
+		New:           c.ID == "",
+		Name:          c.Name,
+		LogoURI:       c.LogoURI,
+		RedirectURIs:  strings.Join(c.RedirectURIs, "\n"),
+		Scopes:        strings.Join(c.Scopes, " "),
+		GrantTypes:    grantTypes,
+		AllGrantTypes: oauth.GrantTypes,
+		Public:        c.Public,
+		RequirePKCE:   c.RequirePKCE,
+		Disabled:      c.Disabled,
+	}
+}
+
+func HandleClient(w http.ResponseWriter, r *http.Request) {
+	if _, ok := getPermittedUser(w, r, roles.ClientsManage); !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	clientID := mux.Vars(r)["id"]
+	isNew := clientID == "new"
+
+	c := oauth.Client{
+		Name:         strings.TrimSpace(r.PostFormValue("name")),
+		LogoURI:      strings.TrimSpace(r.PostFormValue("logoUri")),
+		RedirectURIs: strings.Fields(r.PostFormValue("redirectUris")),
+		Scopes:       strings.Fields(r.PostFormValue("scopes")),
+		GrantTypes:   r.PostForm["grantTypes"],
+		Public:       r.PostFormValue("public") != "",
+		RequirePKCE:  r.PostFormValue("requirePkce") != "",
+	}
+
+	var sendError = func(errorMessage string) {
+		form := NewClientForm(c)
+		form.ID = clientID
+		form.New = isNew
+		form.Error = errorMessage
+		ServeStaticPage(w, r, "/client/"+clientID, form)
+	}
+	if c.Name == "" {
+		sendError("Please provide a name")
+		return
+	}
+	if len(c.RedirectURIs) == 0 {
+		sendError("Please provide at least one redirect URI")
+		return
+	}
+	for _, uri := range append([]string{c.LogoURI}, c.RedirectURIs...) {
+		if uri == "" {
+			continue
+		}
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Fragment != "" {
+			sendError(uri + " is not a valid absolute URL")
+			return
+		}
+	}
+	if len(c.Scopes) == 0 {
+		sendError("Please provide at least one scope")
+		return
+	}
+	if len(c.GrantTypes) == 0 {
+		sendError("Please select at least one grant type")
+		return
+	}
+	for _, g := range c.GrantTypes {
+		if !contains(oauth.GrantTypes, g) {
+			sendError("Unknown grant type " + g)
+			return
+		}
+	}
+
+	if isNew {
+		created, secret, err := oauth.CreateClient(c)
+		if err != nil {
+			HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		form := NewClientForm(created)
+		form.Secret = secret
+		ServeStaticPage(w, r, "/client/"+created.ID, form)
+		return
+	}
+
+	existing, err := oauth.LoadClient(clientID)
+	if _, ok := err.(store.NotFoundError); ok {
+		HTMLError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.ID = existing.ID
+	c.SecretHash = existing.SecretHash
+	c.Disabled = existing.Disabled
+	c.Created = existing.Created
+	if err := oauth.SaveClient(c); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// a client that has just become confidential needs a secret to log in with
+	if !c.Public && len(c.SecretHash) == 0 {
+		secret, err := oauth.RotateSecret(c.ID)
+		if err != nil {
+			HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		form := NewClientForm(c)
+		form.Secret = secret
+		ServeStaticPage(w, r, "/client/"+c.ID, form)
+		return
+	}
+
+	http.Redirect(w, r, "/clients", http.StatusFound)
+}
+
+func HandleClientSecret(w http.ResponseWriter, r *http.Request) {
+	if _, ok := getPermittedUser(w, r, roles.ClientsManage); !ok {
+		return
+	}
+
+	c, err := oauth.LoadClient(mux.Vars(r)["id"])
+	if _, ok := err.(store.NotFoundError); ok {
+		HTMLError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	form := NewClientForm(c)
+	if c.Public {
+		form.Error = "Public clients don't have a secret"
+		ServeStaticPage(w, r, "/client/"+c.ID, form)
+		return
+	}
+
+	form.Secret, err = oauth.RotateSecret(c.ID)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ServeStaticPage(w, r, "/client/"+c.ID, form)
+}
+
+func HandleClientDisable(w http.ResponseWriter, r *http.Request) {
+	if _, ok := getPermittedUser(w, r, roles.ClientsManage); !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	c, err := oauth.LoadClient(mux.Vars(r)["id"])
+	if _, ok := err.(store.NotFoundError); ok {
+		HTMLError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.Disabled = r.PostFormValue("disabled") == "true"
+	if err := oauth.SaveClient(c); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/clients", http.StatusFound)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/mthorning/go-sso/session"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	inRepoRoot(t)
+	handler := CSRF("/token")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	res := httptest.NewRecorder()
+	token, err := session.CSRFToken(res, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := res.Result().Cookies()
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		form        url.Values
+		header      string
+		contentType string
+		want        int
+		wantType    string
+	}{
+		{"GET", "GET", "/", nil, "", "", http.StatusOK, ""},
+		{"form token", "POST", "/", url.Values{"csrf_token": {token}}, "", "", http.StatusOK, ""},
+		{"header token", "POST", "/", nil, token, "", http.StatusOK, ""},
+		{"exempt", "POST", "/token", nil, "", "", http.StatusOK, ""},
+		{"missing", "POST", "/", nil, "", "", http.StatusForbidden, "text/html"},
+		{"wrong form token", "POST", "/", url.Values{"csrf_token": {"nope"}}, "", "", http.StatusForbidden, "text/html"},
+		{"wrong header token", "POST", "/", nil, "nope", "", http.StatusForbidden, "application/json"},
+		{"JSON", "POST", "/", nil, "", "application/json", http.StatusForbidden, "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = "application/x-www-form-urlencoded"
+			}
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", contentType)
+			if tt.header != "" {
+				req.Header.Set("X-CSRF-Token", tt.header)
+			}
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			if res.Code != tt.want {
+				t.Errorf("got %d, want %d", res.Code, tt.want)
+			}
+			if got := res.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %s", got, tt.wantType)
+			}
+		})
+	}
+}
@@ -1,21 +1,37 @@
 package server
 
 import (
-	"context"
-	"encoding/json"
-	"fmt"
 	"github.com/gorilla/mux"
-	"github.com/mthorning/go-sso/firestore"
-	"github.com/mthorning/go-sso/jwt"
+	"github.com/mthorning/go-sso/audit"
+	"github.com/mthorning/go-sso/pwpolicy"
+	"github.com/mthorning/go-sso/roles"
 	"github.com/mthorning/go-sso/session"
+	"github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/throttle"
 	"github.com/mthorning/go-sso/types"
 	"golang.org/x/crypto/bcrypt"
-	"google.golang.org/api/iterator"
+	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
+// dummyHash is the hash of a password nobody knows. Checking it when there is
+// no password to check makes every refusal take as long, so the time taken
+// doesn't give away which addresses have accounts.
+var dummyHash = []byte("$2a$10$9vUP3Js7h00Hft.CsLN41u.dvGMoc2n6tQ7SoXrNFJrxvSJyOMe5S")
+
+// comparePassword never accepts a password for a user without one.
+func comparePassword(hash []byte, password string) error {
+	if len(hash) == 0 {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
+
 func HandleLogin(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
@@ -24,12 +40,17 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 
 	email := r.PostFormValue("email")
 	password := r.PostFormValue("password")
+	next := r.PostFormValue("next")
 
-	var sendError = func(errorMessage string) {
-		ServeStaticPage(w, r, filepath.Clean(r.URL.Path), map[string]string{
+	var loginPage = func(errorMessage string) map[string]string {
+		return map[string]string{
 			"Email": email,
+			"Next":  next,
 			"Error": errorMessage,
-		})
+		}
+	}
+	var sendError = func(errorMessage string) {
+		ServeStaticPage(w, r, filepath.Clean(r.URL.Path), loginPage(errorMessage))
 	}
 	if email == "" {
 		sendError("Please enter an email address")
@@ -40,11 +61,29 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := firestore.Users.Where("Email", "==", email)
-	iter := query.Documents(context.Background())
-	defer iter.Stop()
-	doc, err := iter.Next()
-	if err == iterator.Done {
+	ip := clientIP(r)
+	wait, err := loginAttempt(email, ip)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		servePage(w, r, filepath.Clean(r.URL.Path), loginPage(tooManyRequests(w, wait)), http.StatusTooManyRequests)
+		return
+	}
+
+	dbUser, err := store.Users.FindByEmail(email)
+	if err == nil && dbUser.Deleted() {
+		err = store.NotFoundError{}
+	}
+	if _, ok := err.(store.NotFoundError); ok {
+		comparePassword(nil, password)
+		recordEvent(r, audit.Event{
+			Target:  email,
+			Action:  "login",
+			Outcome: audit.Failure,
+			Detail:  "unknown account",
+		})
 		sendError("Email or password incorrect")
 		return
 	}
@@ -53,20 +92,188 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var dbUser types.DBUser
-	doc.DataTo(&dbUser)
-	dbUser.ID = doc.Ref.ID
-
-	if err = bcrypt.CompareHashAndPassword(dbUser.Password, []byte(password)); err != nil {
+	if err = comparePassword(dbUser.Password, password); err != nil {
+		recordEvent(r, audit.Event{
+			Target:  dbUser.ID,
+			Action:  "login",
+			Outcome: audit.Failure,
+			Detail:  "incorrect password",
+		})
 		sendError("Email or password incorrect")
 		return
 	}
+	if err := attemptPassed(email, ip); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if dbUser.Disabled {
+		recordEvent(r, audit.Event{
+			Target:  dbUser.ID,
+			Action:  "login",
+			Outcome: audit.Failure,
+			Detail:  "account disabled",
+		})
+		sendError(AccountDisabledError{}.Error())
+		return
+	}
+
+	if verificationRequired(dbUser) {
+		ServeStaticPage(w, r, filepath.Clean(r.URL.Path), map[string]string{
+			"Email":      email,
+			"Next":       next,
+			"Error":      "Please verify your email address before signing in",
+			"Unverified": "true",
+		})
+		return
+	}
 
-	if err := session.SetSession(w, r, &dbUser); err != nil {
+	if dbUser.NeedsSecondFactor() {
+		if err := session.SetPendingSession(w, r, &dbUser); err != nil {
+			HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/login/2fa?next="+url.QueryEscape(next), http.StatusFound)
+		return
+	}
+
+	if err := loginSucceeded(w, r, &dbUser, "password"); err != nil {
 		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, "/", http.StatusFound)
+	http.Redirect(w, r, safeRedirect(next), http.StatusFound)
+}
+
+// loginWait returns how long the client has to wait before it can try to
+// sign in to email again.
+func loginWait(email, ip string) (time.Duration, error) {
+	accountWait, err := throttle.Account.Wait(email)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := throttle.IP.Wait(ip)
+	if err != nil {
+		return 0, err
+	}
+	if ipWait > accountWait {
+		return ipWait, nil
+	}
+	return accountWait, nil
+}
+
+// loginAttempt counts an attempt against both the account and the
+// client's IP before the credential is checked, unless the client has to
+// wait first.
+func loginAttempt(email, ip string) (time.Duration, error) {
+	wait, err := throttle.Account.Attempt(email)
+	if err != nil || wait > 0 {
+		return wait, err
+	}
+	wait, err = throttle.IP.Attempt(ip)
+	if err != nil || wait > 0 {
+		// the attempt won't be made after all
+		if err := throttle.Account.Succeeded(email); err != nil {
+			return 0, err
+		}
+	}
+	return wait, err
+}
+
+// attemptPassed takes back a loginAttempt whose credential was right.
+func attemptPassed(email, ip string) error {
+	if err := throttle.Account.Succeeded(email); err != nil {
+		return err
+	}
+	return throttle.IP.Succeeded(ip)
+}
+
+// mailAttempt counts an email about to be sent to email at the client's
+// request against both the address and the client's IP, unless the client
+// has to wait first.
+func mailAttempt(email, ip string) (time.Duration, error) {
+	wait, err := throttle.Mail.Attempt(email)
+	if err != nil || wait > 0 {
+		return wait, err
+	}
+	wait, err = throttle.MailIP.Attempt(ip)
+	if err != nil || wait > 0 {
+		if err := throttle.Mail.Succeeded(email); err != nil {
+			return 0, err
+		}
+	}
+	return wait, err
+}
+
+// loginSucceeded starts the session once every factor has been checked.
+// Only then are the account's failures forgotten, so knowing the password
+// doesn't reset the count against the second factor. method says how the
+// user signed in, for the audit log.
+func loginSucceeded(w http.ResponseWriter, r *http.Request, dbUser *types.DBUser, method string) error {
+	if !dbUser.Active() {
+		recordEvent(r, audit.Event{
+			Target:  dbUser.ID,
+			Action:  "login",
+			Outcome: audit.Failure,
+			Detail:  "account disabled",
+		})
+		return AccountDisabledError{}
+	}
+	if err := throttle.Account.Reset(dbUser.Email); err != nil {
+		return err
+	}
+	if err := session.SetSession(w, r, dbUser); err != nil {
+		return err
+	}
+	recordEvent(r, audit.Event{
+		Actor:  dbUser.ID,
+		Target: dbUser.ID,
+		Action: "login",
+		Detail: method,
+	})
+	return nil
+}
+
+// checkNewUserDetails validates the name and address of a new account,
+// returning a message for the user if they aren't acceptable.
+func checkNewUserDetails(name, email string) (string, error) {
+	if name == "" {
+		return "Please provide a name", nil
+	}
+	if email == "" {
+		return "Please enter an email address", nil
+	}
+	return checkEmailUnique(nil, email, "")
+}
+
+// checkNewUser validates a new account along with the password it will
+// sign in with.
+func checkNewUser(name, email, password, passwordAgain string) (string, error) {
+	if message, err := checkNewUserDetails(name, email); message != "" || err != nil {
+		return message, err
+	}
+	if err := pwpolicy.Check(password, types.DBUser{Name: name, Email: email}); err != nil {
+		if _, ok := err.(pwpolicy.PolicyError); ok {
+			return err.Error(), nil
+		}
+		return "", err
+	}
+	if password != passwordAgain {
+		return "Passwords do not match", nil
+	}
+	return "", nil
+}
+
+func newDBUser(name, email, password string) (types.DBUser, error) {
+	pw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return types.DBUser{}, err
+	}
+	return types.DBUser{
+		Email:    email,
+		Password: pw,
+		Name:     name,
+		Created:  time.Now(),
+	}, nil
 }
 
 func HandleRegister(w http.ResponseWriter, r *http.Request) {
@@ -87,81 +294,52 @@ func HandleRegister(w http.ResponseWriter, r *http.Request) {
 			"Error": errorMessage,
 		})
 	}
-	if name == "" {
-		sendError("Please provide a name")
-		return
-	}
-	if email == "" {
-		sendError("Please enter an email address")
-		return
-	}
-	if password == "" {
-		sendError("Please enter a password")
-		return
-	}
-	if password != passwordAgain {
-		sendError("Passwords do not match")
-		return
-	}
-
-	unique, err := checkEmailUnique(w, email, "")
+	message, err := checkNewUser(name, email, password, passwordAgain)
 	if err != nil {
 		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if !unique {
-		sendError("Email address already taken")
+	if message != "" {
+		sendError(message)
 		return
 	}
 
-	pw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	dbUser, err := newDBUser(name, email, password)
 	if err != nil {
 		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	_, _, err = firestore.Users.Add(context.Background(), struct {
-		Email    string
-		Password []byte
-		Name     string
-		Created  time.Time
-	}{email, pw, name, time.Now()})
+	dbUser.ID, err = store.Users.Create(dbUser)
 	if err != nil {
 		HTMLError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-	http.Redirect(w, r, "/register-success", http.StatusFound)
-}
-
-func HandleAuthn(w http.ResponseWriter, r *http.Request) {
-	// OLD, NEEDS FIXING
-	var rBody map[string]string
-	if err := json.NewDecoder(r.Body).Decode(&rBody); err != nil {
-		JSONError(w, "Error reading from request body", http.StatusInternalServerError)
-		return
-	}
-	token := rBody["jwt"]
-
-	user, err := jwt.Authenticate(token)
-	if err != nil {
-		JSONError(w, err.Error(), http.StatusForbidden)
-		return
-	}
-
-	json, err := json.Marshal(user)
-	if err != nil {
-		JSONError(w, "Error marshalling JSON", http.StatusInternalServerError)
-		return
+	recordEvent(r, audit.Event{
+		Actor:  dbUser.ID,
+		Target: dbUser.ID,
+		Action: "user.register",
+	})
+	// the account exists now, so a failed send is left for the user to resend
+	if err := sendVerification(dbUser); err != nil {
+		log.Printf("error sending verification email: %v\n", err)
 	}
-	JSONResponse(w, json)
+	http.Redirect(w, r, "/register-success", http.StatusFound)
 }
 
 func HandleLogout(w http.ResponseWriter, r *http.Request) {
+	sessionUser, sessionErr := session.GetSession(w, r)
 	err := session.EndSession(w, r)
 	if err != nil {
 		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if sessionErr == nil {
+		recordEvent(r, audit.Event{
+			Actor:  sessionUser.ID,
+			Target: sessionUser.ID,
+			Action: "logout",
+		})
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
@@ -173,8 +351,8 @@ func HandleEdit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	editUserID := mux.Vars(r)["id"]
-	if editUserID != sessionUser.ID && !sessionUser.Admin {
-		HTMLError(w, r, "Not an Admin User", http.StatusForbidden)
+	if editUserID != sessionUser.ID && !sessionUser.Can(roles.UsersWrite) {
+		HTMLError(w, r, PermissionError{Permission: roles.UsersWrite}.Error(), http.StatusForbidden)
 		return
 	}
 
@@ -186,9 +364,6 @@ func HandleEdit(w http.ResponseWriter, r *http.Request) {
 	email := r.PostFormValue("email")
 	name := r.PostFormValue("name")
 
-	// FIXME: Admins editing their own information end up removing their own admin priveleges
-	admin := r.PostFormValue("admin") != ""
-
 	var sendError = func(errorMessage string) {
 		ServeStaticPage(w, r, filepath.Clean(r.URL.Path), map[string]string{
 			"Email": email,
@@ -205,36 +380,97 @@ func HandleEdit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	unique, err := checkEmailUnique(w, email, editUserID)
+	message, err := checkEmailUnique(w, email, editUserID)
 	if err != nil {
-
-		fmt.Println("Error", err.Error())
 		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if !unique {
-		sendError("Email address already taken")
+	if message != "" {
+		sendError(message)
+		return
+	}
+
+	dbUser, err := store.Users.Get(editUserID)
+	if _, ok := err.(store.NotFoundError); ok {
+		HTMLError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	emailChanged := dbUser.Email != email
 
-	_, err = firestore.Users.Doc(editUserID).Update(context.Background(), []firestore.Update{
-		{
+	// only someone editing another user gets the role checkboxes, so anyone
+	// else keeps the roles they had
+	userRoles := dbUser.RoleNames()
+	if editUserID != sessionUser.ID {
+		if !CanManage(sessionUser, dbUser) {
+			HTMLError(w, r, ManageError{}.Error(), http.StatusForbidden)
+			return
+		}
+		userRoles = assignRoles(r.PostForm["role"], userRoles, sessionUser.Roles)
+	}
+	granted, revoked := roleChanges(dbUser.RoleNames(), userRoles)
+	var check store.Condition
+	if !contains(userRoles, roles.Admin) {
+		check = notLastAdmin
+	}
+
+	err = store.Users.UpdateIf(editUserID, check,
+		store.Update{
 			Path:  "Name",
 			Value: name,
 		},
-		{
+		store.Update{
 			Path:  "Email",
 			Value: email,
 		},
-		{
+		store.Update{
+			Path:  "Roles",
+			Value: userRoles,
+		},
+		store.Update{
 			Path:  "Admin",
-			Value: admin,
+			Value: false,
 		},
-	})
+		store.Update{
+			Path:  "EmailVerified",
+			Value: dbUser.EmailVerified && !emailChanged,
+		},
+	)
+	if _, ok := err.(LastAdminError); ok {
+		sendError(err.Error())
+		return
+	}
 	if err != nil {
 		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	var changed []string
+	if dbUser.Name != name {
+		changed = append(changed, "name")
+	}
+	if emailChanged {
+		changed = append(changed, "email")
+	}
+	if len(changed) > 0 {
+		recordEvent(r, audit.Event{
+			Actor:  sessionUser.ID,
+			Target: editUserID,
+			Action: "user.update",
+			Detail: strings.Join(changed, ", "),
+		})
+	}
+	recordRoleChanges(r, sessionUser.ID, editUserID, granted, revoked)
+
+	if emailChanged {
+		dbUser.Name = name
+		dbUser.Email = email
+		if err := sendVerification(dbUser); err != nil {
+			log.Printf("error sending verification email: %v\n", err)
+		}
+	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
@@ -255,10 +491,13 @@ func HandleChpwd(w http.ResponseWriter, r *http.Request) {
 	password := r.PostFormValue("password")
 	passwordAgain := r.PostFormValue("passwordAgain")
 
-	var sendError = func(errorMessage string) {
-		ServeStaticPage(w, r, filepath.Clean(r.URL.Path), map[string]string{
+	var sendErrorCode = func(errorMessage string, code int) {
+		servePage(w, r, filepath.Clean(r.URL.Path), map[string]string{
 			"Error": errorMessage,
-		})
+		}, code)
+	}
+	var sendError = func(errorMessage string) {
+		sendErrorCode(errorMessage, http.StatusOK)
 	}
 	if currentPassword == "" {
 		sendError("Please enter your current password")
@@ -273,24 +512,21 @@ func HandleChpwd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ref := firestore.Users.Doc(sessionUser.ID)
-	dsnap, err := ref.Get(context.Background())
+	dbUser, err := store.Users.Get(sessionUser.ID)
 	if err != nil {
 		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	dbUser := struct {
-		Password []byte
-	}{}
-	err = dsnap.DataTo(&dbUser)
-	if err != nil {
-		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+	if !checkPassword(w, r, dbUser, currentPassword, "password.change", sendErrorCode) {
 		return
 	}
-
-	if err := bcrypt.CompareHashAndPassword(dbUser.Password, []byte(currentPassword)); err != nil {
-		sendError("Incorrect password")
+	if err := pwpolicy.Check(password, dbUser); err != nil {
+		if _, ok := err.(pwpolicy.PolicyError); ok {
+			sendError(err.Error())
+			return
+		}
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -299,16 +535,60 @@ func HandleChpwd(w http.ResponseWriter, r *http.Request) {
 		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = ref.Update(context.Background(), []firestore.Update{
-		{
+	err = store.Users.Update(sessionUser.ID,
+		store.Update{
 			Path:  "Password",
 			Value: newPassword,
 		},
-	})
+		store.Update{
+			Path:  "PasswordHistory",
+			Value: pwpolicy.NewHistory(dbUser),
+		},
+	)
 	if err != nil {
 		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// whoever else knew the old password shouldn't stay signed in with it
+	if err := session.RevokeSessions(sessionUser.ID, sessionUser.SessionKey); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: sessionUser.ID,
+		Action: "password.change",
+	})
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
+
+// HandleUnlock lets an admin clear a lockout before it expires.
+func HandleUnlock(w http.ResponseWriter, r *http.Request) {
+	sessionUser, ok := getPermittedUser(w, r, roles.UsersWrite)
+	if !ok {
+		return
+	}
+
+	userID := mux.Vars(r)["id"]
+	dbUser, err := store.Users.Get(userID)
+	if _, ok := err.(store.NotFoundError); ok {
+		HTMLError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := throttle.Account.Reset(dbUser.Email); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: userID,
+		Action: "user.unlock",
+	})
+	http.Redirect(w, r, "/edit/"+userID, http.StatusFound)
+}
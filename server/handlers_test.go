@@ -0,0 +1,100 @@
+package server
+
+import (
+	"github.com/mthorning/go-sso/throttle"
+	"github.com/mthorning/go-sso/types"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPasswordChecksThrottled(t *testing.T) {
+	inRepoRoot(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("right password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		handler http.HandlerFunc
+		form    url.Values
+	}{
+		{"change password", "/chpwd", HandleChpwd, url.Values{
+			"currentPassword": {"wrong"},
+			"password":        {"a new password"},
+			"passwordAgain":   {"a new password"},
+		}},
+		{"delete passkey", "/passkeys/x/delete", HandlePasskeyDelete, url.Values{"password": {"wrong"}}},
+		{"disable 2fa", "/2fa/disable", HandleTOTPDisable, url.Values{"password": {"wrong"}}},
+		{"recovery codes", "/2fa/recovery", HandleRecoveryCodes, url.Values{"password": {"wrong"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, cookies := signInUser(t, types.DBUser{
+				Email:    strings.Replace(tt.name, " ", "-", -1) + "@handlers.test",
+				Password: hash,
+			})
+			ip := "192.0.2.1"
+			t.Cleanup(func() {
+				throttle.Account.Reset(user.Email)
+				throttle.IP.Reset(ip)
+			})
+
+			for i := 0; ; i++ {
+				req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				req.RemoteAddr = ip + ":1234"
+				for _, c := range cookies {
+					req.AddCookie(c)
+				}
+				res := httptest.NewRecorder()
+				tt.handler(res, req)
+
+				if res.Code == http.StatusTooManyRequests {
+					return
+				}
+				if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "Incorrect password") {
+					t.Fatalf("got %d %s", res.Code, res.Body)
+				}
+				if i > 20 {
+					t.Fatal("wrong passwords were never throttled")
+				}
+			}
+		})
+	}
+}
+
+func TestComparePassword(t *testing.T) {
+	// refusing an unknown account should cost as much as a real hash
+	if cost, err := bcrypt.Cost(dummyHash); err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("dummy hash cost %d, %v", cost, err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("right password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		hash     []byte
+		password string
+		want     bool
+	}{
+		{"right password", hash, "right password", true},
+		{"wrong password", hash, "wrong password", false},
+		{"no password set", nil, "", false},
+		{"no password set, any given", nil, "right password", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := comparePassword(tt.hash, tt.password) == nil; got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
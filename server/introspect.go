@@ -0,0 +1,112 @@
+package server
+
+import (
+	"github.com/mthorning/go-sso/jwt"
+	"github.com/mthorning/go-sso/oauth"
+	"github.com/mthorning/go-sso/roles"
+	"github.com/mthorning/go-sso/store"
+	"net/http"
+	"time"
+)
+
+type introspection struct {
+	Active    bool         `json:"active"`
+	Scope     string       `json:"scope,omitempty"`
+	ClientID  string       `json:"client_id,omitempty"`
+	Username  string       `json:"username,omitempty"`
+	TokenType string       `json:"token_type,omitempty"`
+	Exp       int64        `json:"exp,omitempty"`
+	Iat       int64        `json:"iat,omitempty"`
+	Nbf       int64        `json:"nbf,omitempty"`
+	Sub       string       `json:"sub,omitempty"`
+	Aud       jwt.Audience `json:"aud,omitempty"`
+	Iss       string       `json:"iss,omitempty"`
+	Jti       string       `json:"jti,omitempty"`
+	Name      string       `json:"name,omitempty"`
+	Email     string       `json:"email,omitempty"`
+	Roles     []string     `json:"roles,omitempty"`
+	Admin     bool         `json:"admin,omitempty"`
+}
+
+// HandleIntrospect implements RFC 7662. The user is looked up on every call
+// so that a token for a deleted or changed user isn't reported with the
+// claims it was minted with.
+func HandleIntrospect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if err := r.ParseForm(); err != nil {
+		OAuthError(w, oauth.NewError("invalid_request", "Error reading form"), http.StatusBadRequest)
+		return
+	}
+
+	client, err := oauth.AuthenticateClient(r)
+	if err == nil && client.Public {
+		err = oauth.NewError("invalid_client", "Public clients may not introspect tokens")
+	}
+	if err != nil {
+		if _, _, ok := r.BasicAuth(); ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+		}
+		OAuthError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		OAuthError(w, oauth.NewError("invalid_request", "Missing token"), http.StatusBadRequest)
+		return
+	}
+
+	// refresh tokens are only ever shown to the client they were issued to
+	if rt, err := oauth.LookupRefreshToken(token); err == nil {
+		if rt.ClientID != client.ID || rt.Used || time.Now().After(rt.Expires) {
+			writeJSON(w, introspection{})
+			return
+		}
+		writeJSON(w, liveUser(introspection{
+			Active:    true,
+			Scope:     rt.Scope,
+			ClientID:  rt.ClientID,
+			TokenType: "refresh_token",
+			Exp:       rt.Expires.Unix(),
+			Iat:       rt.Created.Unix(),
+			Sub:       rt.UserID,
+			Iss:       jwt.Conf.Issuer,
+		}))
+		return
+	}
+
+	claims, err := jwt.Authenticate(token, jwt.DefaultAudience(), client.ID)
+	if err != nil {
+		writeJSON(w, introspection{})
+		return
+	}
+	writeJSON(w, liveUser(introspection{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		TokenType: "Bearer",
+		Exp:       int64(claims.ExpiresAt),
+		Iat:       int64(claims.IssuedAt),
+		Nbf:       int64(claims.NotBefore),
+		Sub:       claims.Subject,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+		Jti:       claims.ID,
+	}))
+}
+
+// liveUser fills in the user's current details, or marks the token
+// inactive if they no longer exist or have been disabled.
+func liveUser(res introspection) introspection {
+	user, err := store.Users.Get(res.Sub)
+	if err != nil || !user.Active() {
+		return introspection{}
+	}
+	res.Username = user.Email
+	res.Name = user.Name
+	res.Email = user.Email
+	res.Roles = user.RoleNames()
+	res.Admin = user.HasRole(roles.Admin)
+	return res
+}
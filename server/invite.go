@@ -0,0 +1,319 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/mthorning/go-sso/audit"
+	"github.com/mthorning/go-sso/invite"
+	"github.com/mthorning/go-sso/mail"
+	"github.com/mthorning/go-sso/roles"
+	"github.com/mthorning/go-sso/store"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type AddUserPage struct {
+	Name        string
+	Email       string
+	Roles       []RoleOption
+	Invite      bool
+	Invitations []invite.Invitation
+	Error       string
+}
+
+// NewAddUserPage is the empty form for someone with the editor roles.
+func NewAddUserPage(editor []string) (AddUserPage, error) {
+	invitations, err := invite.List()
+	if err != nil {
+		return AddUserPage{}, err
+	}
+	return AddUserPage{
+		Roles:       NewRoleOptions(nil, editor),
+		Invite:      true,
+		Invitations: invitations,
+	}, nil
+}
+
+func sendInvitation(inv invite.Invitation, token string) error {
+	greeting := "Hi,"
+	if inv.Name != "" {
+		greeting = fmt.Sprintf("Hi %s,", inv.Name)
+	}
+	return mail.Sender.Send(mail.Message{
+		To:      inv.Email,
+		Subject: "You've been invited to create an account",
+		Body: fmt.Sprintf("%s\n\n%s has invited you to create an account. Open the link below to choose your password. It expires in %s.\n\n%s\n\nIf you weren't expecting this you can ignore this email.\n",
+			greeting, inv.InvitedBy, invite.Conf.InvitationLifetime, mail.Link("/invite/"+token)),
+	})
+}
+
+// HandleAddUser lets an admin create an account, either with a password
+// they pass on themselves or by emailing an invitation.
+func HandleAddUser(w http.ResponseWriter, r *http.Request) {
+	sessionUser, ok := getPermittedUser(w, r, roles.UsersWrite)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	page, err := NewAddUserPage(sessionUser.Roles)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	userRoles := assignRoles(r.PostForm["role"], nil, sessionUser.Roles)
+	page.Name = strings.TrimSpace(r.PostFormValue("name"))
+	page.Email = strings.TrimSpace(r.PostFormValue("email"))
+	page.Roles = NewRoleOptions(userRoles, sessionUser.Roles)
+	page.Invite = r.PostFormValue("method") == "invite"
+
+	var sendError = func(errorMessage string) {
+		page.Error = errorMessage
+		ServeStaticPage(w, r, "/users/new", page)
+	}
+
+	if page.Invite {
+		message, err := checkNewUserDetails(page.Name, page.Email)
+		if err != nil {
+			HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if message != "" {
+			sendError(message)
+			return
+		}
+
+		inv, token, err := invite.New(invite.Invitation{
+			Email:     page.Email,
+			Name:      page.Name,
+			Roles:     userRoles,
+			InvitedBy: sessionUser.Name,
+		})
+		if err != nil {
+			HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recordEvent(r, audit.Event{
+			Actor:  sessionUser.ID,
+			Target: inv.Email,
+			Action: "user.invite",
+		})
+		if err := sendInvitation(inv, token); err != nil {
+			log.Printf("error sending invitation email: %v\n", err)
+			sendError("The invitation was saved but the email couldn't be sent. Please try resending it")
+			return
+		}
+		http.Redirect(w, r, "/users/new", http.StatusFound)
+		return
+	}
+
+	password := r.PostFormValue("password")
+	message, err := checkNewUser(page.Name, page.Email, password, r.PostFormValue("passwordAgain"))
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if message != "" {
+		sendError(message)
+		return
+	}
+
+	dbUser, err := newDBUser(page.Name, page.Email, password)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbUser.Roles = userRoles
+	dbUser.ID, err = store.Users.Create(dbUser)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: dbUser.ID,
+		Action: "user.create",
+	})
+	recordRoleChanges(r, sessionUser.ID, dbUser.ID, userRoles, nil)
+	if err := sendVerification(dbUser); err != nil {
+		log.Printf("error sending verification email: %v\n", err)
+	}
+	http.Redirect(w, r, "/edit/"+dbUser.ID, http.StatusFound)
+}
+
+// HandleInvitationResend emails the invitation again with a new expiry.
+// Links sent before stop working.
+func HandleInvitationResend(w http.ResponseWriter, r *http.Request) {
+	sessionUser, ok := getPermittedUser(w, r, roles.UsersWrite)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	inv, token, err := invite.Renew(id)
+	if _, ok := err.(store.NotFoundError); ok {
+		recordEvent(r, audit.Event{
+			Actor:   sessionUser.ID,
+			Target:  id,
+			Action:  "invitation.resend",
+			Outcome: audit.Failure,
+			Detail:  "invitation not found",
+		})
+		HTMLError(w, r, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := sendInvitation(inv, token); err != nil {
+		recordEvent(r, audit.Event{
+			Actor:   sessionUser.ID,
+			Target:  inv.Email,
+			Action:  "invitation.resend",
+			Outcome: audit.Failure,
+			Detail:  "email not sent",
+		})
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: inv.Email,
+		Action: "invitation.resend",
+	})
+	http.Redirect(w, r, "/users/new", http.StatusFound)
+}
+
+func HandleInvitationRevoke(w http.ResponseWriter, r *http.Request) {
+	sessionUser, ok := getPermittedUser(w, r, roles.UsersWrite)
+	if !ok {
+		return
+	}
+
+	// look the invitation up first so the event names who it was for
+	id := mux.Vars(r)["id"]
+	inv, err := invite.Get(id)
+	if err == nil {
+		err = invite.Revoke(id)
+	}
+	if _, ok := err.(store.NotFoundError); ok {
+		recordEvent(r, audit.Event{
+			Actor:   sessionUser.ID,
+			Target:  id,
+			Action:  "invitation.revoke",
+			Outcome: audit.Failure,
+			Detail:  "invitation not found",
+		})
+		HTMLError(w, r, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: inv.Email,
+		Action: "invitation.revoke",
+	})
+	http.Redirect(w, r, "/users/new", http.StatusFound)
+}
+
+func HandleInvitePage(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	inv, err := invite.Check(token)
+	if err != nil {
+		_, isInvalid := err.(invite.InvalidTokenError)
+		_, isExpired := err.(invite.ExpiredTokenError)
+		if isInvalid || isExpired {
+			ServeStaticPage(w, r, "/invite", map[string]string{"Invalid": err.Error()})
+			return
+		}
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ServeStaticPage(w, r, "/invite", map[string]string{
+		"Token": token,
+		"Name":  inv.Name,
+		"Email": inv.Email,
+	})
+}
+
+// HandleAcceptInvite creates the invitee's account. The address is the one
+// the invitation was sent to, so it counts as verified.
+func HandleAcceptInvite(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	token := mux.Vars(r)["token"]
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	password := r.PostFormValue("password")
+
+	var invalid = func(err error) {
+		ServeStaticPage(w, r, "/invite", map[string]string{"Invalid": err.Error()})
+	}
+	inv, err := invite.Check(token)
+	if err != nil {
+		_, isInvalid := err.(invite.InvalidTokenError)
+		_, isExpired := err.(invite.ExpiredTokenError)
+		if isInvalid || isExpired {
+			invalid(err)
+			return
+		}
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message, err := checkNewUser(name, inv.Email, password, r.PostFormValue("passwordAgain"))
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if message != "" {
+		ServeStaticPage(w, r, "/invite", map[string]string{
+			"Token": token,
+			"Name":  name,
+			"Email": inv.Email,
+			"Error": message,
+		})
+		return
+	}
+
+	// redeem before creating the account so the same link can't create two
+	if _, err := invite.Redeem(token); err != nil {
+		if _, ok := err.(invite.InvalidTokenError); ok {
+			invalid(err)
+			return
+		}
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dbUser, err := newDBUser(name, inv.Email, password)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dbUser.Roles = inv.Roles
+	dbUser.EmailVerified = true
+	dbUser.ID, err = store.Users.Create(dbUser)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  dbUser.ID,
+		Target: dbUser.ID,
+		Action: "user.register",
+		Detail: "invited by " + inv.InvitedBy,
+	})
+	ServeStaticPage(w, r, "/invite", map[string]string{"Done": "true"})
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/mthorning/go-sso/mail"
+	"github.com/mthorning/go-sso/store"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// outbox keeps the messages sent during a test instead of sending them.
+type outbox struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+func (o *outbox) Send(m mail.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, m)
+	return nil
+}
+
+// link returns the path of the last link sent to address under prefix.
+func (o *outbox) link(t *testing.T, to, prefix string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	re := regexp.MustCompile(regexp.QuoteMeta(prefix) + `[^\s]+`)
+	for i := len(o.messages) - 1; i >= 0; i-- {
+		if o.messages[i].To != to {
+			continue
+		}
+		if path := re.FindString(o.messages[i].Body); path != "" {
+			return path
+		}
+	}
+	t.Fatalf("no %s link sent to %s", prefix, to)
+	return ""
+}
+
+func useOutbox(t *testing.T) *outbox {
+	old := mail.Sender
+	t.Cleanup(func() { mail.Sender = old })
+	o := &outbox{}
+	mail.Sender = o
+	return o
+}
+
+func postForm(h http.HandlerFunc, path string, vars map[string]string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = mux.SetURLVars(req, vars)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	res := httptest.NewRecorder()
+	h(res, req)
+	return res
+}
+
+func TestInvitation(t *testing.T) {
+	inRepoRoot(t)
+	sent := useOutbox(t)
+	admin := signIn(t, "admin@invite.test", "admin")
+	const email = "invitee@invite.test"
+
+	res := postForm(HandleAddUser, "/users/new", nil, url.Values{
+		"method": {"invite"},
+		"name":   {"Invitee"},
+		"email":  {email},
+		"role":   {"helpdesk"},
+	}, admin)
+	if res.Code != http.StatusFound {
+		t.Fatalf("inviting: got %d %s", res.Code, res.Body)
+	}
+	first := sent.link(t, email, "/invite/")
+	invitations, err := NewAddUserPage([]string{"admin"})
+	if err != nil || len(invitations.Invitations) != 1 {
+		t.Fatalf("got invitations %+v, %v; want the one sent", invitations.Invitations, err)
+	}
+	id := invitations.Invitations[0].ID
+
+	// resending replaces the link
+	res = postForm(HandleInvitationResend, "/invitations/"+id+"/resend", map[string]string{"id": id}, nil, admin)
+	if res.Code != http.StatusFound {
+		t.Fatalf("resending: got %d %s", res.Code, res.Body)
+	}
+	link := sent.link(t, email, "/invite/")
+	if link == first {
+		t.Fatal("resent the same link")
+	}
+
+	accept := func(path string) *httptest.ResponseRecorder {
+		return postForm(HandleAcceptInvite, path, map[string]string{"token": strings.TrimPrefix(path, "/invite/")}, url.Values{
+			"name":          {"Invitee"},
+			"password":      {"Correct horse 1"},
+			"passwordAgain": {"Correct horse 1"},
+		}, nil)
+	}
+	tests := []struct {
+		name        string
+		path        string
+		wantCreated bool
+	}{
+		{"link sent before resending", first, false},
+		{"made up link", "/invite/nope", false},
+		{"link", link, true},
+		{"link again", link, false},
+	}
+	for _, tt := range tests {
+		res := accept(tt.path)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s", tt.name, res.Code, res.Body)
+		}
+		if invalid := strings.Contains(res.Body.String(), "not valid"); invalid == tt.wantCreated {
+			t.Fatalf("%s: invitation refused %v, want %v", tt.name, invalid, !tt.wantCreated)
+		}
+		if !tt.wantCreated {
+			continue
+		}
+		user, err := store.Users.FindByEmail(email)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		t.Cleanup(func() { store.Users.Delete(user.ID) })
+		if !user.EmailVerified || len(user.Roles) != 1 || user.Roles[0] != "helpdesk" {
+			t.Errorf("%s: created %+v", tt.name, user)
+		}
+	}
+}
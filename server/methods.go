@@ -1,23 +1,42 @@
 package server
 
 import (
-	"context"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/mthorning/go-sso/firestore"
-	"github.com/mthorning/go-sso/jwt"
+	"github.com/mthorning/go-sso/config"
+	"github.com/mthorning/go-sso/oauth"
 	"github.com/mthorning/go-sso/session"
+	"github.com/mthorning/go-sso/store"
 	"github.com/mthorning/go-sso/types"
-	"google.golang.org/api/iterator"
 	"html/template"
+	"math"
+	"net"
 	"net/http"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 )
 
+type Config struct {
+	// TrustProxy takes the client address from X-Forwarded-For. Only set it
+	// when the server can't be reached except through a reverse proxy.
+	TrustProxy bool `split_words:"true"`
+	// DeletedUserRetention is how long a deleted user can be restored
+	// before they are purged.
+	DeletedUserRetention time.Duration `default:"720h" split_words:"true"`
+}
+
+var conf Config
+
+func init() {
+	config.SetConfig(&conf)
+	session.ClientIP = clientIP
+}
+
 func trace() string {
 	pc := make([]uintptr, 15)
 	n := runtime.Callers(2, pc)
@@ -42,6 +61,16 @@ func JSONError(w http.ResponseWriter, err string, code int) {
 	json.NewEncoder(w).Encode(map[string]string{"message": err})
 }
 
+func OAuthError(w http.ResponseWriter, err error, code int) {
+	e, ok := err.(oauth.Error)
+	if !ok {
+		e = oauth.NewError("server_error", err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(e)
+}
+
 func HTMLError(w http.ResponseWriter, r *http.Request, errStr string, code int) {
 	lp := filepath.Join("templates", "layout.html")
 	ep := filepath.Join("templates", "error.html")
@@ -54,7 +83,8 @@ func HTMLError(w http.ResponseWriter, r *http.Request, errStr string, code int)
 
 	origin := trace()
 
-	if err := tmpl.ExecuteTemplate(w, "layout",
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "layout",
 		map[string]string{
 			"Code":   strconv.Itoa(code),
 			"Error":  errStr,
@@ -63,6 +93,9 @@ func HTMLError(w http.ResponseWriter, r *http.Request, errStr string, code int)
 		http.Error(w, fmt.Sprintf("Error in HTMLError ExecuteTemplate: %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	buf.WriteTo(w)
 }
 
 func JSONResponse(w http.ResponseWriter, response []byte) {
@@ -71,20 +104,12 @@ func JSONResponse(w http.ResponseWriter, response []byte) {
 	w.Write(response)
 }
 
-// Not sure about this yet
-func getJWT(w http.ResponseWriter, user types.User) {
-	token, err := jwt.New(user)
-	if err != nil {
-		JSONError(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	json, err := json.Marshal(map[string]string{"jwt": token})
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	json, err := json.Marshal(v)
 	if err != nil {
 		JSONError(w, "Error marshalling JSON", http.StatusInternalServerError)
 		return
 	}
-
 	JSONResponse(w, json)
 }
 
@@ -100,24 +125,97 @@ func getSessionUser(w http.ResponseWriter, r *http.Request) (types.SessionUser,
 
 }
 
-func checkEmailUnique(w http.ResponseWriter, email, userID string) (bool, error) {
-	query := firestore.Users.Where("Email", "==", email)
-	iter := query.Documents(context.Background())
-	defer iter.Stop()
-	for {
-		dsnap, err := iter.Next()
-		if err == iterator.Done {
-			return true, nil
-		}
-		if err != nil {
-			return false, err
+// getPermittedUser writes an error page and returns false unless the
+// session's roles grant permission.
+func getPermittedUser(w http.ResponseWriter, r *http.Request, permission string) (types.SessionUser, bool) {
+	sessionUser, err := getSessionUser(w, r)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return types.SessionUser{}, false
+	}
+	if !sessionUser.Can(permission) {
+		HTMLError(w, r, PermissionError{Permission: permission}.Error(), http.StatusForbidden)
+		return types.SessionUser{}, false
+	}
+	return sessionUser, true
+}
+
+// checkEmailUnique returns a message for the user if email belongs to an
+// account other than userID's. A deleted account keeps its address until it
+// is purged so that it can be restored.
+func checkEmailUnique(w http.ResponseWriter, email, userID string) (string, error) {
+	user, err := store.Users.FindByEmail(email)
+	if _, ok := err.(store.NotFoundError); ok {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if user.ID == userID {
+		return "", nil
+	}
+	if user.Deleted() {
+		return fmt.Sprintf("Email address belongs to a deleted account. An admin can restore it, or it can be used again after %s",
+			PurgeAt(user).Format("2006-01-02")), nil
+	}
+	return "Email address already taken", nil
+}
+
+func clientIP(r *http.Request) string {
+	if conf.TrustProxy {
+		// the last entry is the one added by our proxy; anything before it
+		// came from the client
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
 		}
-		return dsnap.Ref.ID == userID, nil
 	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tooManyRequests sets Retry-After for a throttled request and returns the
+// message to show; the caller sends it with http.StatusTooManyRequests.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) string {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	n, unit := seconds, "second"
+	if seconds > 60 {
+		n, unit = (seconds+59)/60, "minute"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("Too many failed attempts, please try again in %d %s", n, unit)
+}
+
+// safeRedirect only allows redirects back into this site, so a crafted
+// ?next= can't bounce a freshly logged in user somewhere else.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
 }
 
 func makeTemplate(w http.ResponseWriter, r *http.Request, files ...string) (*template.Template, error) {
+	// the token has to be in the session before the page starts being
+	// written, as creating it sets the cookie
+	csrfToken, err := session.CSRFToken(w, r)
+	if err != nil {
+		return nil, err
+	}
+
 	funcMap := template.FuncMap{
+		"csrfToken": func() string {
+			return csrfToken
+		},
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="csrf_token" value="` + template.HTMLEscapeString(csrfToken) + `">`)
+		},
 		"many": func(s ...string) []string {
 			return s
 		},
@@ -125,6 +223,13 @@ func makeTemplate(w http.ResponseWriter, r *http.Request, files ...string) (*tem
 			_, err := session.GetSession(w, r)
 			return err == nil
 		},
+		"getSessionUser": func(_ ...string) string {
+			sessionUser, err := session.GetSession(w, r)
+			if err != nil {
+				return ""
+			}
+			return sessionUser.Name
+		},
 		"yesNo": func(x bool) string {
 			if x {
 				return "Yes"
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"github.com/mthorning/go-sso/jwt"
+	"github.com/mthorning/go-sso/oauth"
+	"github.com/mthorning/go-sso/session"
+	"github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/types"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func HandleDiscovery(w http.ResponseWriter, r *http.Request) {
+	iss := jwt.Conf.Issuer
+	writeJSON(w, map[string]interface{}{
+		"issuer":                                iss,
+		"authorization_endpoint":                iss + "/authorize",
+		"token_endpoint":                        iss + "/token",
+		"userinfo_endpoint":                     iss + "/userinfo",
+		"jwks_uri":                              iss + "/jwks",
+		"revocation_endpoint":                   iss + "/revoke",
+		"introspection_endpoint":                iss + "/introspect",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{jwt.Algorithm()},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      oauth.CodeChallengeMethods(),
+		"grant_types_supported":                 oauth.GrantTypes,
+		"claims_supported":                      []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "nonce", "name", "email"},
+	})
+}
+
+func HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, jwt.JWKS())
+}
+
+func redirectWithParams(w http.ResponseWriter, r *http.Request, redirectURI string, params map[string]string) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func HandleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading request", http.StatusBadRequest)
+		return
+	}
+
+	// until the client and redirect_uri are known good, errors must not be
+	// sent back to the redirect_uri
+	client, err := oauth.GetClient(r.Form.Get("client_id"))
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	redirectURI := r.Form.Get("redirect_uri")
+	redirectURISent := redirectURI != ""
+	if !redirectURISent && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !client.ValidRedirectURI(redirectURI) {
+		HTMLError(w, r, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	state := r.Form.Get("state")
+	var sendError = func(e oauth.Error) {
+		redirectWithParams(w, r, redirectURI, map[string]string{
+			"error":             e.Code,
+			"error_description": e.Description,
+			"state":             state,
+		})
+	}
+
+	if r.Form.Get("response_type") != "code" {
+		sendError(oauth.NewError("unsupported_response_type", "Only the code response type is supported"))
+		return
+	}
+	if !client.AllowsGrant("authorization_code") {
+		sendError(oauth.NewError("unauthorized_client", ""))
+		return
+	}
+	scope := r.Form.Get("scope")
+	if !oauth.HasScope(scope, "openid") {
+		sendError(oauth.NewError("invalid_scope", "The openid scope is required"))
+		return
+	}
+	if !client.AllowsScope(scope) {
+		sendError(oauth.NewError("invalid_scope", "Scope not registered for this client"))
+		return
+	}
+
+	challengeMethod, err := oauth.CheckChallenge(client, r.Form.Get("code_challenge"), r.Form.Get("code_challenge_method"))
+	if err != nil {
+		sendError(err.(oauth.Error))
+		return
+	}
+
+	sessionUser, err := session.GetSession(w, r)
+	if err != nil {
+		if _, ok := err.(session.NoSessionError); !ok {
+			HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.Form.Get("prompt") == "none" {
+			sendError(oauth.NewError("login_required", ""))
+			return
+		}
+		next := "/authorize?" + r.Form.Encode()
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusFound)
+		return
+	}
+
+	code, err := oauth.NewCode(oauth.AuthCode{
+		ClientID:    client.ID,
+		UserID:      sessionUser.ID,
+		RedirectURI: redirectURI,
+		Scope:       scope,
+		Nonce:       r.Form.Get("nonce"),
+
+		RedirectURISent: redirectURISent,
+
+		CodeChallenge:       r.Form.Get("code_challenge"),
+		CodeChallengeMethod: challengeMethod,
+	})
+	if err != nil {
+		sendError(oauth.NewError("server_error", ""))
+		return
+	}
+
+	redirectWithParams(w, r, redirectURI, map[string]string{
+		"code":  code,
+		"state": state,
+	})
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	IDToken      string `json:"id_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+func HandleToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	if err := r.ParseForm(); err != nil {
+		OAuthError(w, oauth.NewError("invalid_request", "Error reading form"), http.StatusBadRequest)
+		return
+	}
+
+	client, err := oauth.AuthenticateClient(r)
+	if err != nil {
+		if _, _, ok := r.BasicAuth(); ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		}
+		OAuthError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	grantType := r.PostFormValue("grant_type")
+	if !client.AllowsGrant(grantType) {
+		OAuthError(w, oauth.NewError("unauthorized_client", ""), http.StatusBadRequest)
+		return
+	}
+
+	switch grantType {
+	case "authorization_code":
+		handleAuthorizationCode(w, r, client)
+	case "refresh_token":
+		handleRefreshToken(w, r, client)
+	default:
+		OAuthError(w, oauth.NewError("unsupported_grant_type", ""), http.StatusBadRequest)
+	}
+}
+
+func handleAuthorizationCode(w http.ResponseWriter, r *http.Request, client oauth.Client) {
+	code, err := oauth.ExchangeCode(r.PostFormValue("code"))
+	if err != nil {
+		OAuthError(w, err, http.StatusBadRequest)
+		return
+	}
+	if code.ClientID != client.ID {
+		OAuthError(w, oauth.NewError("invalid_grant", "Code was not issued to this client"), http.StatusBadRequest)
+		return
+	}
+	// RFC 6749 4.1.3: only required when it was sent with the authorization
+	// request, but then it must match
+	if code.RedirectURISent && code.RedirectURI != r.PostFormValue("redirect_uri") {
+		OAuthError(w, oauth.NewError("invalid_grant", "redirect_uri does not match the authorization request"), http.StatusBadRequest)
+		return
+	}
+	if err := oauth.VerifyCodeVerifier(code, r.PostFormValue("code_verifier")); err != nil {
+		OAuthError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	dbUser, err := store.Users.Get(code.UserID)
+	if err != nil || !dbUser.Active() {
+		OAuthError(w, oauth.NewError("invalid_grant", "User no longer exists"), http.StatusBadRequest)
+		return
+	}
+
+	var refreshToken string
+	if client.AllowsGrant("refresh_token") {
+		refreshToken, err = oauth.NewRefreshToken(client.ID, dbUser.ID, code.Scope)
+		if err != nil {
+			OAuthError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	issueTokens(w, client, dbUser.User(), code.Scope, code.Nonce, refreshToken)
+}
+
+func handleRefreshToken(w http.ResponseWriter, r *http.Request, client oauth.Client) {
+	grant, refreshToken, err := oauth.RotateRefreshToken(r.PostFormValue("refresh_token"), client.ID)
+	if err != nil {
+		OAuthError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// a refresh may narrow the original grant but never widen it
+	scope := grant.Scope
+	if requested := r.PostFormValue("scope"); requested != "" {
+		for _, s := range strings.Fields(requested) {
+			if !oauth.HasScope(grant.Scope, s) {
+				OAuthError(w, oauth.NewError("invalid_scope", "Scope exceeds the original grant"), http.StatusBadRequest)
+				return
+			}
+		}
+		scope = requested
+	}
+
+	dbUser, err := store.Users.Get(grant.UserID)
+	if err != nil || !dbUser.Active() {
+		oauth.RevokeFamily(grant.FamilyID)
+		OAuthError(w, oauth.NewError("invalid_grant", "User no longer exists"), http.StatusBadRequest)
+		return
+	}
+
+	issueTokens(w, client, dbUser.User(), scope, "", refreshToken)
+}
+
+// issueTokens keeps the access token to what APIs need to authorize a
+// call. Name and email only go in the ID token, and only when the client
+// was granted the scope for them.
+func issueTokens(w http.ResponseWriter, client oauth.Client, user types.User, scope, nonce, refreshToken string) {
+	accessClaims := jwt.Claims{
+		ClientID: client.ID,
+		Scope:    scope,
+	}
+	accessClaims.SetRoles(user.Roles)
+	accessToken, err := jwt.New(user.ID, accessClaims)
+	if err != nil {
+		OAuthError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var idToken string
+	if oauth.HasScope(scope, "openid") {
+		// ID tokens are for the client itself, not for calling APIs
+		idClaims := jwt.Claims{
+			Audience: jwt.Audience{client.ID},
+			Nonce:    nonce,
+		}
+		idClaims.SetRoles(user.Roles)
+		if oauth.HasScope(scope, "profile") {
+			idClaims.Name = user.Name
+		}
+		if oauth.HasScope(scope, "email") {
+			idClaims.Email = user.Email
+		}
+		idToken, err = jwt.New(user.ID, idClaims)
+		if err != nil {
+			OAuthError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(jwt.Conf.TokenLifetime.Seconds()),
+		IDToken:      idToken,
+		RefreshToken: refreshToken,
+		Scope:        scope,
+	})
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return h[7:]
+	}
+	return r.FormValue("access_token")
+}
+
+func HandleUserinfo(w http.ResponseWriter, r *http.Request) {
+	var sendError = func(description string) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		OAuthError(w, oauth.NewError("invalid_token", description), http.StatusUnauthorized)
+	}
+
+	claims, err := jwt.Authenticate(bearerToken(r))
+	if err != nil {
+		sendError(err.Error())
+		return
+	}
+	if !oauth.HasScope(claims.Scope, "openid") {
+		sendError("Token was not granted the openid scope")
+		return
+	}
+
+	user, err := store.Users.Get(claims.Subject)
+	if err != nil || !user.Active() {
+		sendError("Unknown user")
+		return
+	}
+
+	info := map[string]interface{}{"sub": user.ID}
+	if oauth.HasScope(claims.Scope, "profile") {
+		info["name"] = user.Name
+	}
+	if oauth.HasScope(claims.Scope, "email") {
+		info["email"] = user.Email
+	}
+	writeJSON(w, info)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/mthorning/go-sso/jwt"
+	"github.com/mthorning/go-sso/oauth"
+	"github.com/mthorning/go-sso/types"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIssueTokensClaims(t *testing.T) {
+	client := oauth.Client{ID: "claims-client"}
+	user := types.User{ID: "claims-user", Name: "Claire", Email: "claire@oidc.test", Roles: []string{"admin"}}
+
+	tests := []struct {
+		scope     string
+		wantName  string
+		wantEmail string
+	}{
+		{"openid", "", ""},
+		{"openid profile", "Claire", ""},
+		{"openid email", "", "claire@oidc.test"},
+		{"openid profile email", "Claire", "claire@oidc.test"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			issueTokens(res, client, user, tt.scope, "nonce", "")
+			var tokens tokenResponse
+			if err := json.Unmarshal(res.Body.Bytes(), &tokens); err != nil {
+				t.Fatalf("%v: %s", err, res.Body)
+			}
+
+			access, err := jwt.Authenticate(tokens.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if access.Name != "" || access.Email != "" {
+				t.Errorf("access token has name %q and email %q", access.Name, access.Email)
+			}
+			if access.Subject != user.ID || access.Scope != tt.scope || !access.Admin {
+				t.Errorf("access token claims %+v", access)
+			}
+
+			id, err := jwt.Authenticate(tokens.IDToken, client.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.Name != tt.wantName || id.Email != tt.wantEmail {
+				t.Errorf("ID token has name %q and email %q, want %q and %q", id.Name, id.Email, tt.wantName, tt.wantEmail)
+			}
+			if id.Subject != user.ID || id.Nonce != "nonce" {
+				t.Errorf("ID token claims %+v", id)
+			}
+		})
+	}
+}
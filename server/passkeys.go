@@ -0,0 +1,348 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/mthorning/go-sso/audit"
+	"github.com/mthorning/go-sso/passkey"
+	"github.com/mthorning/go-sso/session"
+	"github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/types"
+	"net/http"
+	"strings"
+)
+
+func HandlePasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	sessionUser, err := session.GetSession(w, r)
+	if err != nil {
+		JSONError(w, "Please sign in", http.StatusUnauthorized)
+		return
+	}
+
+	dbUser, err := store.Users.Get(sessionUser.ID)
+	if err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	options, state, err := passkey.BeginRegistration(dbUser)
+	if err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := session.SetChallenge(w, r, "register", state); err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, options)
+}
+
+func HandlePasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	sessionUser, err := session.GetSession(w, r)
+	if err != nil {
+		JSONError(w, "Please sign in", http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Passkey"
+	}
+
+	state, err := session.TakeChallenge(w, r, "register")
+	if err != nil {
+		JSONError(w, "Please start adding the passkey again", http.StatusBadRequest)
+		return
+	}
+
+	dbUser, err := store.Users.Get(sessionUser.ID)
+	if err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	key, err := passkey.FinishRegistration(dbUser, state, name, r)
+	if err != nil {
+		JSONError(w, "The passkey could not be verified", http.StatusBadRequest)
+		return
+	}
+
+	err = store.Users.Update(dbUser.ID, store.Update{
+		Path:  "Passkeys",
+		Value: append(dbUser.Passkeys, key),
+	})
+	if err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  dbUser.ID,
+		Target: dbUser.ID,
+		Action: "passkey.add",
+		Detail: name,
+	})
+	writeJSON(w, map[string]string{"redirect": "/passkeys"})
+}
+
+func HandlePasskeyDelete(w http.ResponseWriter, r *http.Request) {
+	sessionUser, err := getSessionUser(w, r)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	dbUser, err := store.Users.Get(sessionUser.ID)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var sendError = func(errorMessage string, code int) {
+		servePage(w, r, "/passkeys", map[string]interface{}{
+			"Passkeys": dbUser.Passkeys,
+			"Error":    errorMessage,
+		}, code)
+	}
+	if !checkPassword(w, r, dbUser, r.PostFormValue("password"), "passkey.delete", sendError) {
+		return
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(mux.Vars(r)["id"])
+	if err != nil {
+		HTMLError(w, r, "Passkey not found", http.StatusNotFound)
+		return
+	}
+
+	var (
+		passkeys []types.Passkey
+		removed  string
+	)
+	for _, p := range dbUser.Passkeys {
+		if bytes.Equal(p.ID, id) {
+			removed = p.Name
+			continue
+		}
+		passkeys = append(passkeys, p)
+	}
+	if len(passkeys) == len(dbUser.Passkeys) {
+		HTMLError(w, r, "Passkey not found", http.StatusNotFound)
+		return
+	}
+
+	err = store.Users.Update(dbUser.ID, store.Update{
+		Path:  "Passkeys",
+		Value: passkeys,
+	})
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  dbUser.ID,
+		Target: dbUser.ID,
+		Action: "passkey.delete",
+		Detail: removed,
+	})
+	http.Redirect(w, r, "/passkeys", http.StatusFound)
+}
+
+// passkeyLogin is kept in the session between the two halves of a passkey
+// sign in.
+type passkeyLogin struct {
+	Email string
+	State string
+}
+
+// HandlePasskeyLoginBegin starts a passkey sign in. With an email address
+// the passkey replaces the password; without one it is the second factor
+// for a login whose password has already been checked.
+func HandlePasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		JSONError(w, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	email := r.PostFormValue("email")
+	passwordless := email != ""
+
+	var (
+		dbUser types.DBUser
+		err    error
+	)
+	if passwordless {
+		dbUser, err = store.Users.FindByEmail(email)
+		if _, ok := err.(store.NotFoundError); ok {
+			err = nil
+		}
+	} else {
+		var pending session.PendingUser
+		pending, err = session.GetPendingSession(w, r)
+		if _, ok := err.(session.NoSessionError); ok {
+			JSONError(w, "Your sign in has expired, please sign in again", http.StatusUnauthorized)
+			return
+		}
+		if err == nil && pending.Attempts >= maxSecondFactorAttempts {
+			JSONError(w, "Too many attempts, please sign in again", http.StatusUnauthorized)
+			return
+		}
+		if err == nil {
+			dbUser, err = store.Users.Get(pending.ID)
+			email = dbUser.Email
+		}
+		if _, ok := err.(store.NotFoundError); ok {
+			JSONError(w, "Passkey sign in isn't available for this account", http.StatusBadRequest)
+			return
+		}
+	}
+	if err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	wait, err := loginWait(email, clientIP(r))
+	if err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		JSONError(w, tooManyRequests(w, wait), http.StatusTooManyRequests)
+		return
+	}
+
+	options, state, err := passkey.BeginLogin(dbUser, passwordless)
+	if passwordless && (err != nil || !dbUser.Active()) {
+		// an unknown address looks the same as an account without passkeys
+		options, state, err = passkey.BeginDecoyLogin(email)
+	}
+	if err != nil {
+		JSONError(w, "Passkey sign in isn't available for this account", http.StatusBadRequest)
+		return
+	}
+	login, err := json.Marshal(passkeyLogin{Email: email, State: state})
+	if err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := session.SetChallenge(w, r, "login", string(login)); err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, options)
+}
+
+func HandlePasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	var login passkeyLogin
+	state, err := session.TakeChallenge(w, r, "login")
+	if err == nil {
+		err = json.Unmarshal([]byte(state), &login)
+	}
+	if err != nil {
+		JSONError(w, "Please start signing in again", http.StatusBadRequest)
+		return
+	}
+	userID, err := passkey.UserID(login.State)
+	if err != nil {
+		JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	wait, err := loginAttempt(login.Email, ip)
+	if err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		JSONError(w, tooManyRequests(w, wait), http.StatusTooManyRequests)
+		return
+	}
+
+	// a decoy ceremony has no user, and ends the same way as a passkey that
+	// doesn't verify
+	var dbUser types.DBUser
+	err = store.NotFoundError{}
+	if userID != "" {
+		dbUser, err = store.Users.Get(userID)
+	}
+	if _, ok := err.(store.NotFoundError); ok {
+		recordEvent(r, audit.Event{
+			Target:  login.Email,
+			Action:  "login",
+			Outcome: audit.Failure,
+			Detail:  "passkey not verified",
+		})
+		JSONError(w, "The passkey could not be verified", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	passkeys, err := passkey.FinishLogin(dbUser, login.State, r)
+	if _, ok := err.(passkey.ClonedError); ok {
+		store.Users.Update(dbUser.ID, store.Update{
+			Path:  "Passkeys",
+			Value: passkeys,
+		})
+		JSONError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	// only a pending login has a password already checked
+	_, pendingErr := session.GetPendingSession(w, r)
+	if err != nil {
+		// only a pending login has attempts to count
+		if pendingErr == nil {
+			session.FailPendingSession(w, r)
+		}
+		recordEvent(r, audit.Event{
+			Target:  dbUser.ID,
+			Action:  "login",
+			Outcome: audit.Failure,
+			Detail:  "passkey not verified",
+		})
+		JSONError(w, "The passkey could not be verified", http.StatusUnauthorized)
+		return
+	}
+
+	if err := attemptPassed(login.Email, ip); err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = store.Users.Update(dbUser.ID, store.Update{
+		Path:  "Passkeys",
+		Value: passkeys,
+	})
+	if err != nil {
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if verificationRequired(dbUser) {
+		JSONError(w, "Please verify your email address before signing in", http.StatusForbidden)
+		return
+	}
+
+	method := "passkey"
+	if pendingErr == nil {
+		method = "password and passkey"
+	}
+	if err := loginSucceeded(w, r, &dbUser, method); err != nil {
+		if _, ok := err.(AccountDisabledError); ok {
+			JSONError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		JSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]string{
+		"redirect": safeRedirect(r.URL.Query().Get("next")),
+	})
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/mthorning/go-sso/passkey"
+	"github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/throttle"
+	"github.com/mthorning/go-sso/types"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	store.UseMemory()
+}
+
+// authenticator is a software passkey that signs whatever it is asked to.
+type authenticator struct {
+	id      []byte
+	key     *ecdsa.PrivateKey
+	counter uint32
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &authenticator{id: id, key: key}
+}
+
+// passkey is what registering the authenticator would have stored, with
+// the public key as a COSE EC2 key.
+func (a *authenticator) passkey() types.Passkey {
+	cose := []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20}
+	cose = append(cose, pad32(a.key.X.Bytes())...)
+	cose = append(cose, 0x22, 0x58, 0x20)
+	cose = append(cose, pad32(a.key.Y.Bytes())...)
+	return types.Passkey{ID: a.id, Name: "test", PublicKey: cose, Created: time.Now()}
+}
+
+func pad32(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// assert answers a challenge the way navigator.credentials.get would, with
+// the user present and verified. The options carry the challenge in
+// standard base64 while the client data carries it base64url encoded.
+func (a *authenticator) assert(t *testing.T, challenge string, userHandle string) []byte {
+	raw, err := base64.StdEncoding.DecodeString(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.counter++
+	rpID := sha256.Sum256([]byte(passkey.Conf.RPID))
+	authData := append(rpID[:], 0x05, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[33:], a.counter)
+
+	clientData, _ := json.Marshal(map[string]string{
+		"type":      "webauthn.get",
+		"challenge": base64.RawURLEncoding.EncodeToString(raw),
+		"origin":    passkey.Conf.RPOrigin,
+	})
+	clientHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    enc(a.id),
+		"rawId": enc(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"authenticatorData": enc(authData),
+			"clientDataJSON":    enc(clientData),
+			"signature":         enc(sig),
+			"userHandle":        enc([]byte(userHandle)),
+		},
+	})
+	return body
+}
+
+type assertionOptions struct {
+	PublicKey struct {
+		Challenge        string `json:"challenge"`
+		UserVerification string `json:"userVerification"`
+		AllowCredentials []struct {
+			Type string `json:"type"`
+			ID   string `json:"id"`
+		} `json:"allowCredentials"`
+	} `json:"publicKey"`
+}
+
+// passkeyClient keeps the session cookie between begin and finish.
+type passkeyClient struct {
+	ip      string
+	cookies []*http.Cookie
+}
+
+func newPasskeyClient(t *testing.T, ip string) *passkeyClient {
+	t.Cleanup(func() { throttle.IP.Reset(ip) })
+	return &passkeyClient{ip: ip}
+}
+
+func (c *passkeyClient) do(h http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	req.RemoteAddr = c.ip + ":1234"
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	res := httptest.NewRecorder()
+	h(res, req)
+	if cookies := res.Result().Cookies(); len(cookies) > 0 {
+		c.cookies = cookies
+	}
+	return res
+}
+
+func (c *passkeyClient) begin(t *testing.T, email string) (*httptest.ResponseRecorder, assertionOptions) {
+	t.Cleanup(func() { throttle.Account.Reset(email) })
+	form := url.Values{"email": {email}}
+	req := httptest.NewRequest("POST", "/login/passkey/begin", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := c.do(HandlePasskeyLoginBegin, req)
+
+	var options assertionOptions
+	if res.Code == http.StatusOK {
+		if err := json.Unmarshal(res.Body.Bytes(), &options); err != nil {
+			t.Fatalf("begin returned %s: %v", res.Body, err)
+		}
+	}
+	return res, options
+}
+
+func (c *passkeyClient) finish(body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/login/passkey/finish?next=/", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(HandlePasskeyLoginFinish, req)
+}
+
+func createPasskeyUser(t *testing.T, email string, keys ...*authenticator) types.DBUser {
+	user := types.DBUser{Email: email, Name: email, Created: time.Now()}
+	for _, k := range keys {
+		user.Passkeys = append(user.Passkeys, k.passkey())
+	}
+	id, err := store.Users.Create(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.ID = id
+	t.Cleanup(func() { store.Users.Delete(id) })
+	return user
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	aliceKey, bobKey := newAuthenticator(t), newAuthenticator(t)
+	alice := createPasskeyUser(t, "alice@passkey.test", aliceKey)
+	bob := createPasskeyUser(t, "bob@passkey.test", bobKey)
+
+	tests := []struct {
+		name string
+		key  *authenticator
+		// userHandle is who the authenticator says the credential
+		// belongs to
+		userHandle string
+		want       int
+	}{
+		{"own passkey", aliceKey, alice.ID, http.StatusOK},
+		{"another user's passkey", bobKey, bob.ID, http.StatusUnauthorized},
+		{"another user's passkey claiming to be theirs", bobKey, alice.ID, http.StatusUnauthorized},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newPasskeyClient(t, "198.51.100."+string(rune('1'+i)))
+			res, options := c.begin(t, alice.Email)
+			if res.Code != http.StatusOK {
+				t.Fatalf("begin: %d %s", res.Code, res.Body)
+			}
+			allowed := options.PublicKey.AllowCredentials
+			if len(allowed) != 1 || allowed[0].ID != base64.StdEncoding.EncodeToString(aliceKey.id) {
+				t.Fatalf("begin allowed %+v, want only alice's passkey", allowed)
+			}
+			if options.PublicKey.UserVerification != "required" {
+				t.Errorf("userVerification = %q, want required", options.PublicKey.UserVerification)
+			}
+
+			res = c.finish(tt.key.assert(t, options.PublicKey.Challenge, tt.userHandle))
+			if res.Code != tt.want {
+				t.Errorf("finish: got %d %s, want %d", res.Code, res.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasskeyLoginUnknownAccount(t *testing.T) {
+	createPasskeyUser(t, "nopasskeys@passkey.test")
+	attacker := newAuthenticator(t)
+	c := newPasskeyClient(t, "198.51.100.20")
+
+	var first []string
+	for _, email := range []string{"nobody@passkey.test", "nobody@passkey.test", "nopasskeys@passkey.test"} {
+		res, options := c.begin(t, email)
+		if res.Code != http.StatusOK {
+			t.Fatalf("begin %s: %d %s, want the same response as for a real account", email, res.Code, res.Body)
+		}
+		var ids []string
+		for _, cred := range options.PublicKey.AllowCredentials {
+			ids = append(ids, cred.ID)
+		}
+		if len(ids) != 1 {
+			t.Fatalf("begin %s allowed %v, want one made up credential", email, ids)
+		}
+		if email == "nobody@passkey.test" {
+			if first != nil && first[0] != ids[0] {
+				t.Errorf("begin %s made up %v then %v", email, first, ids)
+			}
+			first = ids
+		}
+
+		res = c.finish(attacker.assert(t, options.PublicKey.Challenge, ""))
+		if res.Code != http.StatusUnauthorized {
+			t.Errorf("finish %s: got %d %s, want %d", email, res.Code, res.Body, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestPasskeyLoginThrottled(t *testing.T) {
+	key, wrongKey := newAuthenticator(t), newAuthenticator(t)
+	user := createPasskeyUser(t, "throttled@passkey.test", key)
+	c := newPasskeyClient(t, "198.51.100.30")
+
+	for i := 0; ; i++ {
+		res, options := c.begin(t, user.Email)
+		if res.Code == http.StatusTooManyRequests {
+			if res.Header().Get("Retry-After") == "" {
+				t.Error("throttled begin has no Retry-After")
+			}
+			break
+		}
+		if res.Code != http.StatusOK {
+			t.Fatalf("begin: %d %s", res.Code, res.Body)
+		}
+		if i > 10 {
+			t.Fatal("begin was never throttled")
+		}
+		res = c.finish(wrongKey.assert(t, options.PublicKey.Challenge, user.ID))
+		if res.Code != http.StatusUnauthorized {
+			t.Fatalf("finish with the wrong passkey: %d %s", res.Code, res.Body)
+		}
+	}
+}
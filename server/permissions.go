@@ -0,0 +1,51 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/mthorning/go-sso/session"
+	"net/http"
+	"path/filepath"
+	"regexp"
+)
+
+// PermissionRule requires Permission for every request whose path matches.
+type PermissionRule struct {
+	Path       *regexp.Regexp
+	Permission string
+}
+
+// RequirePermissions checks the rules before any handler runs, so a page
+// or action can't be reached by someone whose roles don't allow it. Rules
+// are tried in order and only the first match applies. Paths are cleaned
+// first, the same as AuthRoutes does to pick a page.
+func RequirePermissions(rules []PermissionRule) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := filepath.Clean(r.URL.Path)
+			for _, rule := range rules {
+				if !rule.Path.MatchString(path) {
+					continue
+				}
+				sessionUser, err := session.GetSession(w, r)
+				if _, ok := err.(session.NoSessionError); ok {
+					if r.Method == http.MethodGet {
+						http.Redirect(w, r, "/login", http.StatusFound)
+						return
+					}
+					HTMLError(w, r, err.Error(), http.StatusForbidden)
+					return
+				}
+				if err != nil {
+					HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if !sessionUser.Can(rule.Permission) {
+					HTMLError(w, r, PermissionError{Permission: rule.Permission}.Error(), http.StatusForbidden)
+					return
+				}
+				break
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"github.com/mthorning/go-sso/roles"
+	"github.com/mthorning/go-sso/session"
+	"github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/types"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// inRepoRoot moves to where the templates can be found for the rest of the
+// test.
+func inRepoRoot(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// signIn creates a user with roles and returns the cookies of a session
+// signed in as them.
+func signIn(t *testing.T, email string, userRoles ...string) []*http.Cookie {
+	_, cookies := signInUser(t, types.DBUser{Email: email, Name: email, Roles: userRoles})
+	return cookies
+}
+
+// signInUser creates user and returns them with the cookies of a session
+// signed in as them.
+func signInUser(t *testing.T, user types.DBUser) (types.DBUser, []*http.Cookie) {
+	user.Created = time.Now()
+	id, err := store.Users.Create(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.ID = id
+	t.Cleanup(func() { store.Users.Delete(id) })
+
+	res := httptest.NewRecorder()
+	if err := session.SetSession(res, httptest.NewRequest("GET", "/", nil), &user); err != nil {
+		t.Fatal(err)
+	}
+	return user, res.Result().Cookies()
+}
+
+func TestRequirePermissions(t *testing.T) {
+	inRepoRoot(t)
+	handler := RequirePermissions([]PermissionRule{
+		{Path: regexp.MustCompile(`^/manage$`), Permission: roles.UsersRead},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	helpdesk := signIn(t, "helpdesk@permissions.test", "helpdesk")
+	noRoles := signIn(t, "nobody@permissions.test")
+
+	tests := []struct {
+		path    string
+		cookies []*http.Cookie
+		want    int
+	}{
+		{"/manage", helpdesk, http.StatusOK},
+		{"/manage", noRoles, http.StatusForbidden},
+		{"/manage/", noRoles, http.StatusForbidden},
+		{"/manage/.", noRoles, http.StatusForbidden},
+		{"/other/../manage", noRoles, http.StatusForbidden},
+		{"/manage/x", noRoles, http.StatusOK},
+		{"/managed", noRoles, http.StatusOK},
+		// no session at all is sent to sign in
+		{"/manage/", nil, http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.URL.Path = tt.path
+			for _, c := range tt.cookies {
+				req.AddCookie(c)
+			}
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			if res.Code != tt.want {
+				t.Errorf("got %d, want %d", res.Code, tt.want)
+			}
+		})
+	}
+}
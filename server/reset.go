@@ -0,0 +1,195 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/mthorning/go-sso/audit"
+	"github.com/mthorning/go-sso/mail"
+	"github.com/mthorning/go-sso/pwpolicy"
+	"github.com/mthorning/go-sso/reset"
+	"github.com/mthorning/go-sso/session"
+	"github.com/mthorning/go-sso/store"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+)
+
+// HandleForgot emails a reset link. It gives the same answer whether or not
+// the address has an account, so it can't be used to find out who is
+// registered.
+func HandleForgot(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	email := r.PostFormValue("email")
+	if email == "" {
+		ServeStaticPage(w, r, "/forgot", map[string]string{
+			"Error": "Please enter an email address",
+		})
+		return
+	}
+
+	// counted whether or not there's an account, so being made to wait
+	// doesn't give one away either
+	wait, err := mailAttempt(email, clientIP(r))
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		servePage(w, r, "/forgot", map[string]string{
+			"Error": tooManyRequests(w, wait),
+		}, http.StatusTooManyRequests)
+		return
+	}
+
+	dbUser, err := store.Users.FindByEmail(email)
+	if err == nil && dbUser.Deleted() {
+		err = store.NotFoundError{}
+	}
+	if _, ok := err.(store.NotFoundError); ok {
+		ServeStaticPage(w, r, "/forgot", map[string]string{"Sent": "true"})
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := reset.New(dbUser.ID)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Target: dbUser.ID,
+		Action: "password.reset.request",
+	})
+	err = mail.Sender.Send(mail.Message{
+		To:      dbUser.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. If it was you, open the link below to choose a new one. It can only be used once and expires in %s.\n\n%s\n\nIf you didn't ask for this you can ignore this email; your password hasn't been changed.\n",
+			dbUser.Name, reset.Conf.ResetTokenLifetime, mail.Link("/reset/"+token)),
+	})
+	if err != nil {
+		log.Printf("error sending password reset email: %v\n", err)
+	}
+
+	ServeStaticPage(w, r, "/forgot", map[string]string{"Sent": "true"})
+}
+
+func HandleResetPage(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	if _, err := reset.Check(token); err != nil {
+		ServeStaticPage(w, r, "/reset", map[string]string{
+			"Invalid": err.Error(),
+		})
+		return
+	}
+	ServeStaticPage(w, r, "/reset", map[string]string{
+		"Token": token,
+	})
+}
+
+func HandleReset(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	token := mux.Vars(r)["token"]
+	password := r.PostFormValue("password")
+	passwordAgain := r.PostFormValue("passwordAgain")
+
+	var sendError = func(errorMessage string) {
+		ServeStaticPage(w, r, "/reset", map[string]string{
+			"Token": token,
+			"Error": errorMessage,
+		})
+	}
+	if password != passwordAgain {
+		sendError("Passwords do not match")
+		return
+	}
+
+	var invalid = func(err error) {
+		ServeStaticPage(w, r, "/reset", map[string]string{
+			"Invalid": err.Error(),
+		})
+	}
+
+	// check the password before redeeming so a rejected one doesn't use up
+	// the link
+	userID, err := reset.Check(token)
+	if _, ok := err.(reset.InvalidTokenError); ok {
+		invalid(err)
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dbUser, err := store.Users.Get(userID)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := pwpolicy.Check(password, dbUser); err != nil {
+		if _, ok := err.(pwpolicy.PolicyError); ok {
+			sendError(err.Error())
+			return
+		}
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := reset.Redeem(token); err != nil {
+		if _, ok := err.(reset.InvalidTokenError); ok {
+			invalid(err)
+			return
+		}
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	newPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// following the emailed link also proves the address
+	err = store.Users.Update(dbUser.ID,
+		store.Update{
+			Path:  "Password",
+			Value: newPassword,
+		},
+		store.Update{
+			Path:  "PasswordHistory",
+			Value: pwpolicy.NewHistory(dbUser),
+		},
+		store.Update{
+			Path:  "EmailVerified",
+			Value: true,
+		},
+	)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// sign out anyone who was using the old password
+	if err := endUserAccess(dbUser.ID, dbUser.ID); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Target: dbUser.ID,
+		Action: "password.reset",
+	})
+
+	session.EndSession(w, r)
+	ServeStaticPage(w, r, "/reset", map[string]string{"Done": "true"})
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"github.com/mthorning/go-sso/throttle"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestMailThrottled covers the handlers that send email to any address
+// they are given.
+func TestMailThrottled(t *testing.T) {
+	inRepoRoot(t)
+	handlers := []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/forgot", HandleForgot},
+		{"/verify/resend", HandleResendVerification},
+	}
+	tests := []struct {
+		name string
+		// each request comes from its own IP, or all from the same one
+		email func(i int) string
+		ip    func(i int) string
+	}{
+		{"per address",
+			func(i int) string { return "forgot@reset.test" },
+			func(i int) string { return "203.0.113." + strconv.Itoa(i+1) }},
+		{"per IP",
+			func(i int) string { return "forgot" + strconv.Itoa(i) + "@reset.test" },
+			func(i int) string { return "203.0.113.200" }},
+	}
+	for _, h := range handlers {
+		for _, tt := range tests {
+			t.Run(h.path+" "+tt.name, func(t *testing.T) {
+				for i := 0; ; i++ {
+					email, ip := tt.email(i), tt.ip(i)
+					t.Cleanup(func() {
+						throttle.Mail.Reset(email)
+						throttle.MailIP.Reset(ip)
+					})
+
+					form := url.Values{"email": {email}}
+					req := httptest.NewRequest("POST", h.path, strings.NewReader(form.Encode()))
+					req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+					req.RemoteAddr = ip + ":1234"
+					res := httptest.NewRecorder()
+					h.handler(res, req)
+
+					if res.Code == http.StatusTooManyRequests {
+						if res.Header().Get("Retry-After") == "" {
+							t.Error("throttled request has no Retry-After")
+						}
+						return
+					}
+					if res.Code != http.StatusOK {
+						t.Fatalf("got %d", res.Code)
+					}
+					if i > 20 {
+						t.Fatal("never throttled")
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"github.com/mthorning/go-sso/audit"
+	"github.com/mthorning/go-sso/jwt"
+	"github.com/mthorning/go-sso/oauth"
+	"github.com/mthorning/go-sso/roles"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// HandleRevoke implements RFC 7009. Unknown, invalid and already expired
+// tokens are not errors: the client wanted the token gone and it is.
+func HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		OAuthError(w, oauth.NewError("invalid_request", "Error reading form"), http.StatusBadRequest)
+		return
+	}
+
+	client, err := oauth.AuthenticateClient(r)
+	if err != nil {
+		if _, _, ok := r.BasicAuth(); ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="revoke"`)
+		}
+		OAuthError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		OAuthError(w, oauth.NewError("invalid_request", "Missing token"), http.StatusBadRequest)
+		return
+	}
+
+	if rt, err := oauth.LookupRefreshToken(token); err == nil {
+		if rt.ClientID == client.ID {
+			if err := oauth.RevokeFamily(rt.FamilyID); err != nil {
+				OAuthError(w, err, http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	claims, err := jwt.Authenticate(token, jwt.DefaultAudience(), client.ID)
+	if err == nil && (claims.ClientID == client.ID || claims.Audience.Contains(client.ID)) {
+		if err := jwt.Revoke(claims, client.ID); err != nil {
+			OAuthError(w, err, http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func HandleAdminRevoke(w http.ResponseWriter, r *http.Request) {
+	sessionUser, ok := getPermittedUser(w, r, roles.TokensRevoke)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	jti := strings.TrimSpace(r.PostFormValue("jti"))
+	if jti == "" {
+		revocations, err := jwt.Revocations.List()
+		if err != nil {
+			HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ServeStaticPage(w, r, filepath.Clean(r.URL.Path), map[string]interface{}{
+			"Revocations": revocations,
+			"Error":       "Please enter a token ID",
+		})
+		return
+	}
+
+	if err := jwt.RevokeID(jti, sessionUser.ID); err != nil {
+		recordEvent(r, audit.Event{
+			Actor:   sessionUser.ID,
+			Target:  jti,
+			Action:  "token.revoke",
+			Outcome: audit.Failure,
+			Detail:  err.Error(),
+		})
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: jti,
+		Action: "token.revoke",
+	})
+	http.Redirect(w, r, "/revocations", http.StatusFound)
+}
@@ -1,8 +1,10 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/mthorning/go-sso/session"
+	"github.com/mthorning/go-sso/store"
 	"github.com/mthorning/go-sso/types"
 	"net/http"
 	"os"
@@ -12,6 +14,14 @@ import (
 
 type RouteConfig = map[string]interface{}
 
+type PermissionError struct {
+	Permission string
+}
+
+func (e PermissionError) Error() string {
+	return fmt.Sprintf("You need the %s permission to do this", e.Permission)
+}
+
 type AuthRoutes struct {
 	SessionUser *types.SessionUser
 	Config      RouteConfig
@@ -55,6 +65,14 @@ func (a AuthRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		file = "/index"
 	}
 	templateData, err := a.getData(file)
+	if _, ok := err.(store.NotFoundError); ok {
+		HTMLError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	if _, ok := err.(PermissionError); ok {
+		HTMLError(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
@@ -65,7 +83,9 @@ func (a AuthRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func NoAuthRoutes(w http.ResponseWriter, r *http.Request) {
 	file := filepath.Clean(r.URL.Path)
-	ServeStaticPage(w, r, file, nil)
+	ServeStaticPage(w, r, file, map[string]string{
+		"Next": r.URL.Query().Get("next"),
+	})
 }
 
 func getFilePath(path string) (string, error) {
@@ -96,6 +116,12 @@ func getFilePath(path string) (string, error) {
 }
 
 func ServeStaticPage(w http.ResponseWriter, r *http.Request, file string, templateData interface{}) {
+	servePage(w, r, file, templateData, http.StatusOK)
+}
+
+// servePage renders the whole page before writing anything, so an error
+// while rendering can still be sent with its own status.
+func servePage(w http.ResponseWriter, r *http.Request, file string, templateData interface{}, code int) {
 	lp := filepath.Join("templates", "layout.html")
 	up := filepath.Join("templates", "components.html")
 
@@ -111,8 +137,12 @@ func ServeStaticPage(w http.ResponseWriter, r *http.Request, file string, templa
 		return
 	}
 
-	if err := tmpl.ExecuteTemplate(w, "layout", templateData); err != nil {
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "layout", templateData); err != nil {
 		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	buf.WriteTo(w)
 }
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/mthorning/go-sso/audit"
+	"github.com/mthorning/go-sso/session"
+	"net/http"
+)
+
+// HandleSessionRevoke signs out one of the user's own sessions.
+func HandleSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	sessionUser, err := getSessionUser(w, r)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	err = session.RevokeSession(sessionUser.ID, key)
+	if _, ok := err.(session.NoSessionError); ok {
+		HTMLError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: sessionUser.ID,
+		Action: "session.revoke",
+	})
+	if key == sessionUser.SessionKey {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/sessions", http.StatusFound)
+}
+
+// HandleSignOutEverywhere ends all of the user's sessions, including this one.
+func HandleSignOutEverywhere(w http.ResponseWriter, r *http.Request) {
+	sessionUser, err := getSessionUser(w, r)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := session.RevokeSessions(sessionUser.ID, ""); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: sessionUser.ID,
+		Action: "session.revoke",
+		Detail: "all sessions",
+	})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// HandleUserSessionsRevoke lets an admin sign out one of a user's sessions,
+// or all of them when no key is given.
+func HandleUserSessionsRevoke(w http.ResponseWriter, r *http.Request) {
+	sessionUser, dbUser, ok := getManagedUser(w, r)
+	if !ok {
+		return
+	}
+	userID := dbUser.ID
+
+	var err error
+	event := audit.Event{
+		Actor:  sessionUser.ID,
+		Target: userID,
+		Action: "session.revoke",
+	}
+	if key := mux.Vars(r)["key"]; key != "" {
+		err = session.RevokeSession(userID, key)
+	} else {
+		err = session.RevokeSessions(userID, "")
+		event.Detail = "all sessions"
+	}
+	if _, ok := err.(session.NoSessionError); ok {
+		HTMLError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, event)
+	http.Redirect(w, r, "/edit/"+userID, http.StatusFound)
+}
@@ -0,0 +1,511 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/mthorning/go-sso/audit"
+	"github.com/mthorning/go-sso/session"
+	"github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/totp"
+	"github.com/mthorning/go-sso/types"
+	"github.com/skip2/go-qrcode"
+	"html/template"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// maxSecondFactorAttempts is how many wrong codes a pending login may
+// submit before the password has to be entered again.
+const maxSecondFactorAttempts = 5
+
+type TwoFactorPage struct {
+	Enabled           bool
+	Secret            string
+	URI               string
+	QRCode            template.URL
+	RecoveryCodes     []string
+	RecoveryCodesLeft int
+	Error             string
+}
+
+func NewTwoFactorPage(user types.DBUser) TwoFactorPage {
+	return TwoFactorPage{
+		Enabled:           user.TOTPEnabled,
+		RecoveryCodesLeft: len(user.RecoveryCodes),
+	}
+}
+
+// withSecret adds what the user needs to add the pending secret to their
+// authenticator app.
+func (p TwoFactorPage) withSecret(user types.DBUser) (TwoFactorPage, error) {
+	p.Secret = user.TOTPPendingSecret
+	p.URI = totp.ProvisioningURI(user.Email, user.TOTPPendingSecret)
+	png, err := qrcode.Encode(p.URI, qrcode.Medium, 256)
+	if err != nil {
+		return p, err
+	}
+	p.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	return p, nil
+}
+
+// resetTOTP turns 2FA off for the user, applying any other updates in the
+// same write.
+func resetTOTP(userID string, updates ...store.Update) error {
+	return store.Users.Update(userID, append([]store.Update{
+		{Path: "TOTPEnabled", Value: false},
+		{Path: "TOTPSecret", Value: ""},
+		{Path: "TOTPPendingSecret", Value: ""},
+		{Path: "TOTPLastStep", Value: int64(0)},
+		{Path: "RecoveryCodes", Value: []string{}},
+	}, updates...)...)
+}
+
+// codeUsedError stops a second factor code being spent twice when two
+// requests race with it.
+type codeUsedError struct{}
+
+func (e codeUsedError) Error() string {
+	return "Code has already been used"
+}
+
+// checkSecondFactor accepts either a current TOTP code or one of the user's
+// recovery codes, which is used up.
+func checkSecondFactor(user types.DBUser, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" || !user.TOTPEnabled {
+		return false, nil
+	}
+
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		err := store.Users.UpdateIf(user.ID, func(stored types.DBUser, _ func() ([]types.DBUser, error)) error {
+			if step <= stored.TOTPLastStep {
+				return codeUsedError{}
+			}
+			return nil
+		}, store.Update{
+			Path:  "TOTPLastStep",
+			Value: step,
+		})
+		return spendCode(err)
+	}
+
+	hash := totp.HashRecoveryCode(code)
+	for i, h := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			remaining := append([]string{}, user.RecoveryCodes[:i]...)
+			remaining = append(remaining, user.RecoveryCodes[i+1:]...)
+			err := store.Users.UpdateIf(user.ID, func(stored types.DBUser, _ func() ([]types.DBUser, error)) error {
+				if !reflect.DeepEqual(stored.RecoveryCodes, user.RecoveryCodes) {
+					return codeUsedError{}
+				}
+				return nil
+			}, store.Update{
+				Path:  "RecoveryCodes",
+				Value: remaining,
+			})
+			return spendCode(err)
+		}
+	}
+	return false, nil
+}
+
+func spendCode(err error) (bool, error) {
+	if _, ok := err.(codeUsedError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func secondFactorPage(user types.DBUser, next, errorMessage string) map[string]interface{} {
+	return map[string]interface{}{
+		"TOTP":    user.TOTPEnabled,
+		"Passkey": len(user.Passkeys) > 0,
+		"Next":    next,
+		"Error":   errorMessage,
+	}
+}
+
+// getPendingUser returns the user part way through signing in. When the
+// pending login has expired or used up its attempts it renders the login
+// page again and returns false.
+func getPendingUser(w http.ResponseWriter, r *http.Request, next string) (types.DBUser, bool) {
+	var restartLogin = func(errorMessage string) {
+		session.EndSession(w, r)
+		ServeStaticPage(w, r, "/login", map[string]string{
+			"Next":  next,
+			"Error": errorMessage,
+		})
+	}
+
+	pending, err := session.GetPendingSession(w, r)
+	if _, ok := err.(session.NoSessionError); ok {
+		restartLogin("Your sign in has expired, please sign in again")
+		return types.DBUser{}, false
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return types.DBUser{}, false
+	}
+	if pending.Attempts >= maxSecondFactorAttempts {
+		restartLogin("Too many incorrect codes, please sign in again")
+		return types.DBUser{}, false
+	}
+
+	dbUser, err := store.Users.Get(pending.ID)
+	if _, ok := err.(store.NotFoundError); ok {
+		restartLogin("Your sign in has expired, please sign in again")
+		return types.DBUser{}, false
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return types.DBUser{}, false
+	}
+	return dbUser, true
+}
+
+func HandleSecondFactorPage(w http.ResponseWriter, r *http.Request) {
+	next := r.URL.Query().Get("next")
+	dbUser, ok := getPendingUser(w, r, next)
+	if !ok {
+		return
+	}
+	ServeStaticPage(w, r, "/login/2fa", secondFactorPage(dbUser, next, ""))
+}
+
+func HandleLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	code := r.PostFormValue("code")
+	next := r.PostFormValue("next")
+
+	dbUser, ok := getPendingUser(w, r, next)
+	if !ok {
+		return
+	}
+
+	ip := clientIP(r)
+	wait, err := loginAttempt(dbUser.Email, ip)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		servePage(w, r, "/login/2fa", secondFactorPage(dbUser, next, tooManyRequests(w, wait)), http.StatusTooManyRequests)
+		return
+	}
+
+	ok, err = checkSecondFactor(dbUser, code)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		if err := session.FailPendingSession(w, r); err != nil {
+			HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recordEvent(r, audit.Event{
+			Target:  dbUser.ID,
+			Action:  "login",
+			Outcome: audit.Failure,
+			Detail:  "incorrect second factor code",
+		})
+		ServeStaticPage(w, r, "/login/2fa", secondFactorPage(dbUser, next, "Incorrect code"))
+		return
+	}
+
+	if err := attemptPassed(dbUser.Email, ip); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := loginSucceeded(w, r, &dbUser, "password and code"); err != nil {
+		if _, ok := err.(AccountDisabledError); ok {
+			HTMLError(w, r, err.Error(), http.StatusForbidden)
+			return
+		}
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, safeRedirect(next), http.StatusFound)
+}
+
+func HandleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	sessionUser, err := getSessionUser(w, r)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dbUser, err := store.Users.Get(sessionUser.ID)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := NewTwoFactorPage(dbUser)
+	if dbUser.TOTPEnabled {
+		page.Error = "Two-factor authentication is already enabled"
+		ServeStaticPage(w, r, "/2fa", page)
+		return
+	}
+
+	dbUser.TOTPPendingSecret, err = totp.GenerateSecret()
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = store.Users.Update(dbUser.ID, store.Update{
+		Path:  "TOTPPendingSecret",
+		Value: dbUser.TOTPPendingSecret,
+	})
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page, err = page.withSecret(dbUser)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ServeStaticPage(w, r, "/2fa", page)
+}
+
+func HandleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	sessionUser, err := getSessionUser(w, r)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	dbUser, err := store.Users.Get(sessionUser.ID)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := NewTwoFactorPage(dbUser)
+	if dbUser.TOTPEnabled || dbUser.TOTPPendingSecret == "" {
+		page.Error = "Please start setting up two-factor authentication again"
+		ServeStaticPage(w, r, "/2fa", page)
+		return
+	}
+
+	step, ok := totp.Validate(dbUser.TOTPPendingSecret, r.PostFormValue("code"), time.Now())
+	if !ok {
+		page, err = page.withSecret(dbUser)
+		if err != nil {
+			HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Error = "Incorrect code, check the time on your device is correct"
+		ServeStaticPage(w, r, "/2fa", page)
+		return
+	}
+
+	codes, hashes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = store.Users.Update(dbUser.ID,
+		store.Update{
+			Path:  "TOTPEnabled",
+			Value: true,
+		},
+		store.Update{
+			Path:  "TOTPSecret",
+			Value: dbUser.TOTPPendingSecret,
+		},
+		store.Update{
+			Path:  "TOTPPendingSecret",
+			Value: "",
+		},
+		store.Update{
+			Path:  "TOTPLastStep",
+			Value: step,
+		},
+		store.Update{
+			Path:  "RecoveryCodes",
+			Value: hashes,
+		},
+	)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  dbUser.ID,
+		Target: dbUser.ID,
+		Action: "2fa.enable",
+	})
+
+	ServeStaticPage(w, r, "/2fa", TwoFactorPage{
+		Enabled:           true,
+		RecoveryCodes:     codes,
+		RecoveryCodesLeft: len(codes),
+	})
+}
+
+// checkPassword reports whether password is dbUser's current one, calling
+// sendError with the message and status to show if it isn't. Wrong guesses
+// count against the same limits as signing in and are audited as failures
+// of action.
+func checkPassword(w http.ResponseWriter, r *http.Request, dbUser types.DBUser, password, action string, sendError func(message string, code int)) bool {
+	ip := clientIP(r)
+	wait, err := loginAttempt(dbUser.Email, ip)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if wait > 0 {
+		sendError(tooManyRequests(w, wait), http.StatusTooManyRequests)
+		return false
+	}
+
+	if err := comparePassword(dbUser.Password, password); err != nil {
+		recordEvent(r, audit.Event{
+			Actor:   dbUser.ID,
+			Target:  dbUser.ID,
+			Action:  action,
+			Outcome: audit.Failure,
+			Detail:  "incorrect current password",
+		})
+		sendError("Incorrect password", http.StatusOK)
+		return false
+	}
+	if err := attemptPassed(dbUser.Email, ip); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// twoFactorError shows message on the 2fa page.
+func twoFactorError(w http.ResponseWriter, r *http.Request, dbUser types.DBUser) func(message string, code int) {
+	return func(message string, code int) {
+		page := NewTwoFactorPage(dbUser)
+		page.Error = message
+		servePage(w, r, "/2fa", page, code)
+	}
+}
+
+func HandleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	sessionUser, err := getSessionUser(w, r)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	dbUser, err := store.Users.Get(sessionUser.ID)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkPassword(w, r, dbUser, r.PostFormValue("password"), "2fa.disable", twoFactorError(w, r, dbUser)) {
+		return
+	}
+
+	if err := resetTOTP(dbUser.ID); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  dbUser.ID,
+		Target: dbUser.ID,
+		Action: "2fa.disable",
+	})
+	http.Redirect(w, r, "/2fa", http.StatusFound)
+}
+
+func HandleRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	sessionUser, err := getSessionUser(w, r)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	dbUser, err := store.Users.Get(sessionUser.ID)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkPassword(w, r, dbUser, r.PostFormValue("password"), "2fa.recovery_codes", twoFactorError(w, r, dbUser)) {
+		return
+	}
+	if !dbUser.TOTPEnabled {
+		twoFactorError(w, r, dbUser)("Two-factor authentication is not enabled", http.StatusOK)
+		return
+	}
+
+	codes, hashes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = store.Users.Update(dbUser.ID, store.Update{
+		Path:  "RecoveryCodes",
+		Value: hashes,
+	})
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  dbUser.ID,
+		Target: dbUser.ID,
+		Action: "2fa.recovery_codes",
+	})
+
+	ServeStaticPage(w, r, "/2fa", TwoFactorPage{
+		Enabled:           true,
+		RecoveryCodes:     codes,
+		RecoveryCodesLeft: len(codes),
+	})
+}
+
+// HandleTOTPReset lets an admin turn off 2FA for a user who has lost both
+// their device and their recovery codes. Their passkeys go too, as they are
+// most likely on the same device.
+func HandleTOTPReset(w http.ResponseWriter, r *http.Request) {
+	sessionUser, dbUser, ok := getManagedUser(w, r)
+	if !ok {
+		return
+	}
+	userID := dbUser.ID
+
+	err := resetTOTP(userID, store.Update{
+		Path:  "Passkeys",
+		Value: []types.Passkey{},
+	})
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: userID,
+		Action: "2fa.reset",
+	})
+	http.Redirect(w, r, "/edit/"+userID, http.StatusFound)
+}
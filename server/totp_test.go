@@ -0,0 +1,112 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/totp"
+	"github.com/mthorning/go-sso/types"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// totpCode is what an authenticator app would show for secret right now.
+func totpCode(t *testing.T, secret string) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(totp.Step(time.Now())))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
+
+func createTOTPUser(t *testing.T, email string) (types.DBUser, []string) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := createPasskeyUser(t, email, newAuthenticator(t))
+	err = store.Users.Update(user.ID,
+		store.Update{Path: "TOTPEnabled", Value: true},
+		store.Update{Path: "TOTPSecret", Value: secret},
+		store.Update{Path: "RecoveryCodes", Value: hashes},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = store.Users.Get(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, codes
+}
+
+func TestSecondFactorCodesSpentOnce(t *testing.T) {
+	user, recovery := createTOTPUser(t, "spent@totp.test")
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"TOTP code", totpCode(t, user.TOTPSecret), true},
+		{"same TOTP code again", totpCode(t, user.TOTPSecret), false},
+		{"recovery code", recovery[0], true},
+		{"same recovery code again", recovery[0], false},
+		{"another recovery code", recovery[1], true},
+		{"made up code", "000000-0", false},
+	}
+	for _, tt := range tests {
+		// each check sees the user as stored by the one before
+		stored, err := store.Users.Get(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := checkSecondFactor(stored, tt.code)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ok != tt.want {
+			t.Errorf("%s: accepted %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}
+
+func TestTOTPReset(t *testing.T) {
+	inRepoRoot(t)
+	user, _ := createTOTPUser(t, "reset@totp.test")
+	cookies := signIn(t, "admin@totp.test", "admin")
+
+	req := httptest.NewRequest("POST", "/edit/"+user.ID+"/2fa/reset", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": user.ID})
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	res := httptest.NewRecorder()
+	HandleTOTPReset(res, req)
+	if res.Code != http.StatusFound {
+		t.Fatalf("got %d: %s", res.Code, res.Body)
+	}
+
+	got, err := store.Users.Get(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TOTPEnabled || got.TOTPSecret != "" || len(got.RecoveryCodes) != 0 || len(got.Passkeys) != 0 {
+		t.Errorf("second factors left after reset: %+v", got)
+	}
+}
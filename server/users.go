@@ -0,0 +1,374 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/mthorning/go-sso/audit"
+	"github.com/mthorning/go-sso/jwt"
+	"github.com/mthorning/go-sso/oauth"
+	"github.com/mthorning/go-sso/reset"
+	"github.com/mthorning/go-sso/roles"
+	"github.com/mthorning/go-sso/session"
+	"github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/types"
+	"log"
+	"net/http"
+	"time"
+)
+
+// purgeInterval is how often soft-deleted users are checked for purging.
+const purgeInterval = time.Hour
+
+type AccountDisabledError struct{}
+
+func (e AccountDisabledError) Error() string {
+	return "This account has been disabled"
+}
+
+type LastAdminError struct{}
+
+func (e LastAdminError) Error() string {
+	return "This is the only remaining admin"
+}
+
+type ManageError struct{}
+
+func (e ManageError) Error() string {
+	return "This user has roles you can't grant, so you can't change their account"
+}
+
+// notLastAdmin returns LastAdminError if taking user's admin role away
+// would leave nobody able to manage the server. It is a store.Condition so
+// that two admins can't take each other's role away at the same time.
+func notLastAdmin(user types.DBUser, list func() ([]types.DBUser, error)) error {
+	if !user.HasRole(roles.Admin) || !user.Active() {
+		return nil
+	}
+	users, err := list()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.ID != user.ID && u.HasRole(roles.Admin) && u.Active() {
+			return nil
+		}
+	}
+	return LastAdminError{}
+}
+
+// CanManage reports whether sessionUser may change dbUser's account. Being
+// able to change someone's email address is as good as having their
+// password, so it needs every permission they have.
+func CanManage(sessionUser types.SessionUser, dbUser types.DBUser) bool {
+	for _, role := range dbUser.RoleNames() {
+		if _, ok := roles.Get(role); ok && !roles.CanGrant(sessionUser.Roles, role) {
+			return false
+		}
+	}
+	return true
+}
+
+// RoleOption is a role's checkbox on the edit and add user pages.
+type RoleOption struct {
+	roles.Role
+	Checked bool
+	// Disabled roles can't be granted or taken away by the editor.
+	Disabled bool
+}
+
+func NewRoleOptions(assigned, editor []string) []RoleOption {
+	var options []RoleOption
+	for _, role := range roles.All {
+		options = append(options, RoleOption{
+			Role:     role,
+			Checked:  contains(assigned, role.Name),
+			Disabled: !roles.CanGrant(editor, role.Name),
+		})
+	}
+	return options
+}
+
+// assignRoles works out a user's roles from the ones ticked on the form.
+// Roles the editor can't grant stay as they were.
+func assignRoles(requested, current, editor []string) []string {
+	assigned := []string{}
+	for _, role := range roles.All {
+		keep := contains(current, role.Name)
+		if roles.CanGrant(editor, role.Name) {
+			keep = contains(requested, role.Name)
+		}
+		if keep {
+			assigned = append(assigned, role.Name)
+		}
+	}
+	return assigned
+}
+
+func roleChanges(before, after []string) (granted, revoked []string) {
+	for _, role := range after {
+		if !contains(before, role) {
+			granted = append(granted, role)
+		}
+	}
+	for _, role := range before {
+		if !contains(after, role) {
+			revoked = append(revoked, role)
+		}
+	}
+	return granted, revoked
+}
+
+func recordRoleChanges(r *http.Request, actor, target string, granted, revoked []string) {
+	for _, role := range granted {
+		recordEvent(r, audit.Event{
+			Actor:  actor,
+			Target: target,
+			Action: "user.role.grant",
+			Detail: role,
+		})
+	}
+	for _, role := range revoked {
+		recordEvent(r, audit.Event{
+			Actor:  actor,
+			Target: target,
+			Action: "user.role.revoke",
+			Detail: role,
+		})
+	}
+}
+
+// PurgeAt is when a soft-deleted user will be removed for good.
+func PurgeAt(user types.DBUser) time.Time {
+	return user.DeletedAt.Add(conf.DeletedUserRetention)
+}
+
+// endUserAccess signs the user out everywhere and stops their refresh
+// tokens working. Access tokens already issued are revoked too, though
+// resource servers that check them without introspection will accept them
+// until they expire.
+func endUserAccess(userID, by string) error {
+	if err := session.RevokeSessions(userID, ""); err != nil {
+		return err
+	}
+	if err := oauth.RevokeUser(userID); err != nil {
+		return err
+	}
+	return jwt.RevokeSubject(userID, by)
+}
+
+// getManagedUser loads the user named in the URL for an admin action, which
+// can't be taken against yourself or someone with more permissions.
+func getManagedUser(w http.ResponseWriter, r *http.Request) (types.SessionUser, types.DBUser, bool) {
+	sessionUser, ok := getPermittedUser(w, r, roles.UsersWrite)
+	if !ok {
+		return types.SessionUser{}, types.DBUser{}, false
+	}
+
+	userID := mux.Vars(r)["id"]
+	if userID == sessionUser.ID {
+		HTMLError(w, r, "You can't do this to your own account", http.StatusForbidden)
+		return types.SessionUser{}, types.DBUser{}, false
+	}
+	dbUser, err := store.Users.Get(userID)
+	if _, ok := err.(store.NotFoundError); ok {
+		HTMLError(w, r, err.Error(), http.StatusNotFound)
+		return types.SessionUser{}, types.DBUser{}, false
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return types.SessionUser{}, types.DBUser{}, false
+	}
+	if !CanManage(sessionUser, dbUser) {
+		HTMLError(w, r, ManageError{}.Error(), http.StatusForbidden)
+		return types.SessionUser{}, types.DBUser{}, false
+	}
+	return sessionUser, dbUser, true
+}
+
+func HandleUserDisable(w http.ResponseWriter, r *http.Request) {
+	sessionUser, dbUser, ok := getManagedUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+	disabled := r.PostFormValue("disabled") == "true"
+
+	var check store.Condition
+	if disabled {
+		check = notLastAdmin
+	}
+	err := store.Users.UpdateIf(dbUser.ID, check, store.Update{
+		Path:  "Disabled",
+		Value: disabled,
+	})
+	if _, ok := err.(LastAdminError); ok {
+		HTMLError(w, r, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if disabled {
+		if err := endUserAccess(dbUser.ID, sessionUser.ID); err != nil {
+			HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	action := "user.enable"
+	if disabled {
+		action = "user.disable"
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: dbUser.ID,
+		Action: action,
+	})
+	http.Redirect(w, r, "/edit/"+dbUser.ID, http.StatusFound)
+}
+
+// HandleUserDelete soft-deletes a user. They can be restored until they are
+// purged at the end of the retention period.
+func HandleUserDelete(w http.ResponseWriter, r *http.Request) {
+	sessionUser, dbUser, ok := getManagedUser(w, r)
+	if !ok {
+		return
+	}
+	if dbUser.Deleted() {
+		http.Redirect(w, r, "/edit/"+dbUser.ID, http.StatusFound)
+		return
+	}
+
+	err := store.Users.UpdateIf(dbUser.ID, notLastAdmin,
+		store.Update{
+			Path:  "DeletedAt",
+			Value: time.Now(),
+		},
+		store.Update{
+			Path:  "DeletedBy",
+			Value: sessionUser.ID,
+		},
+	)
+	if _, ok := err.(LastAdminError); ok {
+		HTMLError(w, r, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := endUserAccess(dbUser.ID, sessionUser.ID); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := reset.Cancel(dbUser.ID); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: dbUser.ID,
+		Action: "user.delete",
+	})
+	http.Redirect(w, r, "/manage", http.StatusFound)
+}
+
+func HandleUserRestore(w http.ResponseWriter, r *http.Request) {
+	sessionUser, dbUser, ok := getManagedUser(w, r)
+	if !ok {
+		return
+	}
+	if !dbUser.Deleted() {
+		HTMLError(w, r, "Only deleted users can be restored", http.StatusBadRequest)
+		return
+	}
+
+	err := store.Users.Update(dbUser.ID,
+		store.Update{
+			Path:  "DeletedAt",
+			Value: time.Time{},
+		},
+		store.Update{
+			Path:  "DeletedBy",
+			Value: "",
+		},
+	)
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: dbUser.ID,
+		Action: "user.restore",
+	})
+	http.Redirect(w, r, "/edit/"+dbUser.ID, http.StatusFound)
+}
+
+// HandleUserPurge removes a soft-deleted user for good without waiting for
+// the retention period.
+func HandleUserPurge(w http.ResponseWriter, r *http.Request) {
+	sessionUser, dbUser, ok := getManagedUser(w, r)
+	if !ok {
+		return
+	}
+	if !dbUser.Deleted() {
+		HTMLError(w, r, "Only deleted users can be purged", http.StatusConflict)
+		return
+	}
+
+	if err := purgeUser(dbUser.ID, sessionUser.ID); err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(r, audit.Event{
+		Actor:  sessionUser.ID,
+		Target: dbUser.ID,
+		Action: "user.purge",
+	})
+	http.Redirect(w, r, "/manage", http.StatusFound)
+}
+
+func purgeUser(userID, by string) error {
+	if err := endUserAccess(userID, by); err != nil {
+		return err
+	}
+	if err := reset.Cancel(userID); err != nil {
+		return err
+	}
+	err := store.Users.Delete(userID)
+	if _, ok := err.(store.NotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// PurgeDeletedUsers purges users once their retention period has passed,
+// checking every purgeInterval until the process exits.
+func PurgeDeletedUsers() {
+	for range time.Tick(purgeInterval) {
+		users, err := store.Users.List()
+		if err != nil {
+			log.Printf("error listing users to purge: %v\n", err)
+			continue
+		}
+		now := time.Now()
+		for _, u := range users {
+			if !u.Deleted() || now.Before(PurgeAt(u)) {
+				continue
+			}
+			if err := purgeUser(u.ID, ""); err != nil {
+				log.Printf("error purging user %s: %v\n", u.ID, err)
+				continue
+			}
+			audit.Log(audit.Event{
+				Target: u.ID,
+				Action: "user.purge",
+				Detail: "retention period ended",
+			})
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"github.com/mthorning/go-sso/jwt"
+	"github.com/mthorning/go-sso/roles"
+	"github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/types"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotLastAdmin(t *testing.T) {
+	// start from no admins, whatever earlier tests left behind, and put
+	// them back afterwards
+	users, err := store.Users.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range users {
+		if u.HasRole(roles.Admin) && !u.Disabled {
+			if err := store.Users.Update(u.ID, store.Update{Path: "Disabled", Value: true}); err != nil {
+				t.Fatal(err)
+			}
+			id := u.ID
+			t.Cleanup(func() { store.Users.Update(id, store.Update{Path: "Disabled", Value: false}) })
+		}
+	}
+
+	var ids []string
+	for _, email := range []string{"admin1@admins.test", "admin2@admins.test"} {
+		id, err := store.Users.Create(types.DBUser{
+			Email:   email,
+			Created: time.Now(),
+			Roles:   []string{roles.Admin},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		t.Cleanup(func() { store.Users.Delete(id) })
+	}
+
+	// each admin disables the other at the same time
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(ids))
+	)
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			errs[i] = store.Users.UpdateIf(id, notLastAdmin, store.Update{
+				Path:  "Disabled",
+				Value: true,
+			})
+		}(i, id)
+	}
+	wg.Wait()
+
+	var refused int
+	for _, err := range errs {
+		switch err.(type) {
+		case nil:
+		case LastAdminError:
+			refused++
+		default:
+			t.Fatal(err)
+		}
+	}
+	if refused != 1 {
+		t.Errorf("%d of 2 updates refused, want 1: %v", refused, errs)
+	}
+}
+
+func TestEndUserAccessRevokesAccessTokens(t *testing.T) {
+	user, other := "ended", "still-here"
+	token, err := jwt.New(user, jwt.Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := jwt.New(other, jwt.Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := endUserAccess(user, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Authenticate(token); err == nil {
+		t.Error("access token still accepted")
+	} else if _, ok := err.(jwt.RevokedError); !ok {
+		t.Errorf("got %v, want RevokedError", err)
+	}
+	if _, err := jwt.Authenticate(otherToken); err != nil {
+		t.Errorf("another user's token: %v", err)
+	}
+}
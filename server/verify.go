@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/mthorning/go-sso/mail"
+	"github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/types"
+	"github.com/mthorning/go-sso/verify"
+	"log"
+	"net/http"
+)
+
+func sendVerification(user types.DBUser) error {
+	link := mail.Link("/verify/" + verify.NewToken(user))
+	return mail.Sender.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Please verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm this is your email address by opening the link below. It expires in %s.\n\n%s\n\nIf you didn't create an account you can ignore this email.\n",
+			user.Name, verify.Conf.VerificationLifetime, link),
+	})
+}
+
+// verificationRequired reports whether user must verify their address
+// before signing in.
+func verificationRequired(user types.DBUser) bool {
+	return verify.Conf.RequireVerifiedEmail && !user.EmailVerified
+}
+
+func HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var sendError = func(errorMessage string) {
+		ServeStaticPage(w, r, "/verify", map[string]string{
+			"Error": errorMessage,
+		})
+	}
+
+	userID, email, err := verify.CheckToken(mux.Vars(r)["token"])
+	if err != nil {
+		sendError(err.Error())
+		return
+	}
+
+	dbUser, err := store.Users.Get(userID)
+	if _, ok := err.(store.NotFoundError); ok {
+		sendError(verify.InvalidTokenError{}.Error())
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the link has been used, or the address has changed since it was sent
+	err = store.Users.UpdateIf(dbUser.ID, func(stored types.DBUser, _ func() ([]types.DBUser, error)) error {
+		if stored.EmailVerified || stored.Email != email {
+			return verify.InvalidTokenError{}
+		}
+		return nil
+	}, store.Update{
+		Path:  "EmailVerified",
+		Value: true,
+	})
+	if _, ok := err.(verify.InvalidTokenError); ok {
+		sendError(err.Error())
+		return
+	}
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ServeStaticPage(w, r, "/verify", map[string]string{})
+}
+
+// HandleResendVerification gives the same answer whether or not the address
+// has an account, so it can't be used to find out who is registered. It is
+// throttled the same way as password resets.
+func HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		HTMLError(w, r, "Error reading form", http.StatusBadRequest)
+		return
+	}
+
+	email := r.PostFormValue("email")
+	wait, err := mailAttempt(email, clientIP(r))
+	if err != nil {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		servePage(w, r, "/verify", map[string]string{
+			"Error": tooManyRequests(w, wait),
+		}, http.StatusTooManyRequests)
+		return
+	}
+
+	dbUser, err := store.Users.FindByEmail(email)
+	if err == nil && !dbUser.EmailVerified {
+		if err := sendVerification(dbUser); err != nil {
+			log.Printf("error sending verification email: %v\n", err)
+		}
+	} else if _, ok := err.(store.NotFoundError); err != nil && !ok {
+		HTMLError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ServeStaticPage(w, r, "/verify", map[string]string{
+		"Resent": "true",
+	})
+}
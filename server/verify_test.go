@@ -0,0 +1,71 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/types"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyEmail(t *testing.T) {
+	inRepoRoot(t)
+	sent := useOutbox(t)
+
+	tests := []struct {
+		name string
+		// before runs between the link being sent and each use of it
+		before []func(t *testing.T, user types.DBUser)
+		// want is whether each use verifies the address
+		want []bool
+	}{
+		{"used once", []func(t *testing.T, user types.DBUser){nil, nil}, []bool{true, false}},
+		{"address changed", []func(t *testing.T, user types.DBUser){
+			func(t *testing.T, user types.DBUser) {
+				if err := store.Users.Update(user.ID, store.Update{Path: "Email", Value: "changed-" + user.Email}); err != nil {
+					t.Fatal(err)
+				}
+			},
+		}, []bool{false}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := types.DBUser{Name: "Vera", Email: "vera" + string(rune('a'+i)) + "@verify.test", Created: time.Now()}
+			id, err := store.Users.Create(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user.ID = id
+			t.Cleanup(func() { store.Users.Delete(id) })
+
+			if err := sendVerification(user); err != nil {
+				t.Fatal(err)
+			}
+			path := sent.link(t, user.Email, "/verify/")
+
+			for use, want := range tt.want {
+				if before := tt.before[use]; before != nil {
+					before(t, user)
+				}
+				req := mux.SetURLVars(httptest.NewRequest("GET", path, nil), map[string]string{
+					"token": strings.TrimPrefix(path, "/verify/"),
+				})
+				res := httptest.NewRecorder()
+				HandleVerifyEmail(res, req)
+
+				if got := strings.Contains(res.Body.String(), "Email Verified"); got != want {
+					t.Errorf("use %d: verified = %v, want %v: %s", use+1, got, want, res.Body)
+				}
+			}
+			stored, err := store.Users.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.EmailVerified != tt.want[0] {
+				t.Errorf("EmailVerified = %v, want %v", stored.EmailVerified, tt.want[0])
+			}
+		})
+	}
+}
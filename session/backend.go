@@ -0,0 +1,112 @@
+package session
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Backend keeps session records server side so that every instance behind
+// a load balancer sees the same sessions. Keys are hashes of the session
+// IDs held in cookies, never the IDs themselves.
+type Backend interface {
+	Load(key string) (Record, error)
+	Save(key string, rec Record) error
+	Delete(key string) error
+	// DeleteExpired removes records whose Expires has passed. Backends that
+	// expire records themselves can do nothing.
+	DeleteExpired(now time.Time) error
+	// List returns the unexpired records belonging to userID by key.
+	List(userID string) (map[string]Record, error)
+}
+
+type Record struct {
+	Values   []byte
+	Created  time.Time
+	LastSeen time.Time
+	Expires  time.Time
+
+	// UserID is empty until the session has signed in.
+	UserID    string
+	IP        string
+	UserAgent string
+}
+
+func (r Record) expired(now time.Time) bool {
+	return !now.Before(r.Expires)
+}
+
+type notFoundError struct{}
+
+func (e notFoundError) Error() string {
+	return "Session not found"
+}
+
+func newBackend(name string) (Backend, error) {
+	switch name {
+	case "memory":
+		return newMemoryBackend(), nil
+	case "sqlite":
+		return newSqliteBackend(conf.SessionSqlitePath)
+	case "redis":
+		return newRedisBackend(conf.SessionRedisAddr, conf.SessionRedisPassword, conf.SessionRedisDB), nil
+	}
+	return nil, fmt.Errorf("unknown session backend %q", name)
+}
+
+type memoryBackend struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{records: map[string]Record{}}
+}
+
+func (m *memoryBackend) Load(key string) (Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.records[key]
+	if !ok {
+		return Record{}, notFoundError{}
+	}
+	return rec, nil
+}
+
+func (m *memoryBackend) Save(key string, rec Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records[key] = rec
+	return nil
+}
+
+func (m *memoryBackend) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, key)
+	return nil
+}
+
+func (m *memoryBackend) DeleteExpired(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, rec := range m.records {
+		if rec.expired(now) {
+			delete(m.records, key)
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) List(userID string) (map[string]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	list := map[string]Record{}
+	for key, rec := range m.records {
+		if rec.UserID == userID && !rec.expired(now) {
+			list[key] = rec
+		}
+	}
+	return list, nil
+}
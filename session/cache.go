@@ -0,0 +1,62 @@
+package session
+
+import (
+	userstore "github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/types"
+	"sync"
+	"time"
+)
+
+// userCache saves a store lookup on every request. Changes made through this
+// instance evict the user straight away; changes made by another instance
+// are seen within SessionUserCacheTTL.
+type userCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	users map[string]cachedUser
+	// generation changes whenever a user is forgotten, so that a read
+	// which started before a change isn't cached after it
+	generation uint64
+}
+
+type cachedUser struct {
+	user    types.DBUser
+	fetched time.Time
+}
+
+func newUserCache(ttl time.Duration) *userCache {
+	c := &userCache{ttl: ttl, users: map[string]cachedUser{}}
+	userstore.OnUserChange(c.forget)
+	return c
+}
+
+func (c *userCache) get(id string) (types.DBUser, error) {
+	c.mu.Lock()
+	cached, ok := c.users[id]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && time.Since(cached.fetched) < c.ttl {
+		return cached.user, nil
+	}
+
+	user, err := userstore.Users.Get(id)
+	if err != nil {
+		c.forget(id)
+		return types.DBUser{}, err
+	}
+	if c.ttl > 0 {
+		c.mu.Lock()
+		if c.generation == generation {
+			c.users[id] = cachedUser{user: user, fetched: time.Now()}
+		}
+		c.mu.Unlock()
+	}
+	return user, nil
+}
+
+func (c *userCache) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.users, id)
+	c.generation++
+}
@@ -0,0 +1,71 @@
+package session
+
+import (
+	userstore "github.com/mthorning/go-sso/store"
+	"github.com/mthorning/go-sso/types"
+	"testing"
+	"time"
+)
+
+func init() {
+	userstore.UseMemory()
+}
+
+// changedDuringGet runs change once, after Get has read a user but before
+// it returns.
+type changedDuringGet struct {
+	userstore.UserStore
+	change func()
+}
+
+func (c *changedDuringGet) Get(id string) (types.DBUser, error) {
+	user, err := c.UserStore.Get(id)
+	if c.change != nil {
+		change := c.change
+		c.change = nil
+		change()
+	}
+	return user, err
+}
+
+func TestUserCache(t *testing.T) {
+	id, err := userstore.Users.Create(types.DBUser{Name: "Before", Email: "cache@session.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { userstore.Users.Delete(id) })
+	rename := func(name string) {
+		if err := userstore.Users.Update(id, userstore.Update{Path: "Name", Value: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newUserCache(time.Minute)
+	get := func() string {
+		user, err := c.get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user.Name
+	}
+
+	if got := get(); got != "Before" {
+		t.Fatalf("got %q", got)
+	}
+	rename("Evicted")
+	if got := get(); got != "Evicted" {
+		t.Errorf("after a change: got %q, want Evicted", got)
+	}
+
+	// a change made while the user is being read mustn't be hidden by
+	// caching the read
+	rename("Evicted again")
+	users := userstore.Users
+	t.Cleanup(func() { userstore.Users = users })
+	userstore.Users = &changedDuringGet{UserStore: users, change: func() { rename("During") }}
+	if got := get(); got != "Evicted again" {
+		t.Errorf("read during the change: got %q", got)
+	}
+	if got := get(); got != "During" {
+		t.Errorf("after a change during a read: got %q, want During", got)
+	}
+}
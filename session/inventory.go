@@ -0,0 +1,74 @@
+package session
+
+import (
+	"sort"
+	"time"
+)
+
+// Info describes one signed in session. Key identifies it for revocation
+// without exposing the ID from its cookie.
+type Info struct {
+	Key       string
+	Created   time.Time
+	LastSeen  time.Time
+	IP        string
+	UserAgent string
+	Current   bool
+}
+
+// ListSessions returns userID's sessions, most recently used first.
+// currentKey marks the session making the request.
+func ListSessions(userID, currentKey string) ([]Info, error) {
+	records, err := store.backend.List(userID)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Info, 0, len(records))
+	for key, rec := range records {
+		list = append(list, Info{
+			Key:       key,
+			Created:   rec.Created,
+			LastSeen:  rec.LastSeen,
+			IP:        rec.IP,
+			UserAgent: rec.UserAgent,
+			Current:   key == currentKey,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
+	return list, nil
+}
+
+// RevokeSession signs out one of userID's sessions.
+func RevokeSession(userID, key string) error {
+	rec, err := store.backend.Load(key)
+	if _, ok := err.(notFoundError); ok {
+		return NoSessionError{}
+	}
+	if err != nil {
+		return err
+	}
+	if rec.UserID != userID {
+		return NoSessionError{}
+	}
+	return store.backend.Delete(key)
+}
+
+// RevokeSessions signs out all of userID's sessions except exceptKey,
+// which may be empty.
+func RevokeSessions(userID, exceptKey string) error {
+	records, err := store.backend.List(userID)
+	if err != nil {
+		return err
+	}
+	for key := range records {
+		if key == exceptKey {
+			continue
+		}
+		if err := store.backend.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisPrefix = "go-sso:session:"
+	// redisUserPrefix names a set of each user's session keys. Keys are
+	// left behind when their session expires and pruned by List.
+	redisUserPrefix = "go-sso:user-sessions:"
+)
+
+// redisBackend speaks just enough RESP for the commands below, so any server
+// implementing the Redis protocol will do. Records expire through their TTL,
+// so there is nothing for the sweeper to do.
+type redisBackend struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func newRedisBackend(addr, password string, db int) *redisBackend {
+	return &redisBackend{addr: addr, password: password, db: db}
+}
+
+func (b *redisBackend) Load(key string) (Record, error) {
+	reply, err := b.do("GET", redisPrefix+key)
+	if err != nil {
+		return Record{}, err
+	}
+	if reply == nil {
+		return Record{}, notFoundError{}
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return Record{}, fmt.Errorf("redis: unexpected reply %T to GET", reply)
+	}
+	var rec Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return Record{}, err
+	}
+	return rec, nil
+}
+
+func (b *redisBackend) Save(key string, rec Record) error {
+	ttl := time.Until(rec.Expires).Milliseconds()
+	if ttl <= 0 {
+		return b.Delete(key)
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := b.do("SET", redisPrefix+key, string(data), "PX", strconv.FormatInt(ttl, 10)); err != nil {
+		return err
+	}
+	if rec.UserID == "" {
+		return nil
+	}
+	if _, err := b.do("SADD", redisUserPrefix+rec.UserID, key); err != nil {
+		return err
+	}
+	// the set needs to outlive the longest session added to it
+	_, err = b.do("PEXPIRE", redisUserPrefix+rec.UserID,
+		strconv.FormatInt(conf.SessionAbsoluteTimeout.Milliseconds(), 10))
+	return err
+}
+
+func (b *redisBackend) Delete(key string) error {
+	_, err := b.do("DEL", redisPrefix+key)
+	return err
+}
+
+func (b *redisBackend) DeleteExpired(now time.Time) error {
+	return nil
+}
+
+func (b *redisBackend) List(userID string) (map[string]Record, error) {
+	reply, err := b.do("SMEMBERS", redisUserPrefix+userID)
+	if err != nil {
+		return nil, err
+	}
+	members, _ := reply.([]interface{})
+
+	list := map[string]Record{}
+	for _, m := range members {
+		key := string(m.([]byte))
+		rec, err := b.Load(key)
+		if _, ok := err.(notFoundError); ok || (err == nil && rec.UserID != userID) {
+			if _, err := b.do("SREM", redisUserPrefix+userID, key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list[key] = rec
+	}
+	return list, nil
+}
+
+// do sends a command and reads its reply, reconnecting once if the
+// connection has gone away since it was last used.
+func (b *redisBackend) do(args ...string) (interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if b.conn == nil {
+			if err := b.connect(); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := b.roundTrip(args)
+		if _, ok := err.(redisError); ok || err == nil {
+			return reply, err
+		}
+		b.conn.Close()
+		b.conn = nil
+		if attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+func (b *redisBackend) connect() error {
+	conn, err := net.DialTimeout("tcp", b.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	b.conn = conn
+	b.rd = bufio.NewReader(conn)
+
+	var setup [][]string
+	if b.password != "" {
+		setup = append(setup, []string{"AUTH", b.password})
+	}
+	if b.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(b.db)})
+	}
+	for _, args := range setup {
+		if _, err := b.roundTrip(args); err != nil {
+			conn.Close()
+			b.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *redisBackend) roundTrip(args []string) (interface{}, error) {
+	b.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	w := bufio.NewWriter(b.conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(b.rd)
+}
+
+func readReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
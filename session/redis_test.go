@@ -0,0 +1,353 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis answers the commands redisBackend sends over a real socket,
+// expiring keys given a PX and replying with an error to any command in
+// fail.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	conns   int
+	strings map[string]string
+	expires map[string]time.Time
+	sets    map[string]map[string]bool
+	px      map[string]int64
+	fail    map[string]string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		ln:       ln,
+		password: password,
+		strings:  map[string]string{},
+		expires:  map[string]time.Time{},
+		sets:     map[string]map[string]bool{},
+		px:       map[string]int64{},
+		fail:     map[string]string{},
+	}
+	t.Cleanup(func() { ln.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns++
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		var reply string
+		switch {
+		case cmd == "AUTH":
+			authed = args[1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = f.exec(cmd, args[1:])
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	reply, err := readReply(rd)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, fmt.Errorf("not a command: %v", reply)
+	}
+	args := make([]string, len(items))
+	for i, item := range items {
+		args[i] = string(item.([]byte))
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) exec(cmd string, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if msg, ok := f.fail[cmd]; ok {
+		return "-" + msg + "\r\n"
+	}
+	for key, at := range f.expires {
+		if !time.Now().Before(at) {
+			delete(f.strings, key)
+			delete(f.sets, key)
+			delete(f.expires, key)
+		}
+	}
+
+	switch cmd {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok := f.strings[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		f.strings[args[0]] = args[1]
+		delete(f.expires, args[0])
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.ParseInt(args[3], 10, 64)
+			f.px[args[0]] = ms
+			f.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			_, isString := f.strings[key]
+			_, isSet := f.sets[key]
+			if isString || isSet {
+				n++
+			}
+			delete(f.strings, key)
+			delete(f.sets, key)
+			delete(f.expires, key)
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SADD":
+		if f.sets[args[0]] == nil {
+			f.sets[args[0]] = map[string]bool{}
+		}
+		for _, m := range args[1:] {
+			f.sets[args[0]][m] = true
+		}
+		return fmt.Sprintf(":%d\r\n", len(args)-1)
+	case "SREM":
+		for _, m := range args[1:] {
+			delete(f.sets[args[0]], m)
+		}
+		return fmt.Sprintf(":%d\r\n", len(args)-1)
+	case "SMEMBERS":
+		reply := fmt.Sprintf("*%d\r\n", len(f.sets[args[0]]))
+		for m := range f.sets[args[0]] {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(m), m)
+		}
+		return reply
+	case "PEXPIRE":
+		ms, _ := strconv.ParseInt(args[1], 10, 64)
+		f.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", cmd)
+}
+
+func testRecord(userID string, ttl time.Duration) Record {
+	now := time.Now().Truncate(time.Millisecond)
+	return Record{
+		Values:   []byte("values"),
+		Created:  now,
+		LastSeen: now,
+		Expires:  now.Add(ttl),
+		UserID:   userID,
+	}
+}
+
+func TestRedisBackend(t *testing.T) {
+	f := newFakeRedis(t, "")
+	b := newRedisBackend(f.ln.Addr().String(), "", 2)
+
+	if _, err := b.Load("missing"); err != (notFoundError{}) {
+		t.Fatalf("Load of a missing key: got %v, want notFoundError", err)
+	}
+
+	rec := testRecord("user", time.Minute)
+	if err := b.Save("a", rec); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	f.mu.Lock()
+	px := f.px[redisPrefix+"a"]
+	f.mu.Unlock()
+	if px <= 0 || px > time.Minute.Milliseconds() {
+		t.Errorf("SET PX %d, want the time left until the record expires", px)
+	}
+	got, err := b.Load("a")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(got.Values, rec.Values) || !got.Expires.Equal(rec.Expires) || got.UserID != rec.UserID {
+		t.Errorf("Load = %+v, want %+v", got, rec)
+	}
+
+	if err := b.Save("short", testRecord("", 20*time.Millisecond)); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := b.Load("short"); err != (notFoundError{}) {
+		t.Errorf("Load after the TTL: got %v, want notFoundError", err)
+	}
+
+	if err := b.Save("a", testRecord("user", -time.Second)); err != nil {
+		t.Fatalf("Save of an expired record: %v", err)
+	}
+	if _, err := b.Load("a"); err != (notFoundError{}) {
+		t.Errorf("Load after saving an expired record: got %v, want notFoundError", err)
+	}
+
+	if err := b.Save("b", rec); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := b.Delete("b"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := b.Delete("b"); err != nil {
+		t.Fatalf("Delete of a missing key: %v", err)
+	}
+	if _, err := b.Load("b"); err != (notFoundError{}) {
+		t.Errorf("Load after Delete: got %v, want notFoundError", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conns != 1 {
+		t.Errorf("%d connections made, want 1", f.conns)
+	}
+}
+
+func TestRedisBackendList(t *testing.T) {
+	f := newFakeRedis(t, "")
+	b := newRedisBackend(f.ln.Addr().String(), "", 0)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := b.Save(key, testRecord("user", time.Minute)); err != nil {
+			t.Fatalf("Save(%s): %v", key, err)
+		}
+	}
+	if err := b.Delete("b"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	// c has since been given to someone else
+	if err := b.Save("c", testRecord("other", time.Minute)); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	list, err := b.List("user")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list) != 1 || list["a"].UserID != "user" {
+		t.Errorf("List = %v, want only a", list)
+	}
+	f.mu.Lock()
+	members := f.sets[redisUserPrefix+"user"]
+	f.mu.Unlock()
+	if len(members) != 1 || !members["a"] {
+		t.Errorf("user's set = %v after List, want the stale keys pruned", members)
+	}
+}
+
+func TestRedisBackendErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		// password is what the server wants and auth what the client sends
+		password, auth string
+		fail           map[string]string
+		op             func(b *redisBackend) error
+		want           string
+	}{
+		{
+			name: "GET",
+			fail: map[string]string{"GET": "WRONGTYPE Operation against a key holding the wrong kind of value"},
+			op: func(b *redisBackend) error {
+				_, err := b.Load("a")
+				return err
+			},
+			want: "redis: WRONGTYPE Operation against a key holding the wrong kind of value",
+		},
+		{
+			name: "SET",
+			fail: map[string]string{"SET": "OOM command not allowed when used memory > 'maxmemory'"},
+			op: func(b *redisBackend) error {
+				return b.Save("a", testRecord("", time.Minute))
+			},
+			want: "redis: OOM command not allowed when used memory > 'maxmemory'",
+		},
+		{
+			name: "DEL",
+			fail: map[string]string{"DEL": "READONLY You can't write against a read only replica."},
+			op: func(b *redisBackend) error {
+				return b.Delete("a")
+			},
+			want: "redis: READONLY You can't write against a read only replica.",
+		},
+		{
+			name:     "AUTH",
+			password: "secret",
+			auth:     "wrong",
+			op: func(b *redisBackend) error {
+				_, err := b.Load("a")
+				return err
+			},
+			want: "redis: WRONGPASS invalid password",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeRedis(t, tt.password)
+			for cmd, msg := range tt.fail {
+				f.fail[cmd] = msg
+			}
+			b := newRedisBackend(f.ln.Addr().String(), tt.auth, 0)
+
+			err := tt.op(b)
+			if _, ok := err.(redisError); !ok || err.Error() != tt.want {
+				t.Fatalf("got %v, want %q", err, tt.want)
+			}
+
+			// an error reply leaves the connection usable, so the command
+			// isn't retried on a new one
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if f.conns != 1 {
+				t.Errorf("%d connections made, want 1", f.conns)
+			}
+		})
+	}
+}
@@ -1,25 +1,69 @@
 package session
 
 import (
-	"github.com/gorilla/sessions"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"github.com/mthorning/go-sso/config"
+	userstore "github.com/mthorning/go-sso/store"
 	"github.com/mthorning/go-sso/types"
+	"log"
 	"net/http"
+	"time"
 )
 
 type Config struct {
 	SessionKey  string `default:"devsessionkey"`
 	SessionName string `default:"go-sso"`
+	// SessionSecure only sends the cookie over HTTPS; turn it off for local
+	// development over plain HTTP.
+	SessionSecure bool `default:"false" split_words:"true"`
+	// SessionBackend is "memory" for a single instance, or "sqlite" or
+	// "redis" to share sessions between instances.
+	SessionBackend       string `default:"memory" split_words:"true"`
+	SessionSqlitePath    string `default:"go-sso.db" split_words:"true"`
+	SessionRedisAddr     string `default:"localhost:6379" split_words:"true"`
+	SessionRedisPassword string `split_words:"true"`
+	SessionRedisDB       int    `envconfig:"session_redis_db"`
+	// A session ends after SessionIdleTimeout without a request, and
+	// SessionAbsoluteTimeout after login however active it has been.
+	SessionIdleTimeout     time.Duration `default:"24h" split_words:"true"`
+	SessionAbsoluteTimeout time.Duration `default:"720h" split_words:"true"`
+	SessionSweepInterval   time.Duration `default:"10m" split_words:"true"`
+	// SessionUserCacheTTL is how long a user record is trusted before
+	// being read again, bounding how long a change made on another
+	// instance takes to reach sessions here.
+	SessionUserCacheTTL time.Duration `default:"5s" envconfig:"session_user_cache_ttl"`
 }
 
 var (
 	conf  Config
-	store *sessions.FilesystemStore
+	store *serverStore
+	users *userCache
 )
 
 func init() {
 	config.SetConfig(&conf)
-	store = sessions.NewFilesystemStore("", []byte(conf.SessionKey))
+	backend, err := newBackend(conf.SessionBackend)
+	if err != nil {
+		log.Fatalf("error initializing sessions: %v\n", err)
+	}
+	store = newServerStore(backend, []byte(conf.SessionKey))
+	// Lax still sends the cookie when a relying party redirects the browser
+	// to /authorize, but not on cross-site form posts
+	store.Options.SameSite = http.SameSiteLaxMode
+	store.Options.HttpOnly = true
+	store.Options.Secure = conf.SessionSecure
+	users = newUserCache(conf.SessionUserCacheTTL)
+}
+
+// SweepSessions deletes expired sessions every SessionSweepInterval until
+// the process exits.
+func SweepSessions() {
+	if conf.SessionSweepInterval <= 0 {
+		return
+	}
+	store.sweep(time.Tick(conf.SessionSweepInterval))
 }
 
 func SetSession(w http.ResponseWriter, r *http.Request, user *types.DBUser) error {
@@ -28,9 +72,21 @@ func SetSession(w http.ResponseWriter, r *http.Request, user *types.DBUser) erro
 		return err
 	}
 
+	delete(s.Values, "pendingID")
+	delete(s.Values, "pendingAt")
+	delete(s.Values, "pendingAttempts")
+	// a token seen before signing in mustn't outlive it
+	delete(s.Values, "csrf")
+	// a new ID stops anyone who planted the old one riding on the login, and
+	// the absolute timeout counts from here
+	if s.ID != "" {
+		if err := store.backend.Delete(backendKey(s.ID)); err != nil {
+			return err
+		}
+		s.ID = ""
+	}
+	delete(s.Values, "created")
 	s.Values["id"] = user.ID
-	s.Values["admin"] = user.Admin
-	s.Values["name"] = user.Name
 	err = s.Save(r, w)
 	if err != nil {
 		return err
@@ -52,15 +108,25 @@ func GetSession(w http.ResponseWriter, r *http.Request) (types.SessionUser, erro
 	if !ok {
 		return types.SessionUser{}, NoSessionError{}
 	}
-	admin, ok := s.Values["admin"].(bool)
-	name, ok := s.Values["name"].(string)
-	if !ok {
+
+	// the name and roles come from the user record rather than the
+	// session, so an admin's changes apply without signing the user out;
+	// disabled and deleted users' sessions have been revoked
+	user, err := users.get(id)
+	if _, ok := err.(userstore.NotFoundError); ok {
+		return types.SessionUser{}, NoSessionError{}
+	}
+	if err != nil {
+		return types.SessionUser{}, err
+	}
+	if !user.Active() {
 		return types.SessionUser{}, NoSessionError{}
 	}
 	return types.SessionUser{
-		ID:    id,
-		Name:  name,
-		Admin: admin,
+		ID:         user.ID,
+		Name:       user.Name,
+		Roles:      user.RoleNames(),
+		SessionKey: backendKey(s.ID),
 	}, nil
 }
 
@@ -76,3 +142,113 @@ func EndSession(w http.ResponseWriter, r *http.Request) error {
 	}
 	return nil
 }
+
+// pendingLifetime is how long a user has to enter their second factor after
+// their password has been accepted.
+const pendingLifetime = 5 * time.Minute
+
+type PendingUser struct {
+	ID       string
+	Attempts int
+}
+
+// SetPendingSession records that user has passed the password check but
+// still needs to present a second factor. It does not log them in.
+func SetPendingSession(w http.ResponseWriter, r *http.Request, user *types.DBUser) error {
+	s, err := store.Get(r, conf.SessionName)
+	if err != nil {
+		return err
+	}
+
+	delete(s.Values, "id")
+	s.Values["pendingID"] = user.ID
+	s.Values["pendingAt"] = time.Now().Unix()
+	s.Values["pendingAttempts"] = 0
+	return s.Save(r, w)
+}
+
+func GetPendingSession(w http.ResponseWriter, r *http.Request) (PendingUser, error) {
+	s, err := store.Get(r, conf.SessionName)
+	if err != nil {
+		return PendingUser{}, err
+	}
+	id, ok := s.Values["pendingID"].(string)
+	if !ok {
+		return PendingUser{}, NoSessionError{}
+	}
+	at, _ := s.Values["pendingAt"].(int64)
+	if time.Since(time.Unix(at, 0)) > pendingLifetime {
+		return PendingUser{}, NoSessionError{}
+	}
+	attempts, _ := s.Values["pendingAttempts"].(int)
+	return PendingUser{
+		ID:       id,
+		Attempts: attempts,
+	}, nil
+}
+
+// FailPendingSession counts a wrong second factor against the pending login.
+func FailPendingSession(w http.ResponseWriter, r *http.Request) error {
+	s, err := store.Get(r, conf.SessionName)
+	if err != nil {
+		return err
+	}
+	attempts, _ := s.Values["pendingAttempts"].(int)
+	s.Values["pendingAttempts"] = attempts + 1
+	return s.Save(r, w)
+}
+
+// SetChallenge keeps the state of a WebAuthn ceremony between its begin
+// and finish requests.
+func SetChallenge(w http.ResponseWriter, r *http.Request, purpose, state string) error {
+	s, err := store.Get(r, conf.SessionName)
+	if err != nil {
+		return err
+	}
+	s.Values["challenge:"+purpose] = state
+	return s.Save(r, w)
+}
+
+// TakeChallenge returns and removes the ceremony state, so each challenge
+// can only be answered once.
+func TakeChallenge(w http.ResponseWriter, r *http.Request, purpose string) (string, error) {
+	s, err := store.Get(r, conf.SessionName)
+	if err != nil {
+		return "", err
+	}
+	state, ok := s.Values["challenge:"+purpose].(string)
+	if !ok {
+		return "", NoSessionError{}
+	}
+	delete(s.Values, "challenge:"+purpose)
+	return state, s.Save(r, w)
+}
+
+// CSRFToken returns the session's CSRF token, creating it if needed. It
+// must be called before anything is written to w.
+func CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	// a cookie that can't be decoded gets replaced by a fresh session, so
+	// the login page keeps working after a key change
+	s, _ := store.Get(r, conf.SessionName)
+	if token, ok := s.Values["csrf"].(string); ok {
+		return token, nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	s.Values["csrf"] = token
+	return token, s.Save(r, w)
+}
+
+// CheckCSRFToken reports whether token is the session's CSRF token.
+func CheckCSRFToken(r *http.Request, token string) bool {
+	s, err := store.Get(r, conf.SessionName)
+	if err != nil {
+		return false
+	}
+	expected, ok := s.Values["csrf"].(string)
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
@@ -0,0 +1,100 @@
+package session
+
+import (
+	"database/sql"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Times are kept as unix nanoseconds so the sweeper can compare them in SQL.
+type sqliteBackend struct {
+	db *sql.DB
+}
+
+func newSqliteBackend(path string) (*sqliteBackend, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		key TEXT PRIMARY KEY,
+		data BLOB NOT NULL,
+		created INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		expires INTEGER NOT NULL,
+		user_id TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS sessions_expires ON sessions (expires);
+	CREATE INDEX IF NOT EXISTS sessions_user_id ON sessions (user_id);`)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteBackend{db: db}, nil
+}
+
+const sessionColumns = `data, created, last_seen, expires, user_id, ip, user_agent`
+
+func scanRecord(row interface{ Scan(...interface{}) error }, dest ...interface{}) (Record, error) {
+	var (
+		rec                    Record
+		created, seen, expires int64
+	)
+	dest = append(dest, &rec.Values, &created, &seen, &expires, &rec.UserID, &rec.IP, &rec.UserAgent)
+	if err := row.Scan(dest...); err != nil {
+		if err == sql.ErrNoRows {
+			return Record{}, notFoundError{}
+		}
+		return Record{}, err
+	}
+	rec.Created = time.Unix(0, created)
+	rec.LastSeen = time.Unix(0, seen)
+	rec.Expires = time.Unix(0, expires)
+	return rec, nil
+}
+
+func (s *sqliteBackend) Load(key string) (Record, error) {
+	return scanRecord(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE key = ?`, key))
+}
+
+func (s *sqliteBackend) Save(key string, rec Record) error {
+	_, err := s.db.Exec(`INSERT INTO sessions (key, `+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET data = excluded.data, created = excluded.created,
+			last_seen = excluded.last_seen, expires = excluded.expires, user_id = excluded.user_id,
+			ip = excluded.ip, user_agent = excluded.user_agent`,
+		key, rec.Values, rec.Created.UnixNano(), rec.LastSeen.UnixNano(), rec.Expires.UnixNano(),
+		rec.UserID, rec.IP, rec.UserAgent)
+	return err
+}
+
+func (s *sqliteBackend) Delete(key string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE key = ?`, key)
+	return err
+}
+
+func (s *sqliteBackend) DeleteExpired(now time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE expires <= ?`, now.UnixNano())
+	return err
+}
+
+func (s *sqliteBackend) List(userID string) (map[string]Record, error) {
+	rows, err := s.db.Query(`SELECT key, `+sessionColumns+` FROM sessions WHERE user_id = ? AND expires > ?`,
+		userID, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := map[string]Record{}
+	for rows.Next() {
+		var key string
+		rec, err := scanRecord(rows, &key)
+		if err != nil {
+			return nil, err
+		}
+		list[key] = rec
+	}
+	return list, rows.Err()
+}
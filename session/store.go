@@ -0,0 +1,206 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// touchInterval limits how often a read-only request writes back to the
+// backend just to move the idle timeout along.
+const touchInterval = time.Minute
+
+// ClientIP gives the address recorded against a session. The server swaps
+// in its own so that a trusted proxy's X-Forwarded-For is honoured.
+var ClientIP = func(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// serverStore is a sessions.Store whose cookie carries only a signed session
+// ID; the values live in a Backend.
+type serverStore struct {
+	backend Backend
+	codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+func newServerStore(backend Backend, keyPairs ...[]byte) *serverStore {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, c := range codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(int(conf.SessionAbsoluteTimeout.Seconds()))
+		}
+	}
+	return &serverStore{
+		backend: backend,
+		codecs:  codecs,
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: int(conf.SessionAbsoluteTimeout.Seconds()),
+		},
+	}
+}
+
+func (s *serverStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the request's cookie. A missing, expired
+// or unreadable session gives a new, empty one.
+func (s *serverStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, c.Value, &id, s.codecs...); err != nil {
+		return session, err
+	}
+
+	key := backendKey(id)
+	rec, err := s.backend.Load(key)
+	if _, ok := err.(notFoundError); ok {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	now := time.Now()
+	if rec.expired(now) {
+		return session, s.backend.Delete(key)
+	}
+	if err := decodeValues(rec.Values, &session.Values); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+
+	if now.Sub(rec.LastSeen) > touchInterval {
+		rec.LastSeen = now
+		rec.IP = ClientIP(r)
+		rec.UserAgent = r.UserAgent()
+		rec.Expires = expiry(rec.Created, now)
+		if err := s.backend.Save(key, rec); err != nil {
+			return session, err
+		}
+	}
+	return session, nil
+}
+
+// Save writes the session to the backend, or deletes it if MaxAge is
+// negative. A session with no ID is given a new one, which is how logins
+// rotate the ID.
+func (s *serverStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.Delete(backendKey(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now()
+	created, ok := session.Values["created"].(int64)
+	if !ok {
+		created = now.Unix()
+		session.Values["created"] = created
+	}
+	if session.ID == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+
+	values, err := encodeValues(session.Values)
+	if err != nil {
+		return err
+	}
+	userID, _ := session.Values["id"].(string)
+	rec := Record{
+		Values:    values,
+		Created:   time.Unix(created, 0),
+		LastSeen:  now,
+		UserID:    userID,
+		IP:        ClientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	rec.Expires = expiry(rec.Created, now)
+	if err := s.backend.Save(backendKey(session.ID), rec); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// expiry is whichever of the idle and absolute timeouts comes first.
+func expiry(created, lastSeen time.Time) time.Time {
+	idle := lastSeen.Add(conf.SessionIdleTimeout)
+	absolute := created.Add(conf.SessionAbsoluteTimeout)
+	if idle.Before(absolute) {
+		return idle
+	}
+	return absolute
+}
+
+// sweep deletes the sessions expired at each tick until tick is closed.
+func (s *serverStore) sweep(tick <-chan time.Time) {
+	for now := range tick {
+		if err := s.backend.DeleteExpired(now); err != nil {
+			log.Printf("error sweeping expired sessions: %v\n", err)
+		}
+	}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// backendKey hashes the session ID so that read access to the backend
+// isn't enough to hijack a session.
+func backendKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+func encodeValues(values map[interface{}]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeValues(data []byte, values *map[interface{}]interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(values)
+}
@@ -0,0 +1,287 @@
+package session
+
+import (
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/mthorning/go-sso/types"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withConf changes the configuration for the rest of the test.
+func withConf(t *testing.T, change func(c *Config)) {
+	old := conf
+	t.Cleanup(func() { conf = old })
+	change(&conf)
+}
+
+// testBackends are the backends kept by this process, each empty.
+func testBackends(t *testing.T) map[string]Backend {
+	sqlite, err := newSqliteBackend(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.db.Close() })
+	return map[string]Backend{
+		"memory": newMemoryBackend(),
+		"sqlite": sqlite,
+	}
+}
+
+// useStore replaces the sessions' store with one on backend for the rest of
+// the test.
+func useStore(t *testing.T, backend Backend) *serverStore {
+	old := store
+	t.Cleanup(func() { store = old })
+	store = newServerStore(backend, []byte("test session key"))
+	return store
+}
+
+func request(cookies []*http.Cookie) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+// sessionID returns the ID held in the session cookie among cookies.
+func sessionID(t *testing.T, s *serverStore, cookies []*http.Cookie) string {
+	for _, c := range cookies {
+		if c.Name != conf.SessionName {
+			continue
+		}
+		var id string
+		if err := securecookie.DecodeMulti(c.Name, c.Value, &id, s.codecs...); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	t.Fatal("no session cookie")
+	return ""
+}
+
+func TestExpiry(t *testing.T) {
+	withConf(t, func(c *Config) {
+		c.SessionIdleTimeout = time.Hour
+		c.SessionAbsoluteTimeout = 24 * time.Hour
+	})
+	created := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		lastSeen time.Duration
+		want     time.Duration
+	}{
+		{"just created", 0, time.Hour},
+		{"idle timeout first", 10 * time.Hour, 11 * time.Hour},
+		{"absolute timeout first", 23*time.Hour + 30*time.Minute, 24 * time.Hour},
+		{"past the absolute timeout", 30 * time.Hour, 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expiry(created, created.Add(tt.lastSeen)); !got.Equal(created.Add(tt.want)) {
+				t.Errorf("got %s after creation, want %s", got.Sub(created), tt.want)
+			}
+		})
+	}
+}
+
+func TestServerStoreExpiry(t *testing.T) {
+	withConf(t, func(c *Config) {
+		c.SessionIdleTimeout = time.Hour
+		c.SessionAbsoluteTimeout = 24 * time.Hour
+	})
+
+	tests := []struct {
+		name string
+		// created and lastSeen are how long before now the session was
+		// created and last used
+		created, lastSeen time.Duration
+		wantLoaded        bool
+	}{
+		{"active", 2 * time.Hour, 2 * time.Minute, true},
+		{"idle", 2 * time.Hour, 2 * time.Hour, false},
+		{"active past the absolute timeout", 25 * time.Hour, 2 * time.Minute, false},
+		{"active near the absolute timeout", 24*time.Hour - 30*time.Minute, 2 * time.Minute, true},
+	}
+	for name, backend := range testBackends(t) {
+		s := newServerStore(backend, []byte("test session key"))
+		for _, tt := range tests {
+			t.Run(name+" "+tt.name, func(t *testing.T) {
+				res := httptest.NewRecorder()
+				session := sessions.NewSession(s, conf.SessionName)
+				session.Options = &sessions.Options{Path: "/"}
+				session.Values["id"] = "user"
+				if err := s.Save(request(nil), res, session); err != nil {
+					t.Fatal(err)
+				}
+				cookies := res.Result().Cookies()
+				key := backendKey(sessionID(t, s, cookies))
+
+				// as if it had been saved by the last request
+				rec, err := backend.Load(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				now := time.Now()
+				rec.Created, rec.LastSeen = now.Add(-tt.created), now.Add(-tt.lastSeen)
+				rec.Expires = expiry(rec.Created, rec.LastSeen)
+				if err := backend.Save(key, rec); err != nil {
+					t.Fatal(err)
+				}
+
+				loaded, err := s.New(request(cookies), conf.SessionName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := !loaded.IsNew && loaded.Values["id"] == "user"; got != tt.wantLoaded {
+					t.Fatalf("loaded = %v, want %v", got, tt.wantLoaded)
+				}
+
+				touched, err := backend.Load(key)
+				if !tt.wantLoaded {
+					if _, ok := err.(notFoundError); !ok {
+						t.Errorf("expired session left in the backend: %v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if touched.LastSeen.Before(now) {
+					t.Errorf("last seen %s ago, want it moved along", time.Since(touched.LastSeen))
+				}
+				if want := expiry(rec.Created, touched.LastSeen); !touched.Expires.Equal(want) {
+					t.Errorf("expires %s, want %s", touched.Expires, want)
+				}
+			})
+		}
+	}
+}
+
+func TestSetSessionRotatesID(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := useStore(t, backend)
+
+			// a visitor given a session before signing in
+			res := httptest.NewRecorder()
+			if _, err := CSRFToken(res, request(nil)); err != nil {
+				t.Fatal(err)
+			}
+			before := res.Result().Cookies()
+			oldID := sessionID(t, s, before)
+
+			res = httptest.NewRecorder()
+			if err := SetSession(res, request(before), &types.DBUser{ID: "user"}); err != nil {
+				t.Fatal(err)
+			}
+			after := res.Result().Cookies()
+			newID := sessionID(t, s, after)
+
+			if newID == oldID {
+				t.Fatal("session ID not changed")
+			}
+			if _, err := backend.Load(backendKey(oldID)); err != (notFoundError{}) {
+				t.Errorf("old session still in the backend: %v", err)
+			}
+			signedIn, err := s.New(request(after), conf.SessionName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signedIn.Values["id"] != "user" {
+				t.Errorf("new session values %v", signedIn.Values)
+			}
+			if _, ok := signedIn.Values["csrf"]; ok {
+				t.Error("CSRF token carried over from before signing in")
+			}
+			// whoever planted the old ID gets nothing
+			if _, err := GetSession(httptest.NewRecorder(), request(before)); err != (NoSessionError{}) {
+				t.Errorf("old cookie: got %v, want NoSessionError", err)
+			}
+		})
+	}
+}
+
+func TestSweep(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := newServerStore(backend, []byte("test session key"))
+			if err := backend.Save("expired", testRecord("user", -time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Save("active", testRecord("user", time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+
+			tick := make(chan time.Time)
+			done := make(chan struct{})
+			go func() {
+				s.sweep(tick)
+				close(done)
+			}()
+			tick <- time.Now()
+			close(tick)
+			<-done
+
+			if _, err := backend.Load("expired"); err != (notFoundError{}) {
+				t.Errorf("expired session: got %v, want notFoundError", err)
+			}
+			if _, err := backend.Load("active"); err != nil {
+				t.Errorf("active session: %v", err)
+			}
+		})
+	}
+}
+
+func TestBackend(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := backend.Load("missing"); err != (notFoundError{}) {
+				t.Fatalf("Load of a missing key: got %v, want notFoundError", err)
+			}
+
+			rec := testRecord("user", time.Minute)
+			rec.IP, rec.UserAgent = "192.0.2.1", "test agent"
+			for _, key := range []string{"a", "b", "c", "expired"} {
+				if err := backend.Save(key, rec); err != nil {
+					t.Fatalf("Save(%s): %v", key, err)
+				}
+			}
+			got, err := backend.Load("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Values) != string(rec.Values) || !got.Created.Equal(rec.Created) || !got.LastSeen.Equal(rec.LastSeen) ||
+				!got.Expires.Equal(rec.Expires) || got.UserID != rec.UserID || got.IP != rec.IP || got.UserAgent != rec.UserAgent {
+				t.Errorf("Load = %+v, want %+v", got, rec)
+			}
+
+			if err := backend.Delete("b"); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Delete("b"); err != nil {
+				t.Fatalf("Delete of a missing key: %v", err)
+			}
+			// c has since been given to someone else
+			if err := backend.Save("c", testRecord("other", time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Save("expired", testRecord("user", -time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			list, err := backend.List("user")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := list["a"]; len(list) != 1 || !ok {
+				t.Errorf("List = %v, want only a", list)
+			}
+		})
+	}
+}
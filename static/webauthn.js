@@ -0,0 +1,80 @@
+// The WebAuthn API works in ArrayBuffers, the server in base64url strings.
+function bufferFromBase64url(s) {
+  s = s.replace(/-/g, "+").replace(/_/g, "/");
+  var bin = atob(s + "===".slice((s.length + 3) % 4));
+  return Uint8Array.from(bin, function (c) { return c.charCodeAt(0); }).buffer;
+}
+
+function base64urlFromBuffer(buf) {
+  var bin = String.fromCharCode.apply(null, new Uint8Array(buf));
+  return btoa(bin).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function postJSON(url, body) {
+  var headers = { "X-CSRF-Token": document.querySelector('meta[name="csrf-token"]').content };
+  if (!(body instanceof URLSearchParams)) headers["Content-Type"] = "application/json";
+  return fetch(url, {
+    method: "POST",
+    credentials: "same-origin",
+    headers: headers,
+    body: body instanceof URLSearchParams ? body : JSON.stringify(body),
+  }).then(function (res) {
+    return res.json().then(function (data) {
+      if (!res.ok) throw new Error(data.message);
+      return data;
+    });
+  });
+}
+
+function registerPasskey(name) {
+  return postJSON("/passkeys/begin", new URLSearchParams())
+    .then(function (options) {
+      var pk = options.publicKey;
+      pk.challenge = bufferFromBase64url(pk.challenge);
+      pk.user.id = bufferFromBase64url(pk.user.id);
+      (pk.excludeCredentials || []).forEach(function (c) { c.id = bufferFromBase64url(c.id); });
+      return navigator.credentials.create(options);
+    })
+    .then(function (cred) {
+      return postJSON("/passkeys/finish?name=" + encodeURIComponent(name), {
+        id: cred.id,
+        rawId: base64urlFromBuffer(cred.rawId),
+        type: cred.type,
+        response: {
+          attestationObject: base64urlFromBuffer(cred.response.attestationObject),
+          clientDataJSON: base64urlFromBuffer(cred.response.clientDataJSON),
+        },
+      });
+    });
+}
+
+// signInWithPasskey uses the passkey instead of a password when email is
+// given, or as the second factor of a login already in progress.
+function signInWithPasskey(email, next) {
+  var form = new URLSearchParams();
+  if (email) form.set("email", email);
+  return postJSON("/login/passkey/begin", form)
+    .then(function (options) {
+      var pk = options.publicKey;
+      pk.challenge = bufferFromBase64url(pk.challenge);
+      (pk.allowCredentials || []).forEach(function (c) { c.id = bufferFromBase64url(c.id); });
+      return navigator.credentials.get(options);
+    })
+    .then(function (cred) {
+      return postJSON("/login/passkey/finish?next=" + encodeURIComponent(next || ""), {
+        id: cred.id,
+        rawId: base64urlFromBuffer(cred.rawId),
+        type: cred.type,
+        response: {
+          authenticatorData: base64urlFromBuffer(cred.response.authenticatorData),
+          clientDataJSON: base64urlFromBuffer(cred.response.clientDataJSON),
+          signature: base64urlFromBuffer(cred.response.signature),
+          userHandle: cred.response.userHandle ? base64urlFromBuffer(cred.response.userHandle) : null,
+        },
+      });
+    });
+}
+
+function showError(el, err) {
+  el.textContent = err.message;
+}
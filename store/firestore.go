@@ -0,0 +1,248 @@
+package store
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	firebase "firebase.google.com/go/v4"
+	"github.com/mthorning/go-sso/types"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"reflect"
+)
+
+type firestoreUsers struct {
+	client *firestore.Client
+	users  *firestore.CollectionRef
+}
+
+func newFirestoreClient(credentials string) (*firestore.Client, error) {
+	if credentials == "" {
+		return nil, errors.New("SSO_GOOGLE_APPLICATION_CREDENTIALS is required for the firestore store")
+	}
+
+	ctx := context.Background()
+	sa := option.WithCredentialsFile(credentials)
+
+	app, err := firebase.NewApp(ctx, nil, sa)
+	if err != nil {
+		return nil, err
+	}
+	return app.Firestore(ctx)
+}
+
+func firestoreError(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return NotFoundError{}
+	}
+	return err
+}
+
+func docToUser(doc *firestore.DocumentSnapshot) (types.DBUser, error) {
+	var user types.DBUser
+	if err := doc.DataTo(&user); err != nil {
+		return types.DBUser{}, err
+	}
+	user.ID = doc.Ref.ID
+	return user, nil
+}
+
+func (f *firestoreUsers) Get(id string) (types.DBUser, error) {
+	doc, err := f.users.Doc(id).Get(context.Background())
+	if err != nil {
+		return types.DBUser{}, firestoreError(err)
+	}
+	return docToUser(doc)
+}
+
+func (f *firestoreUsers) FindByEmail(email string) (types.DBUser, error) {
+	iter := f.users.Where("Email", "==", email).Documents(context.Background())
+	defer iter.Stop()
+	doc, err := iter.Next()
+	if err == iterator.Done {
+		return types.DBUser{}, NotFoundError{}
+	}
+	if err != nil {
+		return types.DBUser{}, err
+	}
+	return docToUser(doc)
+}
+
+func (f *firestoreUsers) Create(user types.DBUser) (string, error) {
+	ref, _, err := f.users.Add(context.Background(), user)
+	if err != nil {
+		return "", err
+	}
+	return ref.ID, nil
+}
+
+func firestoreUpdates(updates []Update) []firestore.Update {
+	fu := make([]firestore.Update, len(updates))
+	for i, u := range updates {
+		fu[i] = firestore.Update{Path: u.Path, Value: u.Value}
+	}
+	return fu
+}
+
+func (f *firestoreUsers) Update(id string, updates ...Update) error {
+	_, err := f.users.Doc(id).Update(context.Background(), firestoreUpdates(updates))
+	return firestoreError(err)
+}
+
+// UpdateIf runs in a transaction, which Firestore retries if any document it
+// read has changed by the time it commits.
+func (f *firestoreUsers) UpdateIf(id string, check Condition, updates ...Update) error {
+	ref := f.users.Doc(id)
+	err := f.client.RunTransaction(context.Background(), func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		user, err := docToUser(doc)
+		if err != nil {
+			return err
+		}
+		if check != nil {
+			list := func() ([]types.DBUser, error) {
+				return docsToUsers(tx.Documents(f.users.OrderBy("Created", firestore.Asc)).GetAll())
+			}
+			if err := check(user, list); err != nil {
+				return err
+			}
+		}
+		return tx.Update(ref, firestoreUpdates(updates))
+	})
+	return firestoreError(err)
+}
+
+func (f *firestoreUsers) List() ([]types.DBUser, error) {
+	return docsToUsers(f.users.OrderBy("Created", firestore.Asc).Documents(context.Background()).GetAll())
+}
+
+func docsToUsers(docs []*firestore.DocumentSnapshot, err error) ([]types.DBUser, error) {
+	if err != nil {
+		return nil, err
+	}
+	users := make([]types.DBUser, 0, len(docs))
+	for _, doc := range docs {
+		user, err := docToUser(doc)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (f *firestoreUsers) Delete(id string) error {
+	_, err := f.users.Doc(id).Delete(context.Background(), firestore.Exists)
+	return firestoreError(err)
+}
+
+type firestoreCollection struct {
+	client *firestore.Client
+	ref    *firestore.CollectionRef
+}
+
+type firestoreDocument struct {
+	doc *firestore.DocumentSnapshot
+}
+
+func (d firestoreDocument) ID() string {
+	return d.doc.Ref.ID
+}
+
+func (d firestoreDocument) DataTo(v interface{}) error {
+	return d.doc.DataTo(v)
+}
+
+func (f *firestoreCollection) Get(id string, v interface{}) error {
+	doc, err := f.ref.Doc(id).Get(context.Background())
+	if err != nil {
+		return firestoreError(err)
+	}
+	return doc.DataTo(v)
+}
+
+func (f *firestoreCollection) Set(id string, v interface{}) error {
+	_, err := f.ref.Doc(id).Set(context.Background(), v)
+	return err
+}
+
+// Update may run change more than once, as the transaction is retried
+// when the document is written in between. Each attempt starts again from
+// a fresh read, or from v as it was passed in if there is no document.
+func (f *firestoreCollection) Update(id string, v interface{}, change func() error) error {
+	ref := f.ref.Doc(id)
+	target := reflect.ValueOf(v).Elem()
+	initial := reflect.New(target.Type()).Elem()
+	initial.Set(target)
+	return f.client.RunTransaction(context.Background(), func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		fresh := reflect.New(target.Type())
+		if err == nil {
+			if err := doc.DataTo(fresh.Interface()); err != nil {
+				return err
+			}
+		} else {
+			fresh.Elem().Set(initial)
+		}
+		target.Set(fresh.Elem())
+		if err := change(); err != nil {
+			return err
+		}
+		return tx.Set(ref, v)
+	})
+}
+
+func (f *firestoreCollection) Delete(id string) error {
+	_, err := f.ref.Doc(id).Delete(context.Background(), firestore.Exists)
+	return firestoreError(err)
+}
+
+func (f *firestoreCollection) documents(q firestore.Query) ([]Document, error) {
+	snaps, err := q.Documents(context.Background()).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]Document, len(snaps))
+	for i, snap := range snaps {
+		docs[i] = firestoreDocument{doc: snap}
+	}
+	return docs, nil
+}
+
+func (f *firestoreCollection) List() ([]Document, error) {
+	return f.Find(Query{})
+}
+
+func (f *firestoreCollection) Where(field, value string) ([]Document, error) {
+	return f.Find(Query{Equal: map[string]string{field: value}})
+}
+
+func (f *firestoreCollection) Find(q Query) ([]Document, error) {
+	query := f.ref.Query
+	for field, value := range q.Equal {
+		query = query.Where(field, "==", value)
+	}
+	if q.From != "" {
+		query = query.Where(firestore.DocumentID, ">=", f.ref.Doc(q.From))
+	}
+	if q.To != "" {
+		query = query.Where(firestore.DocumentID, "<", f.ref.Doc(q.To))
+	}
+	dir := firestore.Asc
+	if q.Descending {
+		dir = firestore.Desc
+	}
+	query = query.OrderBy(firestore.DocumentID, dir)
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+	return f.documents(query)
+}
@@ -0,0 +1,214 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/mthorning/go-sso/types"
+	"github.com/nu7hatch/gouuid"
+	"sort"
+	"sync"
+)
+
+type memoryUsers struct {
+	mu    sync.RWMutex
+	users map[string]types.DBUser
+}
+
+func newMemoryUsers() *memoryUsers {
+	return &memoryUsers{users: map[string]types.DBUser{}}
+}
+
+func (m *memoryUsers) Get(id string) (types.DBUser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.users[id]
+	if !ok {
+		return types.DBUser{}, NotFoundError{}
+	}
+	return user, nil
+}
+
+func (m *memoryUsers) FindByEmail(email string) (types.DBUser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, user := range m.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return types.DBUser{}, NotFoundError{}
+}
+
+func (m *memoryUsers) Create(user types.DBUser) (string, error) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	user.ID = u.String()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[user.ID] = user
+	return user.ID, nil
+}
+
+func (m *memoryUsers) Update(id string, updates ...Update) error {
+	return m.UpdateIf(id, nil, updates...)
+}
+
+func (m *memoryUsers) UpdateIf(id string, check Condition, updates ...Update) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[id]
+	if !ok {
+		return NotFoundError{}
+	}
+	if check != nil {
+		if err := check(user, m.list); err != nil {
+			return err
+		}
+	}
+	if err := applyUpdates(&user, updates); err != nil {
+		return err
+	}
+	m.users[id] = user
+	return nil
+}
+
+func (m *memoryUsers) List() ([]types.DBUser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.list()
+}
+
+// list must be called with mu held.
+func (m *memoryUsers) list() ([]types.DBUser, error) {
+	users := make([]types.DBUser, 0, len(m.users))
+	for _, user := range m.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Created.Before(users[j].Created)
+	})
+	return users, nil
+}
+
+func (m *memoryUsers) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[id]; !ok {
+		return NotFoundError{}
+	}
+	delete(m.users, id)
+	return nil
+}
+
+func memoryCollections() func(name string) Collection {
+	var mu sync.Mutex
+	collections := map[string]*memoryCollection{}
+	return func(name string) Collection {
+		mu.Lock()
+		defer mu.Unlock()
+		c, ok := collections[name]
+		if !ok {
+			c = &memoryCollection{docs: map[string][]byte{}}
+			collections[name] = c
+		}
+		return c
+	}
+}
+
+// Documents are held as JSON so callers never share memory with the store,
+// the same as they wouldn't with a real database.
+type memoryCollection struct {
+	mu   sync.RWMutex
+	docs map[string][]byte
+}
+
+func (m *memoryCollection) Get(id string, v interface{}) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok := m.docs[id]
+	if !ok {
+		return NotFoundError{}
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (m *memoryCollection) Set(id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.docs[id] = data
+	return nil
+}
+
+func (m *memoryCollection) Update(id string, v interface{}, change func() error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.docs[id]
+	if ok {
+		if err := json.Unmarshal(data, v); err != nil {
+			return err
+		}
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.docs[id] = data
+	return nil
+}
+
+func (m *memoryCollection) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.docs[id]; !ok {
+		return NotFoundError{}
+	}
+	delete(m.docs, id)
+	return nil
+}
+
+func (m *memoryCollection) List() ([]Document, error) {
+	return m.Find(Query{})
+}
+
+func (m *memoryCollection) Where(field, value string) ([]Document, error) {
+	return m.Find(Query{Equal: map[string]string{field: value}})
+}
+
+func (m *memoryCollection) Find(q Query) ([]Document, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0, len(m.docs))
+	for id := range m.docs {
+		if q.matchID(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return (ids[i] < ids[j]) != q.Descending
+	})
+
+	var docs []Document
+	for _, id := range ids {
+		if q.Limit > 0 && len(docs) == q.Limit {
+			break
+		}
+		doc := jsonDocument{id: id, data: m.docs[id]}
+		ok, err := q.matchFields(doc)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
@@ -0,0 +1,310 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/mthorning/go-sso/types"
+	"github.com/nu7hatch/gouuid"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Users are stored as JSON documents so that new fields on types.DBUser
+// don't need a schema migration; only the columns we query on are split out.
+type sqliteUsers struct {
+	db *sql.DB
+}
+
+func openSqlite(path string) (*sql.DB, error) {
+	// transactions take the write lock up front, so that a read made inside
+	// one can't be changed by another connection before it commits
+	dsn := path + "?_txlock=immediate&_busy_timeout=5000"
+	if strings.Contains(path, "?") {
+		dsn = path + "&_txlock=immediate&_busy_timeout=5000"
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		created DATETIME NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS users_email ON users (email);
+	CREATE TABLE IF NOT EXISTS documents (
+		collection TEXT NOT NULL,
+		id TEXT NOT NULL,
+		data TEXT NOT NULL,
+		PRIMARY KEY (collection, id)
+	);`)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func scanUser(row interface{ Scan(...interface{}) error }) (types.DBUser, error) {
+	var id, data string
+	if err := row.Scan(&id, &data); err != nil {
+		if err == sql.ErrNoRows {
+			return types.DBUser{}, NotFoundError{}
+		}
+		return types.DBUser{}, err
+	}
+	var user types.DBUser
+	if err := json.Unmarshal([]byte(data), &user); err != nil {
+		return types.DBUser{}, err
+	}
+	user.ID = id
+	return user, nil
+}
+
+func (s *sqliteUsers) Get(id string) (types.DBUser, error) {
+	return scanUser(s.db.QueryRow(`SELECT id, data FROM users WHERE id = ?`, id))
+}
+
+func (s *sqliteUsers) FindByEmail(email string) (types.DBUser, error) {
+	return scanUser(s.db.QueryRow(`SELECT id, data FROM users WHERE email = ? LIMIT 1`, email))
+}
+
+func (s *sqliteUsers) Create(user types.DBUser) (string, error) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	user.ID = u.String()
+
+	data, err := json.Marshal(user)
+	if err != nil {
+		return "", err
+	}
+	_, err = s.db.Exec(`INSERT INTO users (id, email, created, data) VALUES (?, ?, ?, ?)`,
+		user.ID, user.Email, user.Created, string(data))
+	if err != nil {
+		return "", err
+	}
+	return user.ID, nil
+}
+
+func (s *sqliteUsers) Update(id string, updates ...Update) error {
+	return s.UpdateIf(id, nil, updates...)
+}
+
+func (s *sqliteUsers) UpdateIf(id string, check Condition, updates ...Update) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow(`SELECT id, data FROM users WHERE id = ?`, id))
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		list := func() ([]types.DBUser, error) {
+			return listUsers(tx)
+		}
+		if err := check(user, list); err != nil {
+			return err
+		}
+	}
+	if err := applyUpdates(&user, updates); err != nil {
+		return err
+	}
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE users SET email = ?, data = ? WHERE id = ?`, user.Email, string(data), id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteUsers) List() ([]types.DBUser, error) {
+	return listUsers(s.db)
+}
+
+func listUsers(db interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}) ([]types.DBUser, error) {
+	rows, err := db.Query(`SELECT id, data FROM users ORDER BY created`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []types.DBUser
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqliteUsers) Delete(id string) error {
+	res, err := s.db.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return NotFoundError{}
+	}
+	return nil
+}
+
+type sqliteCollection struct {
+	db   *sql.DB
+	name string
+}
+
+type jsonDocument struct {
+	id   string
+	data []byte
+}
+
+func (d jsonDocument) ID() string {
+	return d.id
+}
+
+func (d jsonDocument) DataTo(v interface{}) error {
+	return json.Unmarshal(d.data, v)
+}
+
+func (s *sqliteCollection) Get(id string, v interface{}) error {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM documents WHERE collection = ? AND id = ?`, s.name, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return NotFoundError{}
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+func (s *sqliteCollection) Set(id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO documents (collection, id, data) VALUES (?, ?, ?)
+		ON CONFLICT (collection, id) DO UPDATE SET data = excluded.data`, s.name, id, string(data))
+	return err
+}
+
+func (s *sqliteCollection) Update(id string, v interface{}, change func() error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var data string
+	err = tx.QueryRow(`SELECT data FROM documents WHERE collection = ? AND id = ?`, s.name, id).Scan(&data)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal([]byte(data), v); err != nil {
+			return err
+		}
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	changed, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO documents (collection, id, data) VALUES (?, ?, ?)
+		ON CONFLICT (collection, id) DO UPDATE SET data = excluded.data`, s.name, id, string(changed))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteCollection) Delete(id string) error {
+	res, err := s.db.Exec(`DELETE FROM documents WHERE collection = ? AND id = ?`, s.name, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return NotFoundError{}
+	}
+	return nil
+}
+
+func (s *sqliteCollection) List() ([]Document, error) {
+	return s.Find(Query{})
+}
+
+func (s *sqliteCollection) Where(field, value string) ([]Document, error) {
+	return s.Find(Query{Equal: map[string]string{field: value}})
+}
+
+// Find narrows by ID and orders in SQL, then reads rows only until it has
+// enough that match. Fields are filtered in Go rather than with
+// json_extract, as the JSON1 extension isn't compiled into the driver by
+// default.
+func (s *sqliteCollection) Find(q Query) ([]Document, error) {
+	query := `SELECT id, data FROM documents WHERE collection = ?`
+	args := []interface{}{s.name}
+	if q.From != "" {
+		query += ` AND id >= ?`
+		args = append(args, q.From)
+	}
+	if q.To != "" {
+		query += ` AND id < ?`
+		args = append(args, q.To)
+	}
+	if q.Descending {
+		query += ` ORDER BY id DESC`
+	} else {
+		query += ` ORDER BY id`
+	}
+	if q.Limit > 0 && len(q.Equal) == 0 {
+		query += ` LIMIT ` + strconv.Itoa(q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var docs []Document
+	for rows.Next() && (q.Limit <= 0 || len(docs) < q.Limit) {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		doc := jsonDocument{id: id, data: []byte(data)}
+		ok, err := q.matchFields(doc)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, rows.Err()
+}
@@ -0,0 +1,317 @@
+package store
+
+import (
+	"cloud.google.com/go/firestore"
+	"database/sql"
+	"fmt"
+	"github.com/mthorning/go-sso/config"
+	"github.com/mthorning/go-sso/types"
+	"reflect"
+)
+
+type Config struct {
+	Store                        string `default:"firestore"`
+	SqlitePath                   string `default:"go-sso.db" split_words:"true"`
+	GoogleApplicationCredentials string `split_words:"true"`
+}
+
+type Update struct {
+	Path  string
+	Value interface{}
+}
+
+// Condition decides whether an UpdateIf goes ahead, returning an error to
+// stop it. It is given the user as stored and, for conditions that depend
+// on other users, a way to list every user inside the same transaction.
+type Condition func(user types.DBUser, list func() ([]types.DBUser, error)) error
+
+type UserStore interface {
+	Get(id string) (types.DBUser, error)
+	FindByEmail(email string) (types.DBUser, error)
+	Create(user types.DBUser) (string, error)
+	Update(id string, updates ...Update) error
+	// UpdateIf applies updates only if check returns nil, which it returns.
+	// No other write to users can come between the check and the update.
+	UpdateIf(id string, check Condition, updates ...Update) error
+	List() ([]types.DBUser, error)
+	Delete(id string) error
+}
+
+// Collection is a schemaless set of documents keyed by ID, used for
+// everything that isn't a user record.
+type Collection interface {
+	Get(id string, v interface{}) error
+	Set(id string, v interface{}) error
+	// Update reads the document into v, leaving v alone if there isn't one,
+	// and stores v again once change has modified it. Nothing else can
+	// write the document in between. If change returns an error nothing is
+	// stored and Update returns it.
+	Update(id string, v interface{}, change func() error) error
+	Delete(id string) error
+	// List, Where and Find return documents in order of their IDs, the one
+	// order every backend can give.
+	List() ([]Document, error)
+	Where(field, value string) ([]Document, error)
+	Find(q Query) ([]Document, error)
+}
+
+// Query selects documents for Find.
+type Query struct {
+	// Equal holds string fields that must have exactly the given value.
+	Equal map[string]string
+	// From and To bound the IDs returned. From is inclusive, To is
+	// exclusive, and either can be left empty.
+	From, To   string
+	Descending bool
+	// Limit is the most documents returned; zero returns them all.
+	Limit int
+}
+
+type Document interface {
+	ID() string
+	DataTo(v interface{}) error
+}
+
+type NotFoundError struct{}
+
+func (e NotFoundError) Error() string {
+	return "Record not found"
+}
+
+var (
+	conf        Config
+	Users       UserStore
+	collections func(name string) Collection
+	changeHooks []func(id string)
+	openErr     error
+)
+
+func init() {
+	config.SetConfig(&conf)
+	if err := openBackend(conf.Store); err != nil {
+		openErr = fmt.Errorf("error initializing store: %v", err)
+		Users = unavailableUsers{openErr}
+		collections = func(name string) Collection {
+			return unavailableCollection{openErr}
+		}
+	}
+	Users = notifyingUsers{Users}
+}
+
+// Err reports why the configured store couldn't be opened. Importing the
+// package doesn't exit on failure, so main must check this before serving;
+// until then every call returns the same error.
+func Err() error {
+	return openErr
+}
+
+// UseMemory replaces the configured store with an empty in-memory one, for
+// tests.
+func UseMemory() {
+	Users = notifyingUsers{newMemoryUsers()}
+	collections = memoryCollections()
+	openErr = nil
+}
+
+func openBackend(name string) error {
+	var err error
+	switch name {
+	case "firestore":
+		var client *firestore.Client
+		client, err = newFirestoreClient(conf.GoogleApplicationCredentials)
+		if err == nil {
+			Users = &firestoreUsers{client: client, users: client.Collection("users")}
+			collections = func(name string) Collection {
+				return &firestoreCollection{client: client, ref: client.Collection(name)}
+			}
+		}
+	case "sqlite":
+		var db *sql.DB
+		db, err = openSqlite(conf.SqlitePath)
+		if err == nil {
+			Users = &sqliteUsers{db: db}
+			collections = func(name string) Collection {
+				return &sqliteCollection{db: db, name: name}
+			}
+		}
+	case "memory":
+		Users = newMemoryUsers()
+		collections = memoryCollections()
+	default:
+		err = fmt.Errorf("unknown store %q", name)
+	}
+	return err
+}
+
+// OnUserChange registers f to be called with the ID of every user updated or
+// deleted through Users, so that anything caching user records can drop
+// them. Other instances sharing the store aren't told.
+func OnUserChange(f func(id string)) {
+	changeHooks = append(changeHooks, f)
+}
+
+type notifyingUsers struct {
+	UserStore
+}
+
+func (n notifyingUsers) Update(id string, updates ...Update) error {
+	defer userChanged(id)
+	return n.UserStore.Update(id, updates...)
+}
+
+func (n notifyingUsers) UpdateIf(id string, check Condition, updates ...Update) error {
+	defer userChanged(id)
+	return n.UserStore.UpdateIf(id, check, updates...)
+}
+
+func (n notifyingUsers) Delete(id string) error {
+	defer userChanged(id)
+	return n.UserStore.Delete(id)
+}
+
+func userChanged(id string) {
+	for _, f := range changeHooks {
+		f(id)
+	}
+}
+
+// Open returns the named collection from the configured backend. The
+// backend is looked up on every call so that UseMemory applies to
+// collections opened before it.
+func Open(name string) Collection {
+	return namedCollection(name)
+}
+
+type namedCollection string
+
+func (n namedCollection) Get(id string, v interface{}) error {
+	return collections(string(n)).Get(id, v)
+}
+
+func (n namedCollection) Set(id string, v interface{}) error {
+	return collections(string(n)).Set(id, v)
+}
+
+func (n namedCollection) Update(id string, v interface{}, change func() error) error {
+	return collections(string(n)).Update(id, v, change)
+}
+
+func (n namedCollection) Delete(id string) error {
+	return collections(string(n)).Delete(id)
+}
+
+func (n namedCollection) List() ([]Document, error) {
+	return collections(string(n)).List()
+}
+
+func (n namedCollection) Where(field, value string) ([]Document, error) {
+	return collections(string(n)).Where(field, value)
+}
+
+func (n namedCollection) Find(q Query) ([]Document, error) {
+	return collections(string(n)).Find(q)
+}
+
+type unavailableUsers struct {
+	err error
+}
+
+func (u unavailableUsers) Get(id string) (types.DBUser, error) {
+	return types.DBUser{}, u.err
+}
+
+func (u unavailableUsers) FindByEmail(email string) (types.DBUser, error) {
+	return types.DBUser{}, u.err
+}
+
+func (u unavailableUsers) Create(user types.DBUser) (string, error) {
+	return "", u.err
+}
+
+func (u unavailableUsers) Update(id string, updates ...Update) error {
+	return u.err
+}
+
+func (u unavailableUsers) UpdateIf(id string, check Condition, updates ...Update) error {
+	return u.err
+}
+
+func (u unavailableUsers) List() ([]types.DBUser, error) {
+	return nil, u.err
+}
+
+func (u unavailableUsers) Delete(id string) error {
+	return u.err
+}
+
+type unavailableCollection struct {
+	err error
+}
+
+func (u unavailableCollection) Get(id string, v interface{}) error {
+	return u.err
+}
+
+func (u unavailableCollection) Set(id string, v interface{}) error {
+	return u.err
+}
+
+func (u unavailableCollection) Update(id string, v interface{}, change func() error) error {
+	return u.err
+}
+
+func (u unavailableCollection) Delete(id string) error {
+	return u.err
+}
+
+func (u unavailableCollection) List() ([]Document, error) {
+	return nil, u.err
+}
+
+func (u unavailableCollection) Where(field, value string) ([]Document, error) {
+	return nil, u.err
+}
+
+func (u unavailableCollection) Find(q Query) ([]Document, error) {
+	return nil, u.err
+}
+
+func applyUpdates(user *types.DBUser, updates []Update) error {
+	v := reflect.ValueOf(user).Elem()
+	for _, u := range updates {
+		f := v.FieldByName(u.Path)
+		if !f.IsValid() || u.Path == "ID" {
+			return fmt.Errorf("cannot update field %q", u.Path)
+		}
+		val := reflect.ValueOf(u.Value)
+		if !val.IsValid() {
+			f.Set(reflect.Zero(f.Type()))
+			continue
+		}
+		if !val.Type().AssignableTo(f.Type()) {
+			return fmt.Errorf("cannot assign %s to field %q", val.Type(), u.Path)
+		}
+		f.Set(val)
+	}
+	return nil
+}
+
+func (q Query) matchID(id string) bool {
+	return (q.From == "" || id >= q.From) && (q.To == "" || id < q.To)
+}
+
+func (q Query) matchFields(doc Document) (bool, error) {
+	if len(q.Equal) == 0 {
+		return true, nil
+	}
+	var fields map[string]interface{}
+	if err := doc.DataTo(&fields); err != nil {
+		return false, err
+	}
+	for field, value := range q.Equal {
+		if v, ok := fields[field].(string); !ok || v != value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
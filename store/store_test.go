@@ -0,0 +1,346 @@
+package store
+
+import (
+	"errors"
+	"github.com/mthorning/go-sso/types"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type backend struct {
+	name        string
+	users       UserStore
+	collections func(name string) Collection
+}
+
+func backends(t *testing.T) []backend {
+	db, err := openSqlite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("opening sqlite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return []backend{
+		{"memory", newMemoryUsers(), memoryCollections()},
+		{"sqlite", &sqliteUsers{db: db}, func(name string) Collection {
+			return &sqliteCollection{db: db, name: name}
+		}},
+	}
+}
+
+type doc struct {
+	Owner string
+	Count int
+}
+
+func TestCollection(t *testing.T) {
+	for _, b := range backends(t) {
+		t.Run(b.name, func(t *testing.T) {
+			c := b.collections("things")
+			other := b.collections("others")
+
+			var got doc
+			if err := c.Get("a", &got); !isNotFound(err) {
+				t.Fatalf("Get of a missing document: got %v, want NotFoundError", err)
+			}
+			if err := c.Delete("a"); !isNotFound(err) {
+				t.Fatalf("Delete of a missing document: got %v, want NotFoundError", err)
+			}
+
+			sets := []struct {
+				id  string
+				doc doc
+			}{
+				{"a", doc{"alice", 1}},
+				{"b", doc{"bob", 2}},
+				{"c", doc{"alice", 3}},
+				{"a", doc{"alice", 4}},
+			}
+			for _, s := range sets {
+				if err := c.Set(s.id, s.doc); err != nil {
+					t.Fatalf("Set(%q): %v", s.id, err)
+				}
+			}
+			if err := other.Set("a", doc{"carol", 9}); err != nil {
+				t.Fatalf("Set in another collection: %v", err)
+			}
+
+			if err := c.Get("a", &got); err != nil || got != (doc{"alice", 4}) {
+				t.Fatalf("Get(a) = %+v, %v; want the last value set", got, err)
+			}
+
+			tests := []struct {
+				field, value string
+				want         []string
+			}{
+				{"Owner", "alice", []string{"a", "c"}},
+				{"Owner", "bob", []string{"b"}},
+				{"Owner", "carol", nil},
+				{"Missing", "alice", nil},
+			}
+			for _, tt := range tests {
+				docs, err := c.Where(tt.field, tt.value)
+				if err != nil {
+					t.Fatalf("Where(%q, %q): %v", tt.field, tt.value, err)
+				}
+				if ids := documentIDs(docs); !sameIDs(ids, tt.want) {
+					t.Errorf("Where(%q, %q) = %v, want %v", tt.field, tt.value, ids, tt.want)
+				}
+			}
+
+			if err := c.Delete("b"); err != nil {
+				t.Fatalf("Delete(b): %v", err)
+			}
+			if err := c.Get("b", &got); !isNotFound(err) {
+				t.Fatalf("Get of a deleted document: got %v, want NotFoundError", err)
+			}
+			// added last but listed first, as documents are in ID order
+			if err := c.Set("0", doc{"alice", 5}); err != nil {
+				t.Fatalf("Set(0): %v", err)
+			}
+			docs, err := c.List()
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			if ids := documentIDs(docs); !sameIDs(ids, []string{"0", "a", "c"}) {
+				t.Errorf("List = %v, want [0 a c]", ids)
+			}
+			for _, d := range docs {
+				var v doc
+				if err := d.DataTo(&v); err != nil || v.Owner != "alice" {
+					t.Errorf("DataTo(%s) = %+v, %v", d.ID(), v, err)
+				}
+			}
+		})
+	}
+}
+
+func TestFind(t *testing.T) {
+	for _, b := range backends(t) {
+		t.Run(b.name, func(t *testing.T) {
+			c := b.collections("found")
+			// set out of order so that insertion order isn't ID order
+			for _, id := range []string{"c", "a", "e", "b", "d"} {
+				owner := "alice"
+				if id == "b" || id == "d" {
+					owner = "bob"
+				}
+				if err := c.Set(id, doc{owner, 1}); err != nil {
+					t.Fatalf("Set(%q): %v", id, err)
+				}
+			}
+
+			tests := []struct {
+				name  string
+				query Query
+				want  []string
+			}{
+				{"all", Query{}, []string{"a", "b", "c", "d", "e"}},
+				{"descending", Query{Descending: true}, []string{"e", "d", "c", "b", "a"}},
+				{"from", Query{From: "c"}, []string{"c", "d", "e"}},
+				{"to", Query{To: "c"}, []string{"a", "b"}},
+				{"from and to", Query{From: "b", To: "d", Descending: true}, []string{"c", "b"}},
+				{"limit", Query{Limit: 2, Descending: true}, []string{"e", "d"}},
+				{"equal", Query{Equal: map[string]string{"Owner": "alice"}}, []string{"a", "c", "e"}},
+				{"equal with limit", Query{Equal: map[string]string{"Owner": "alice"}, Descending: true, Limit: 2}, []string{"e", "c"}},
+				{"nothing equal", Query{Equal: map[string]string{"Owner": "carol"}}, nil},
+			}
+			for _, tt := range tests {
+				docs, err := c.Find(tt.query)
+				if err != nil {
+					t.Fatalf("Find %s: %v", tt.name, err)
+				}
+				if ids := documentIDs(docs); !sameIDs(ids, tt.want) {
+					t.Errorf("Find %s = %v, want %v", tt.name, ids, tt.want)
+				}
+			}
+
+			docs, err := c.List()
+			if ids := documentIDs(docs); err != nil || !sameIDs(ids, []string{"a", "b", "c", "d", "e"}) {
+				t.Errorf("List = %v, %v; want them in ID order", ids, err)
+			}
+			docs, err = c.Where("Owner", "alice")
+			if ids := documentIDs(docs); err != nil || !sameIDs(ids, []string{"a", "c", "e"}) {
+				t.Errorf("Where = %v, %v; want them in ID order", ids, err)
+			}
+		})
+	}
+}
+
+func TestCollectionUpdate(t *testing.T) {
+	failed := errors.New("change failed")
+	tests := []struct {
+		name string
+		// stored is the document before the update, if there is one
+		stored  *doc
+		initial doc
+		err     error
+		want    doc
+	}{
+		{"new document starts from v", nil, doc{"alice", 1}, nil, doc{"alice", 2}},
+		{"existing document replaces v", &doc{"bob", 5}, doc{"alice", 1}, nil, doc{"bob", 6}},
+		{"failed change stores nothing", &doc{"bob", 5}, doc{}, failed, doc{"bob", 5}},
+	}
+	for _, b := range backends(t) {
+		for i, tt := range tests {
+			t.Run(b.name+" "+tt.name, func(t *testing.T) {
+				c := b.collections("updated")
+				id := string(rune('a' + i))
+				if tt.stored != nil {
+					if err := c.Set(id, *tt.stored); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				v := tt.initial
+				err := c.Update(id, &v, func() error {
+					v.Count++
+					return tt.err
+				})
+				if err != tt.err {
+					t.Fatalf("got %v, want %v", err, tt.err)
+				}
+				var got doc
+				if err := c.Get(id, &got); err != nil || got != tt.want {
+					t.Errorf("stored %+v, %v; want %+v", got, err, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestUsers(t *testing.T) {
+	for _, b := range backends(t) {
+		t.Run(b.name, func(t *testing.T) {
+			u := b.users
+
+			if _, err := u.Get("nobody"); !isNotFound(err) {
+				t.Fatalf("Get of a missing user: got %v, want NotFoundError", err)
+			}
+			if _, err := u.FindByEmail("nobody@example.com"); !isNotFound(err) {
+				t.Fatalf("FindByEmail of a missing user: got %v, want NotFoundError", err)
+			}
+			if err := u.Update("nobody", Update{"Name", "x"}); !isNotFound(err) {
+				t.Fatalf("Update of a missing user: got %v, want NotFoundError", err)
+			}
+			if err := u.Delete("nobody"); !isNotFound(err) {
+				t.Fatalf("Delete of a missing user: got %v, want NotFoundError", err)
+			}
+
+			created := time.Now().Truncate(time.Second)
+			id, err := u.Create(types.DBUser{
+				Name:    "Alice",
+				Email:   "alice@example.com",
+				Created: created,
+				Roles:   []string{"auditor"},
+			})
+			if err != nil || id == "" {
+				t.Fatalf("Create = %q, %v", id, err)
+			}
+			if _, err := u.Create(types.DBUser{Email: "bob@example.com", Created: created.Add(time.Second)}); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+
+			byEmail, err := u.FindByEmail("alice@example.com")
+			if err != nil || byEmail.ID != id {
+				t.Fatalf("FindByEmail = %+v, %v; want ID %s", byEmail, err, id)
+			}
+
+			updates := []struct {
+				name    string
+				updates []Update
+				wantErr bool
+			}{
+				{"set", []Update{{"Name", "Alice B"}}, false},
+				{"clear", []Update{{"Roles", nil}}, false},
+				{"wrong type", []Update{{"Name", 3}}, true},
+				{"unknown field", []Update{{"Nope", "x"}}, true},
+				{"ID", []Update{{"ID", "x"}}, true},
+			}
+			for _, tt := range updates {
+				err := u.Update(id, tt.updates...)
+				if (err != nil) != tt.wantErr {
+					t.Errorf("Update %s: got %v, want error %v", tt.name, err, tt.wantErr)
+				}
+			}
+
+			stop := errors.New("stop")
+			conditions := []struct {
+				name  string
+				check Condition
+				want  error
+			}{
+				{"refused", func(user types.DBUser, list func() ([]types.DBUser, error)) error {
+					return stop
+				}, stop},
+				{"sees the stored user", func(user types.DBUser, list func() ([]types.DBUser, error)) error {
+					if user.Name != "Alice B" {
+						return stop
+					}
+					return nil
+				}, nil},
+				{"lists every user", func(user types.DBUser, list func() ([]types.DBUser, error)) error {
+					all, err := list()
+					if err != nil {
+						return err
+					}
+					if len(all) != 2 {
+						return stop
+					}
+					return nil
+				}, nil},
+			}
+			for _, tt := range conditions {
+				err := u.UpdateIf(id, tt.check, Update{"DeletedBy", tt.name})
+				if err != tt.want {
+					t.Errorf("UpdateIf %s: got %v, want %v", tt.name, err, tt.want)
+				}
+			}
+
+			got, err := u.Get(id)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if got.DeletedBy != "lists every user" {
+				t.Errorf("DeletedBy = %q after UpdateIf", got.DeletedBy)
+			}
+			if got.Name != "Alice B" || got.Roles != nil || !got.Created.Equal(created) {
+				t.Errorf("Get = %+v after updates", got)
+			}
+
+			list, err := u.List()
+			if err != nil || len(list) != 2 || list[0].ID != id {
+				t.Fatalf("List = %+v, %v; want alice then bob", list, err)
+			}
+
+			if err := u.Delete(id); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := u.Get(id); !isNotFound(err) {
+				t.Fatalf("Get of a deleted user: got %v, want NotFoundError", err)
+			}
+		})
+	}
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(NotFoundError)
+	return ok
+}
+
+func documentIDs(docs []Document) []string {
+	var ids []string
+	for _, d := range docs {
+		ids = append(ids, d.ID())
+	}
+	return ids
+}
+
+func sameIDs(got, want []string) bool {
+	if len(got) == 0 && len(want) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(got, want)
+}
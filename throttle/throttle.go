@@ -0,0 +1,265 @@
+// Package throttle slows down password guessing. Failures are counted per
+// account and per client IP; after a few of them each further attempt has
+// to wait twice as long as the last, and an account that keeps failing is
+// locked for a while. Emails sent on request are counted the same way, per
+// address and per IP.
+package throttle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/mthorning/go-sso/config"
+	"github.com/mthorning/go-sso/store"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// ThrottleStore is "memory" for a single instance, or "store" to share
+	// counts between instances through the configured store.
+	ThrottleStore string `default:"memory" split_words:"true"`
+	// ThrottleWindow is how long a failure is remembered for.
+	ThrottleWindow time.Duration `default:"1h" split_words:"true"`
+	// ThrottleSweepInterval is how often the memory store forgets records
+	// that have outlived the window.
+	ThrottleSweepInterval time.Duration `default:"10m" split_words:"true"`
+	BackoffBase           time.Duration `default:"1s" split_words:"true"`
+	BackoffMax            time.Duration `default:"5m" split_words:"true"`
+	AccountBackoff        int           `default:"3" split_words:"true"`
+	IPBackoff             int           `envconfig:"ip_backoff" default:"10"`
+	LockoutThreshold      int           `default:"10" split_words:"true"`
+	MailBackoff           int           `default:"3" split_words:"true"`
+	MailIPBackoff         int           `envconfig:"mail_ip_backoff" default:"10"`
+	LockoutDuration       time.Duration `default:"15m" split_words:"true"`
+}
+
+// Record counts failures for a key. Attempts count as failures until they
+// succeed, so LastFailure is really the last attempt.
+type Record struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// expired reports whether r no longer counts against anyone.
+func (r Record) expired(now time.Time) bool {
+	return now.Sub(r.LastFailure) > Conf.ThrottleWindow && now.After(r.LockedUntil)
+}
+
+type Store interface {
+	Get(key string) (Record, error)
+	// Update changes the record for key, starting from the zero Record if
+	// there isn't one. Concurrent updates to a key must not lose changes.
+	Update(key string, change func(r *Record)) error
+	Delete(key string) error
+}
+
+// Kind is what is being counted. Accounts are locked out; IPs, which may
+// be shared by many people, only ever back off.
+type Kind struct {
+	prefix  string
+	backoff func() int
+	lockout bool
+}
+
+var (
+	Account = Kind{prefix: "account", backoff: func() int { return Conf.AccountBackoff }, lockout: true}
+	IP      = Kind{prefix: "ip", backoff: func() int { return Conf.IPBackoff }}
+	// Mail and MailIP count emails sent, such as reset links, which nobody
+	// can take back by succeeding.
+	Mail   = Kind{prefix: "mail", backoff: func() int { return Conf.MailBackoff }}
+	MailIP = Kind{prefix: "mail-ip", backoff: func() int { return Conf.MailIPBackoff }}
+)
+
+var (
+	Conf     Config
+	Failures Store
+)
+
+func init() {
+	config.SetConfig(&Conf)
+	if Conf.ThrottleStore == "store" {
+		Failures = &storeFailures{c: store.Open("throttle")}
+	} else {
+		Failures = &memoryFailures{records: map[string]Record{}}
+	}
+}
+
+// key hashes the email or IP so they aren't kept in the clear.
+func (k Kind) key(id string) string {
+	sum := sha256.Sum256([]byte(k.prefix + ":" + strings.ToLower(id)))
+	return hex.EncodeToString(sum[:])
+}
+
+// current drops an expired record, and turns a count that has reached the
+// lockout threshold into a lockout starting from the last attempt.
+func (k Kind) current(r Record, now time.Time) Record {
+	if r.expired(now) {
+		return Record{}
+	}
+	if k.lockout && r.Failures >= Conf.LockoutThreshold {
+		r.Failures = 0
+		r.LockedUntil = r.LastFailure.Add(Conf.LockoutDuration)
+	}
+	return r
+}
+
+func (k Kind) get(id string) (Record, error) {
+	r, err := Failures.Get(k.key(id))
+	if err != nil {
+		return Record{}, err
+	}
+	return k.current(r, time.Now()), nil
+}
+
+func (k Kind) wait(r Record, now time.Time) time.Duration {
+	if now.Before(r.LockedUntil) {
+		return r.LockedUntil.Sub(now)
+	}
+
+	over := r.Failures - k.backoff()
+	if over <= 0 {
+		return 0
+	}
+	delay := Conf.BackoffMax
+	if over < 32 && Conf.BackoffBase<<uint(over-1) < Conf.BackoffMax {
+		delay = Conf.BackoffBase << uint(over-1)
+	}
+	if wait := r.LastFailure.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Wait returns how long until another attempt for id will be accepted.
+func (k Kind) Wait(id string) (time.Duration, error) {
+	r, err := k.get(id)
+	if err != nil {
+		return 0, err
+	}
+	return k.wait(r, time.Now()), nil
+}
+
+// Attempt returns how long to wait if an attempt for id isn't allowed yet.
+// Otherwise it counts the attempt as failed before it is made, so that
+// parallel attempts can't all get in before any of them has failed; call
+// Succeeded if it turns out to be right.
+func (k Kind) Attempt(id string) (time.Duration, error) {
+	var wait time.Duration
+	err := Failures.Update(k.key(id), func(r *Record) {
+		now := time.Now()
+		*r = k.current(*r, now)
+		if wait = k.wait(*r, now); wait > 0 {
+			return
+		}
+		r.Failures++
+		r.LastFailure = now
+	})
+	return wait, err
+}
+
+// Succeeded takes back an attempt that turned out to be right.
+func (k Kind) Succeeded(id string) error {
+	return Failures.Update(k.key(id), func(r *Record) {
+		if r.Failures > 0 {
+			r.Failures--
+		}
+	})
+}
+
+// Reset forgets id's failures, after a successful attempt or when an admin
+// unlocks an account.
+func (k Kind) Reset(id string) error {
+	return Failures.Delete(k.key(id))
+}
+
+// LockedUntil returns when the account's lockout ends, or the zero time if
+// it isn't locked.
+func (k Kind) LockedUntil(id string) (time.Time, error) {
+	r, err := k.get(id)
+	if err != nil || time.Now().After(r.LockedUntil) {
+		return time.Time{}, err
+	}
+	return r.LockedUntil, nil
+}
+
+type memoryFailures struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+func (m *memoryFailures) Get(key string) (Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.records[key], nil
+}
+
+func (m *memoryFailures) Update(key string, change func(r *Record)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.records[key]
+	change(&r)
+	m.records[key] = r
+	return nil
+}
+
+// SweepFailures forgets expired records every ThrottleSweepInterval until
+// the process exits. The store's records aren't swept; they are replaced
+// when they are next counted against.
+func SweepFailures() {
+	m, ok := Failures.(*memoryFailures)
+	if !ok || Conf.ThrottleSweepInterval <= 0 {
+		return
+	}
+	m.sweep(time.Tick(Conf.ThrottleSweepInterval))
+}
+
+// sweep forgets the records expired at each tick until tick is closed.
+func (m *memoryFailures) sweep(tick <-chan time.Time) {
+	for now := range tick {
+		m.mu.Lock()
+		for k, r := range m.records {
+			if r.expired(now) {
+				delete(m.records, k)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *memoryFailures) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, key)
+	return nil
+}
+
+type storeFailures struct {
+	c store.Collection
+}
+
+func (s *storeFailures) Get(key string) (Record, error) {
+	var r Record
+	err := s.c.Get(key, &r)
+	if _, ok := err.(store.NotFoundError); ok {
+		return Record{}, nil
+	}
+	return r, err
+}
+
+func (s *storeFailures) Update(key string, change func(r *Record)) error {
+	var r Record
+	return s.c.Update(key, &r, func() error {
+		change(&r)
+		return nil
+	})
+}
+
+func (s *storeFailures) Delete(key string) error {
+	err := s.c.Delete(key)
+	if _, ok := err.(store.NotFoundError); ok {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package throttle
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAttemptBurst(t *testing.T) {
+	const n = 50
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		allowed int
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := Account.Attempt("burst@example.com")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if wait == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the attempt that takes the count to the backoff threshold is still
+	// allowed straight away
+	if want := Conf.AccountBackoff + 1; allowed != want {
+		t.Errorf("%d of %d parallel attempts allowed, want %d", allowed, n, want)
+	}
+}
+
+func TestAttempt(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		succeeded bool
+		// backdate each attempt so that the backoff doesn't refuse the next
+		backdate bool
+		wantWait bool
+		wantLock bool
+	}{
+		{"under the backoff", Conf.AccountBackoff, false, false, false, false},
+		{"backing off", Conf.AccountBackoff + 1, false, false, true, false},
+		{"successes are taken back", Conf.LockoutThreshold + 5, true, false, false, false},
+		{"locked out", Conf.LockoutThreshold, false, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := tt.name + "@example.com"
+			defer Account.Reset(id)
+
+			for i := 0; i < tt.failures; i++ {
+				if _, err := Account.Attempt(id); err != nil {
+					t.Fatal(err)
+				}
+				if tt.succeeded {
+					if err := Account.Succeeded(id); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if tt.backdate {
+					Failures.Update(Account.key(id), func(r *Record) {
+						r.LastFailure = r.LastFailure.Add(-Conf.BackoffMax)
+					})
+				}
+			}
+
+			wait, err := Account.Attempt(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (wait > 0) != tt.wantWait {
+				t.Errorf("Attempt wait = %v, want a wait %v", wait, tt.wantWait)
+			}
+			until, err := Account.LockedUntil(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !until.IsZero() != tt.wantLock {
+				t.Errorf("LockedUntil = %v, want locked %v", until, tt.wantLock)
+			}
+		})
+	}
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+	m := &memoryFailures{records: map[string]Record{
+		"recent":    {Failures: 1, LastFailure: now.Add(-time.Minute)},
+		"forgotten": {Failures: 1, LastFailure: now.Add(-Conf.ThrottleWindow - time.Minute)},
+		// a lockout outlasting the window is kept until it ends
+		"locked": {LastFailure: now.Add(-Conf.ThrottleWindow - time.Minute), LockedUntil: now.Add(time.Minute)},
+	}}
+
+	tick := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		m.sweep(tick)
+		close(done)
+	}()
+	tick <- now
+	close(tick)
+	<-done
+
+	for key, want := range map[string]bool{"recent": true, "forgotten": false, "locked": true} {
+		if _, ok := m.records[key]; ok != want {
+			t.Errorf("%s kept = %v, want %v", key, ok, want)
+		}
+	}
+}
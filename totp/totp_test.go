@@ -0,0 +1,99 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// secret is the RFC 6238 SHA-1 test key, "12345678901234567890".
+var secret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+// TestRFC6238 uses the SHA-1 vectors from RFC 6238 Appendix B, cut to the
+// last six digits.
+func TestRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		at := time.Unix(tt.unix, 0)
+		step, ok := Validate(secret, tt.want, at)
+		if !ok {
+			t.Errorf("%d: %s not accepted", tt.unix, tt.want)
+			continue
+		}
+		if step != Step(at) {
+			t.Errorf("%d: matched step %d, want %d", tt.unix, step, Step(at))
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		secret string
+		want   bool
+	}{
+		{"current step", code(key, Step(now)), secret, true},
+		{"one step behind", code(key, Step(now)-1), secret, true},
+		{"one step ahead", code(key, Step(now)+1), secret, true},
+		{"two steps behind", code(key, Step(now)-2), secret, false},
+		{"two steps ahead", code(key, Step(now)+2), secret, false},
+		{"spaced", "050 471", secret, true},
+		{"lower case secret", "050471", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", true},
+		{"too short", "50471", secret, false},
+		{"too long", "0504710", secret, false},
+		{"wrong code", "123456", secret, false},
+		{"bad secret", "050471", "not base32!", false},
+		{"empty secret", "050471", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := Validate(tt.secret, tt.input, now); ok != tt.want {
+				t.Errorf("Validate(%q) = %v, want %v", tt.input, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != Conf.RecoveryCodes || len(hashes) != len(codes) {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), Conf.RecoveryCodes)
+	}
+	seen := map[string]bool{}
+	for i, c := range codes {
+		if seen[c] {
+			t.Errorf("%s generated twice", c)
+		}
+		seen[c] = true
+		if hashes[i] == c || hashes[i] != HashRecoveryCode(c) {
+			t.Errorf("%s not stored as its hash", c)
+		}
+	}
+
+	spaced := " " + codes[0][:5] + " " + codes[0][6:] + " "
+	for _, typed := range []string{codes[0], spaced, strings.ToUpper(codes[0]), codes[0][:5] + codes[0][6:]} {
+		if HashRecoveryCode(typed) != hashes[0] {
+			t.Errorf("%q doesn't match %s", typed, codes[0])
+		}
+	}
+}
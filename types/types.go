@@ -1,39 +1,132 @@
 package types
 
 import (
-	"context"
-	"github.com/mthorning/go-sso/firestore"
+	"encoding/base64"
+	"github.com/mthorning/go-sso/roles"
 	"time"
 )
 
 type User struct {
-	ID      string
+	ID      string `firestore:"-"`
 	Name    string
-	Admin   bool
+	Roles   []string
 	Email   string
 	Created time.Time
 }
 
 type DBUser struct {
-	ID       string
+	ID       string `firestore:"-"`
 	Name     string
 	Password []byte
 	Email    string
-	Admin    bool
-	Created  time.Time
+	// Admin is the flag used before roles. It still counts as the admin
+	// role, and is cleared once the user's roles are next saved.
+	Admin   bool
+	Roles   []string
+	Created time.Time
+
+	EmailVerified bool
+	// PasswordHistory holds the hashes of recent previous passwords, newest
+	// first, so they can't be reused.
+	PasswordHistory [][]byte
+
+	TOTPEnabled bool
+	TOTPSecret  string
+	// TOTPPendingSecret is held until the user proves their app has it.
+	TOTPPendingSecret string
+	// TOTPLastStep is the time step of the last accepted code, so a code
+	// can't be replayed within its validity window.
+	TOTPLastStep  int64
+	RecoveryCodes []string
+
+	Passkeys []Passkey
+
+	// Disabled users keep their account but can't sign in.
+	Disabled bool
+	// DeletedAt marks a soft-deleted user, who is purged for good once the
+	// retention period has passed.
+	DeletedAt time.Time
+	DeletedBy string
+}
+
+// Passkey is a registered WebAuthn credential.
+type Passkey struct {
+	ID              []byte
+	Name            string
+	PublicKey       []byte
+	AttestationType string
+	AAGUID          []byte
+	SignCount       uint32
+	// CloneWarning is set when the authenticator's sign counter went
+	// backwards, meaning the key may have been copied. It can no longer be
+	// used to sign in.
+	CloneWarning bool
+	Created      time.Time
+	LastUsed     time.Time
+}
+
+// KeyID is the credential ID as it appears in URLs.
+func (p Passkey) KeyID() string {
+	return base64.RawURLEncoding.EncodeToString(p.ID)
+}
+
+// NeedsSecondFactor reports whether a password alone isn't enough to sign in.
+func (u DBUser) NeedsSecondFactor() bool {
+	return u.TOTPEnabled || len(u.Passkeys) > 0
+}
+
+func (u DBUser) Deleted() bool {
+	return !u.DeletedAt.IsZero()
+}
+
+// Active reports whether the user is allowed to sign in and keep a session.
+func (u DBUser) Active() bool {
+	return !u.Disabled && !u.Deleted()
+}
+
+// RoleNames returns the user's roles, including admin for the old flag.
+func (u DBUser) RoleNames() []string {
+	if u.Admin && !contains(u.Roles, roles.Admin) {
+		return append([]string{roles.Admin}, u.Roles...)
+	}
+	return u.Roles
+}
+
+func (u DBUser) HasRole(role string) bool {
+	return contains(u.RoleNames(), role)
+}
+
+func (u DBUser) Can(permission string) bool {
+	return roles.Allows(u.RoleNames(), permission)
 }
 
 type SessionUser struct {
 	ID    string
 	Name  string
-	Admin bool
+	Roles []string
+	// SessionKey identifies the session in the user's session list.
+	SessionKey string
+}
+
+func (u SessionUser) Can(permission string) bool {
+	return roles.Allows(u.Roles, permission)
+}
+
+func (u DBUser) User() User {
+	return User{
+		ID:      u.ID,
+		Name:    u.Name,
+		Roles:   u.RoleNames(),
+		Email:   u.Email,
+		Created: u.Created,
+	}
 }
 
-func (s *SessionUser) GetUser(u interface{}) error {
-	dsnap, err := firestore.Users.Doc(s.ID).Get(context.Background())
-	if err != nil {
-		return err
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
 	}
-	dsnap.DataTo(u)
-	return nil
+	return false
 }
@@ -0,0 +1,94 @@
+// Package verify creates and checks the signed links sent to prove a user
+// owns their email address. Links aren't stored; they are tied to the
+// address they were sent to, so changing it invalidates older links, and
+// they are only good while that address is unverified, so each can be used
+// once.
+package verify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/mthorning/go-sso/config"
+	"github.com/mthorning/go-sso/types"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSecret = "devverificationsecret"
+
+type Config struct {
+	VerificationSecret   string        `default:"devverificationsecret" split_words:"true"`
+	VerificationLifetime time.Duration `default:"24h" split_words:"true"`
+	// RequireVerifiedEmail stops unverified users signing in. Turn it on once
+	// existing users have verified their addresses.
+	RequireVerifiedEmail bool `default:"false" split_words:"true"`
+}
+
+var Conf Config
+
+func init() {
+	config.SetConfig(&Conf)
+	// anyone could sign links with the default, which is harmless until
+	// being verified lets you sign in
+	if Conf.RequireVerifiedEmail && Conf.VerificationSecret == defaultSecret {
+		log.Fatal("SSO_VERIFICATION_SECRET must be set when SSO_REQUIRE_VERIFIED_EMAIL is")
+	}
+}
+
+type InvalidTokenError struct{}
+
+func (e InvalidTokenError) Error() string {
+	return "This verification link is not valid"
+}
+
+type ExpiredTokenError struct{}
+
+func (e ExpiredTokenError) Error() string {
+	return "This verification link has expired"
+}
+
+var encoding = base64.RawURLEncoding
+
+func sign(payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(Conf.VerificationSecret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func NewToken(user types.DBUser) string {
+	expires := time.Now().Add(Conf.VerificationLifetime).Unix()
+	payload := strings.Join([]string{user.ID, user.Email, strconv.FormatInt(expires, 10)}, "\n")
+	return encoding.EncodeToString([]byte(payload)) + "." + encoding.EncodeToString(sign(payload))
+}
+
+// CheckToken returns the user and the address the token was issued for.
+func CheckToken(token string) (string, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", "", InvalidTokenError{}
+	}
+	payload, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", InvalidTokenError{}
+	}
+	sig, err := encoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, sign(string(payload))) {
+		return "", "", InvalidTokenError{}
+	}
+
+	fields := strings.Split(string(payload), "\n")
+	if len(fields) != 3 {
+		return "", "", InvalidTokenError{}
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", "", InvalidTokenError{}
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return "", "", ExpiredTokenError{}
+	}
+	return fields[0], fields[1], nil
+}
@@ -0,0 +1,70 @@
+package verify
+
+import (
+	"github.com/mthorning/go-sso/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withConf changes the configuration for the rest of the test.
+func withConf(t *testing.T, change func(c *Config)) {
+	old := Conf
+	t.Cleanup(func() { Conf = old })
+	change(&Conf)
+}
+
+func TestCheckToken(t *testing.T) {
+	user := types.DBUser{ID: "user-id", Email: "someone@verify.test"}
+
+	tests := []struct {
+		name    string
+		token   func(t *testing.T) string
+		wantErr error
+	}{
+		{"valid", func(t *testing.T) string {
+			return NewToken(user)
+		}, nil},
+		{"expired", func(t *testing.T) string {
+			withConf(t, func(c *Config) { c.VerificationLifetime = -time.Minute })
+			return NewToken(user)
+		}, ExpiredTokenError{}},
+		{"signed with another secret", func(t *testing.T) string {
+			secret := Conf.VerificationSecret
+			defer func() { Conf.VerificationSecret = secret }()
+			Conf.VerificationSecret = "another secret"
+			return NewToken(user)
+		}, InvalidTokenError{}},
+		{"changed address", func(t *testing.T) string {
+			parts := strings.Split(NewToken(user), ".")
+			payload, _ := encoding.DecodeString(parts[0])
+			parts[0] = encoding.EncodeToString([]byte(strings.Replace(string(payload), user.Email, "attacker@verify.test", 1)))
+			return strings.Join(parts, ".")
+		}, InvalidTokenError{}},
+		{"another token's signature", func(t *testing.T) string {
+			other := types.DBUser{ID: "other-id", Email: user.Email}
+			return strings.Split(NewToken(user), ".")[0] + "." + strings.Split(NewToken(other), ".")[1]
+		}, InvalidTokenError{}},
+		{"no signature", func(t *testing.T) string {
+			return strings.Split(NewToken(user), ".")[0]
+		}, InvalidTokenError{}},
+		{"not base64", func(t *testing.T) string {
+			return "!!!.!!!"
+		}, InvalidTokenError{}},
+		{"empty", func(t *testing.T) string {
+			return ""
+		}, InvalidTokenError{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token(t)
+			userID, email, err := CheckToken(token)
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (userID != user.ID || email != user.Email) {
+				t.Errorf("got %q and %q, want %q and %q", userID, email, user.ID, user.Email)
+			}
+		})
+	}
+}